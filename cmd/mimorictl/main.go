@@ -2,20 +2,34 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
+	"github.com/jerkeyray/mimori/internal/api/adminpb"
 	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/meta"
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
 )
 
 // Server address for the node (can be overridden by flag or env)
 var addr string
 
+// Range the raft and member commands act on, 0 for the first range
+var rangeID uint64
+
 // Default timeout for requests
 const timeout = 3 * time.Second
 
@@ -35,8 +49,14 @@ to a MimoriDB node running locally or remotely.`,
 	rootCmd.AddCommand(
 		newPutCmd(),
 		newGetCmd(),
+		newScanCmd(),
 		newDelCmd(),
+		newBatchCmd(),
 		newHealthCmd(),
+		newRaftCmd(),
+		newMemberCmd(),
+		newTopCmd(),
+		newMetaCmd(),
 	)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -48,43 +68,87 @@ to a MimoriDB node running locally or remotely.`,
 
 // newPutCmd creates the "put" subcommand: mimorictl put key value
 func newPutCmd() *cobra.Command {
-	return &cobra.Command{
+	var ifAbsent bool
+	var expect string
+	var expectRevision uint64
+
+	cmd := &cobra.Command{
 		Use:   "put [key] [value]",
 		Short: "Store a key/value pair in the database",
 		Args:  cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
 			key := []byte(args[0])
 			val := []byte(args[1])
-			client := mustConnect()
-			defer client.Close()
 
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
+			switch {
+			case ifAbsent:
+				conditional(func(ctx context.Context, client *clientWrapper) (*kv.ConditionalResponse, error) {
+					return client.Client.PutIfAbsent(ctx, &kv.PutIfAbsentRequest{Key: key, Value: val})
+				})
+				return
+			case cmd.Flags().Changed("expect"):
+				conditional(func(ctx context.Context, client *clientWrapper) (*kv.ConditionalResponse, error) {
+					return client.Client.CompareAndSwap(ctx, &kv.CompareAndSwapRequest{Key: key, Expected: []byte(expect), Value: val})
+				})
+				return
+			}
 
-			_, err := client.Client.Put(ctx, &kv.PutRequest{Key: key, Value: val})
+			var resp *kv.PutResponse
+			err := withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+				var err error
+				resp, err = client.Client.Put(ctx, &kv.PutRequest{Key: key, Value: val, ExpectedModRevision: expectRevision})
+				return err
+			})
 			if err != nil {
 				log.Fatalf("put failed: %v", err)
 			}
+			if !resp.Ok {
+				fmt.Printf("condition failed, key last written at revision %d\n", resp.ModRevision)
+				os.Exit(1)
+			}
 			fmt.Println("ok")
 		},
 	}
+	cmd.Flags().BoolVar(&ifAbsent, "if-absent", false, "only store the pair if the key does not exist yet")
+	cmd.Flags().StringVar(&expect, "expect", "", "only store the pair if the key holds this value")
+	cmd.Flags().Uint64Var(&expectRevision, "expect-revision", 0, "only store the pair if the key was last written at this revision")
+	cmd.MarkFlagsMutuallyExclusive("if-absent", "expect", "expect-revision")
+	return cmd
 }
 
 // newGetCmd creates "get" subcommand: mimorictl get key
 func newGetCmd() *cobra.Command {
-	return &cobra.Command{
+	var consistency, asOf string
+	var revisions bool
+	var asOfRevision uint64
+
+	cmd := &cobra.Command{
 		Use:   "get [key]",
 		Short: "Fetch a value for a key",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			key := []byte(args[0])
-			client := mustConnect()
-			defer client.Close()
 
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
+			level, ok := kv.Consistency_value[strings.ToUpper(consistency)]
+			if !ok {
+				log.Fatalf("unknown consistency %q, want linearizable, lease or stale", consistency)
+			}
+			at, err := parseAsOf(asOf)
+			if err != nil {
+				log.Fatal(err)
+			}
 
-			resp, err := client.Client.Get(ctx, &kv.GetRequest{Key: key})
+			var resp *kv.GetResponse
+			err = withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+				var err error
+				resp, err = client.Client.Get(ctx, &kv.GetRequest{
+					Key:          key,
+					Consistency:  kv.Consistency(level),
+					AsOfRevision: asOfRevision,
+					AsOfTime:     at,
+				})
+				return err
+			})
 			if err != nil {
 				log.Fatalf("get failed: %v", err)
 			}
@@ -94,31 +158,200 @@ func newGetCmd() *cobra.Command {
 				return
 			}
 			fmt.Printf("%s\n", string(resp.Value))
+			if revisions {
+				fmt.Printf("create revision %d, mod revision %d, version %d\n", resp.CreateRevision, resp.ModRevision, resp.Version)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&consistency, "consistency", "linearizable", "read consistency: linearizable, lease or stale")
+	cmd.Flags().BoolVar(&revisions, "revisions", false, "also print the key's revisions")
+	cmd.Flags().Uint64Var(&asOfRevision, "as-of-revision", 0, "read the key as it was at this revision")
+	cmd.Flags().StringVar(&asOf, "as-of", "", "read the key as it was at this time, RFC 3339 or a duration ago like 1h")
+	cmd.MarkFlagsMutuallyExclusive("as-of-revision", "as-of")
+	return cmd
+}
+
+// newScanCmd creates "scan" subcommand: mimorictl scan --prefix user: --limit 100
+func newScanCmd() *cobra.Command {
+	var start, end, prefix, consistency, pageToken, asOf string
+	var limit uint32
+	var reverse bool
+	var asOfRevision uint64
+
+	cmd := &cobra.Command{
+		Use:   "scan",
+		Short: "List the key/value pairs in a key range",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			level, ok := kv.Consistency_value[strings.ToUpper(consistency)]
+			if !ok {
+				log.Fatalf("unknown consistency %q, want linearizable, lease or stale", consistency)
+			}
+			token, err := hex.DecodeString(pageToken)
+			if err != nil {
+				log.Fatalf("bad page token %q: %v", pageToken, err)
+			}
+			at, err := parseAsOf(asOf)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			client := mustConnect()
+			defer client.Close()
+
+			// pairs are printed as they arrive, the node walks every range
+			stream, err := client.Client.Scan(context.Background(), &kv.ScanRequest{
+				Start:        []byte(start),
+				End:          []byte(end),
+				Prefix:       []byte(prefix),
+				Reverse:      reverse,
+				Limit:        limit,
+				Consistency:  kv.Consistency(level),
+				PageToken:    token,
+				AsOfRevision: asOfRevision,
+				AsOfTime:     at,
+			})
+			if err != nil {
+				log.Fatalf("scan failed: %v", err)
+			}
+			for {
+				resp, err := stream.Recv()
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					log.Fatalf("scan failed: %v", err)
+				}
+				for _, pair := range resp.Kvs {
+					fmt.Printf("%s\t%s\n", pair.Key, pair.Value)
+				}
+				if len(resp.NextPageToken) > 0 {
+					next := fmt.Sprintf("--page-token %x", resp.NextPageToken)
+					if at != 0 {
+						// the next page must be read as of the same time
+						next += " --as-of " + time.Unix(0, at).Format(time.RFC3339Nano)
+					}
+					fmt.Fprintf(os.Stderr, "more pairs follow, continue with %s\n", next)
+				}
+			}
 		},
 	}
+	cmd.Flags().StringVar(&start, "start", "", "first key to list")
+	cmd.Flags().StringVar(&end, "end", "", "list keys before this one")
+	cmd.Flags().StringVar(&prefix, "prefix", "", "only list keys starting with this")
+	cmd.Flags().Uint32Var(&limit, "limit", 0, "most pairs to list, 0 for all")
+	cmd.Flags().BoolVar(&reverse, "reverse", false, "list from the largest key down")
+	cmd.Flags().StringVar(&consistency, "consistency", "linearizable", "read consistency: linearizable, lease or stale")
+	cmd.Flags().StringVar(&pageToken, "page-token", "", "resume where a previous scan stopped")
+	cmd.Flags().Uint64Var(&asOfRevision, "as-of-revision", 0, "list the pairs as they were at this revision, within one range")
+	cmd.Flags().StringVar(&asOf, "as-of", "", "list the pairs as they were at this time, RFC 3339 or a duration ago like 1h")
+	cmd.MarkFlagsMutuallyExclusive("as-of-revision", "as-of")
+	return cmd
+}
+
+// parseAsOf reads a time to read as of, either RFC 3339 or a duration before
+// now, into unix nanoseconds, 0 if it isn't set
+func parseAsOf(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d).UnixNano(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("bad --as-of %q, want RFC 3339 or a duration like 1h", s)
+	}
+	return t.UnixNano(), nil
 }
 
 // newDelCmd creates "del" subcommand: mimorictl del key
 func newDelCmd() *cobra.Command {
-	return &cobra.Command{
+	var expect string
+
+	cmd := &cobra.Command{
 		Use:   "del [key]",
 		Short: "Delete a key from the database",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			key := []byte(args[0])
-			client := mustConnect()
-			defer client.Close()
 
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
+			if cmd.Flags().Changed("expect") {
+				conditional(func(ctx context.Context, client *clientWrapper) (*kv.ConditionalResponse, error) {
+					return client.Client.CompareAndDelete(ctx, &kv.CompareAndDeleteRequest{Key: key, Expected: []byte(expect)})
+				})
+				return
+			}
 
-			_, err := client.Client.Delete(ctx, &kv.DeleteRequest{Key: key})
+			err := withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+				_, err := client.Client.Delete(ctx, &kv.DeleteRequest{Key: key})
+				return err
+			})
 			if err != nil {
 				log.Fatalf("delete failed: %v", err)
 			}
 			fmt.Println("deleted")
 		},
 	}
+	cmd.Flags().StringVar(&expect, "expect", "", "only delete the key if it holds this value")
+	return cmd
+}
+
+// conditional runs a conditional write and prints its outcome, exiting
+// with status 1 if its condition failed so scripts can tell
+func conditional(call func(ctx context.Context, client *clientWrapper) (*kv.ConditionalResponse, error)) {
+	var resp *kv.ConditionalResponse
+	err := withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+		var err error
+		resp, err = call(ctx, client)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("conditional write failed: %v", err)
+	}
+	switch {
+	case resp.Succeeded:
+		fmt.Println("ok")
+		return
+	case resp.CurrentFound:
+		fmt.Printf("condition failed, current value: %s\n", resp.CurrentValue)
+	default:
+		fmt.Println("condition failed, key does not exist")
+	}
+	os.Exit(1)
+}
+
+// newBatchCmd creates "batch" subcommand: mimorictl batch put k1 v1 del k2 ...
+func newBatchCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "batch (put [key] [value] | del [key])...",
+		Short: "Apply several puts and deletes atomically, their keys must share a range",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ops []*kv.BatchOp
+			for len(args) > 0 {
+				switch {
+				case args[0] == "put" && len(args) >= 3:
+					ops = append(ops, &kv.BatchOp{Key: []byte(args[1]), Value: []byte(args[2])})
+					args = args[3:]
+				case args[0] == "del" && len(args) >= 2:
+					ops = append(ops, &kv.BatchOp{Key: []byte(args[1]), Delete: true})
+					args = args[2:]
+				default:
+					log.Fatalf("expected put [key] [value] or del [key], got %q", args)
+				}
+			}
+
+			err := withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+				_, err := client.Client.Batch(ctx, &kv.BatchRequest{Ops: ops})
+				return err
+			})
+			if err != nil {
+				log.Fatalf("batch failed: %v", err)
+			}
+			fmt.Println("ok")
+		},
+	}
 }
 
 // newHealthCmd creates "health" subcommand: mimorictl health
@@ -143,11 +376,410 @@ func newHealthCmd() *cobra.Command {
 	}
 }
 
+// newRaftCmd groups commands that manage the raft cluster
+func newRaftCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "raft",
+		Short: "Manage the raft cluster",
+	}
+	cmd.PersistentFlags().Uint64Var(&rangeID, "range", 0, "range whose raft group to manage, 0 for the one holding the first key")
+	cmd.AddCommand(newTransferLeaderCmd())
+	return cmd
+}
+
+// newTransferLeaderCmd creates "raft transfer-leader": mimorictl raft transfer-leader node
+func newTransferLeaderCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "transfer-leader [node]",
+		Short: "Hand leadership over to another node",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var resp *adminpb.TransferLeaderResponse
+			err := withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+				var err error
+				resp, err = client.Admin.TransferLeader(ctx, &adminpb.TransferLeaderRequest{TargetId: args[0], RangeId: rangeID})
+				return err
+			})
+			if err != nil {
+				log.Fatalf("transfer failed: %v", err)
+			}
+			fmt.Printf("leader is now %s\n", resp.LeaderId)
+		},
+	}
+}
+
+// newMemberCmd groups commands that change who is in the cluster
+func newMemberCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "member",
+		Short: "List, add or remove cluster members",
+	}
+	cmd.PersistentFlags().Uint64Var(&rangeID, "range", 0, "range whose members to manage, 0 for the one holding the first key")
+	cmd.AddCommand(newMemberListCmd(), newMemberAddCmd(), newMemberRemoveCmd())
+	return cmd
+}
+
+// newMemberListCmd creates "member list": mimorictl member list
+func newMemberListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "Show the voters and learners in the cluster",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var resp *adminpb.ListMembersResponse
+			err := withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+				var err error
+				resp, err = client.Admin.ListMembers(ctx, &adminpb.ListMembersRequest{RangeId: rangeID})
+				return err
+			})
+			if err != nil {
+				log.Fatalf("list failed: %v", err)
+			}
+			printMembers(resp.Members)
+			if resp.QuorumRisk != "" {
+				fmt.Printf("\nwarning: a majority of voters is in %s, losing it loses quorum\n", resp.QuorumRisk)
+			}
+		},
+	}
+}
+
+// newMemberAddCmd creates "member add": mimorictl member add node [--learner]
+func newMemberAddCmd() *cobra.Command {
+	var learner bool
+	cmd := &cobra.Command{
+		Use:   "add [node]",
+		Short: "Add a node started with MIMORI_JOIN=true, or promote a learner",
+		Long: `Add a node as a voter, or with --learner as a learner that replicates the
+log without voting. Running add without --learner on a learner promotes it
+once it has caught up with the leader.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var resp *adminpb.AddMemberResponse
+			err := withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+				var err error
+				resp, err = client.Admin.AddMember(ctx, &adminpb.AddMemberRequest{NodeId: args[0], Learner: learner, RangeId: rangeID})
+				return err
+			})
+			if err != nil {
+				log.Fatalf("add failed: %v", err)
+			}
+			printMembers(resp.Members)
+		},
+	}
+	cmd.Flags().BoolVar(&learner, "learner", false, "add as a non-voting learner")
+	return cmd
+}
+
+// newMemberRemoveCmd creates "member remove": mimorictl member remove node
+func newMemberRemoveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove [node]",
+		Short: "Remove a node from the cluster",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var resp *adminpb.RemoveMemberResponse
+			err := withLeaderRetry(func(ctx context.Context, client *clientWrapper) error {
+				var err error
+				resp, err = client.Admin.RemoveMember(ctx, &adminpb.RemoveMemberRequest{NodeId: args[0], RangeId: rangeID})
+				return err
+			})
+			if err != nil {
+				log.Fatalf("remove failed: %v", err)
+			}
+			printMembers(resp.Members)
+		},
+	}
+}
+
+// newTopCmd creates "top": mimorictl top [--interval 2s] [--limit 20] [--once]
+func newTopCmd() *cobra.Command {
+	var interval time.Duration
+	var limit uint32
+	var once bool
+	cmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show the busiest keys and key prefixes on a node",
+		Long: `Show the keys and key prefixes the node given by --addr has served the most
+requests for, refreshing every --interval with per second rates over the last
+interval. Counts are estimated from a sample of requests.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			client := mustConnect()
+			defer client.Close()
+
+			var prev *adminpb.TopKeysResponse
+			var last time.Time
+			for {
+				// the busiest over the last interval need not be the busiest
+				// overall, so fetch everything tracked unless printing totals
+				req := &adminpb.TopKeysRequest{}
+				if once {
+					req.Limit = limit
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				resp, err := client.Admin.TopKeys(ctx, req)
+				cancel()
+				if err != nil {
+					log.Fatalf("top failed: %v", err)
+				}
+				now := time.Now()
+
+				if once {
+					printTop(resp, nil, 0, limit)
+					return
+				}
+				// clear the screen and start at the top left
+				fmt.Print("\033[H\033[2J")
+				fmt.Printf("%s every %v, sampling 1 in %d requests\n\n", addr, interval, resp.SampleRate)
+				printTop(resp, prev, now.Sub(last), limit)
+
+				prev, last = resp, now
+				time.Sleep(interval)
+			}
+		},
+	}
+	cmd.Flags().DurationVar(&interval, "interval", 2*time.Second, "how often to refresh")
+	cmd.Flags().Uint32Var(&limit, "limit", 20, "most keys and prefixes to show")
+	cmd.Flags().BoolVar(&once, "once", false, "print totals since the node started once and exit")
+	return cmd
+}
+
 // HELPER FUNCTIONS
 
-// clientWrapper wraps a gRPC client connection and the generated Mimori service client.
+// printTop prints up to limit of the keys and prefixes in resp. With an
+// earlier response it shows rates over the time since then, busiest first,
+// otherwise totals.
+func printTop(resp, prev *adminpb.TopKeysResponse, elapsed time.Duration, limit uint32) {
+	var prevKeys, prevPrefixes []*adminpb.KeyStats
+	if prev != nil {
+		prevKeys, prevPrefixes = prev.Keys, prev.Prefixes
+	}
+	printKeyStats("KEY", resp.Keys, prevKeys, prev != nil, elapsed, int(limit))
+	fmt.Println()
+	printKeyStats("PREFIX", resp.Prefixes, prevPrefixes, prev != nil, elapsed, int(limit))
+}
+
+func printKeyStats(title string, stats, prev []*adminpb.KeyStats, rates bool, elapsed time.Duration, limit int) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	if !rates {
+		if limit > 0 && len(stats) > limit {
+			stats = stats[:limit]
+		}
+		fmt.Fprintf(w, "%s\tREADS\tWRITES\tBYTES\t\n", title)
+		for _, st := range stats {
+			fmt.Fprintf(w, "%q\t%d\t%d\t%s\t\n", st.Key, st.Reads, st.Writes, formatBytes(float64(st.Bytes)))
+		}
+		return
+	}
+
+	// a key missing from the previous response started being tracked since,
+	// so everything counted for it happened within the interval
+	before := make(map[string]*adminpb.KeyStats, len(prev))
+	for _, st := range prev {
+		before[string(st.Key)] = st
+	}
+	type row struct {
+		key                  []byte
+		reads, writes, bytes float64
+	}
+	secs := elapsed.Seconds()
+	rows := make([]row, 0, len(stats))
+	for _, st := range stats {
+		r := row{key: st.Key, reads: float64(st.Reads), writes: float64(st.Writes), bytes: float64(st.Bytes)}
+		if b, ok := before[string(st.Key)]; ok && st.Reads >= b.Reads && st.Writes >= b.Writes {
+			r.reads -= float64(b.Reads)
+			r.writes -= float64(b.Writes)
+			r.bytes -= float64(b.Bytes)
+		}
+		r.reads, r.writes, r.bytes = r.reads/secs, r.writes/secs, r.bytes/secs
+		rows = append(rows, r)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].reads+rows[i].writes > rows[j].reads+rows[j].writes
+	})
+	if limit > 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+
+	fmt.Fprintf(w, "%s\tREADS/S\tWRITES/S\tBYTES/S\t\n", title)
+	for _, r := range rows {
+		fmt.Fprintf(w, "%q\t%.1f\t%.1f\t%s\t\n", r.key, r.reads, r.writes, formatBytes(r.bytes))
+	}
+}
+
+// formatBytes prints a byte count with a binary unit, e.g. 1.5K
+func formatBytes(n float64) string {
+	units := []string{"", "K", "M", "G", "T"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f", n)
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+// newMetaCmd groups commands on the cluster metadata
+func newMetaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "meta",
+		Short: "Show or change the cluster metadata: nodes, routing table and settings",
+	}
+	cmd.AddCommand(newMetaShowCmd(), newMetaSetCmd(), newMetaRemoveNodeCmd())
+	return cmd
+}
+
+// newMetaShowCmd creates "meta show": mimorictl meta show [--watch]
+func newMetaShowCmd() *cobra.Command {
+	var watch bool
+	cmd := &cobra.Command{
+		Use:   "show",
+		Short: "Show the cluster metadata as the node knows it",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			client := mustConnect()
+			defer client.Close()
+
+			if !watch {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				md, err := client.Meta.Get(ctx, &metapb.GetRequest{})
+				if err != nil {
+					log.Fatalf("get failed: %v", err)
+				}
+				printMetadata(md)
+				return
+			}
+
+			// every version from the current one on, until interrupted
+			stream, err := client.Meta.Watch(context.Background(), &metapb.WatchRequest{})
+			if err != nil {
+				log.Fatalf("watch failed: %v", err)
+			}
+			for first := true; ; first = false {
+				md, err := stream.Recv()
+				if err != nil {
+					log.Fatalf("watch failed: %v", err)
+				}
+				if !first {
+					fmt.Println()
+				}
+				printMetadata(md)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&watch, "watch", false, "keep printing the metadata as it changes")
+	return cmd
+}
+
+// newMetaSetCmd creates "meta set": mimorictl meta set key [value]
+func newMetaSetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set [key] [value]",
+		Short: "Set a cluster-wide setting, leaving out the value removes it",
+		Long: `Set a cluster-wide setting. In hash mode changing vnodes or replication
+places the partitions again and moves the ones whose replicas changed. The
+partitioning mode and the number of partitions can't be changed.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			setting := &metapb.Setting{Key: args[0]}
+			if len(args) == 2 {
+				setting.Value = args[1]
+			}
+			md := metaCall(func(ctx context.Context, c metapb.MetaClient) (*metapb.Metadata, error) {
+				return c.SetConfig(ctx, &metapb.SetConfigRequest{Setting: setting})
+			})
+			fmt.Printf("metadata is at version %d\n", md.Version)
+		},
+	}
+}
+
+// newMetaRemoveNodeCmd creates "meta remove-node": mimorictl meta remove-node node
+func newMetaRemoveNodeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove-node [node]",
+		Short: "Take a node out of the registry",
+		Long: `Take a node out of the registry. In hash mode its partitions move to the
+remaining nodes. In range mode it has to be removed from every range with
+member remove first.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			md := metaCall(func(ctx context.Context, c metapb.MetaClient) (*metapb.Metadata, error) {
+				return c.RemoveNode(ctx, &metapb.RemoveNodeRequest{Addr: args[0]})
+			})
+			fmt.Printf("removed %s, metadata is at version %d\n", args[0], md.Version)
+		},
+	}
+}
+
+// metaCall makes a metadata change through the configured node, which passes
+// it on to the meta leader
+func metaCall(call func(context.Context, metapb.MetaClient) (*metapb.Metadata, error)) *metapb.Metadata {
+	client := mustConnect()
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	md, err := call(ctx, client.Meta)
+	if err != nil {
+		log.Fatalf("change failed: %v", err)
+	}
+	return md
+}
+
+func printMetadata(md *metapb.Metadata) {
+	if md.Version == 0 {
+		fmt.Println("the cluster isn't bootstrapped yet")
+		return
+	}
+	fmt.Printf("version %d\n", md.Version)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "\nNODE\tLOCALITY\t")
+	for _, n := range md.Nodes {
+		role := ""
+		if meta.IsMetaNode(md, n.Addr) {
+			role = "meta"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", n.Addr, n.Locality, role)
+	}
+
+	fmt.Fprintln(w, "\nRANGE\tREPLICAS\t")
+	for _, r := range md.Ranges {
+		fmt.Fprintf(w, "%v\t%s\t\n", meta.FromProto(r), strings.Join(r.Replicas, ","))
+	}
+
+	fmt.Fprintln(w, "\nSETTING\tVALUE\t")
+	for _, s := range md.Config {
+		fmt.Fprintf(w, "%s\t%s\t\n", s.Key, s.Value)
+	}
+	_ = w.Flush()
+}
+
+func printMembers(members []*adminpb.Member) {
+	for _, m := range members {
+		line := m.Id
+		switch {
+		case m.Leader:
+			line += " (leader)"
+		case m.Learner:
+			line += " (learner)"
+		}
+		if m.Locality != "" {
+			line += " " + m.Locality
+		}
+		fmt.Println(line)
+	}
+}
+
+// clientWrapper wraps a gRPC client connection and the generated Mimori service clients.
 type clientWrapper struct {
 	Client kv.KVClient
+	Admin  adminpb.AdminClient
+	Meta   metapb.MetaClient
 	conn   *grpc.ClientConn
 }
 
@@ -159,21 +791,59 @@ func (cw *clientWrapper) Close() {
 }
 
 func mustConnect() *clientWrapper {
+	return mustConnectTo(addr) // from the global flag
+}
+
+func mustConnectTo(target string) *clientWrapper {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	// grpc.DialContext is the stable, modern connection call.
 	conn, err := grpc.DialContext(
 		ctx,
-		addr, // from the global flag
+		target,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 	)
 	if err != nil {
-		log.Fatalf("failed to connect to node at %s: %v", addr, err)
+		log.Fatalf("failed to connect to node at %s: %v", target, err)
 	}
 
 	client := kv.NewKVClient(conn)
-	return &clientWrapper{Client: client, conn: conn}
+	return &clientWrapper{Client: client, Admin: adminpb.NewAdminClient(conn), Meta: metapb.NewMetaClient(conn), conn: conn}
+}
+
+// withLeaderRetry runs fn against the configured node and, if that node
+// answers with a NOT_LEADER error naming the leader, again against it. It
+// takes up to two redirects, in case leadership moves in the meantime.
+func withLeaderRetry(fn func(ctx context.Context, client *clientWrapper) error) error {
+	target := addr
+	for attempt := 0; ; attempt++ {
+		client := mustConnectTo(target)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := fn(ctx, client)
+		cancel()
+		client.Close()
+
+		leader, ok := leaderFromError(err)
+		if !ok || leader == "" || attempt > 1 {
+			return err
+		}
+		target = leader
+	}
+}
+
+// leaderFromError returns the leader address carried by a NOT_LEADER error
+func leaderFromError(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return "", false
+	}
+	for _, d := range st.Details() {
+		if nl, ok := d.(*kv.NotLeader); ok {
+			return nl.LeaderAddr, true
+		}
+	}
+	return "", false
 }
 
 
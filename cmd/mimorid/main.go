@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/jerkeyray/mimori/internal/api"
 	"github.com/jerkeyray/mimori/internal/cluster"
+	"github.com/jerkeyray/mimori/internal/meta"
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
 	"github.com/jerkeyray/mimori/internal/raft"
+	"github.com/jerkeyray/mimori/internal/ranges"
 	"github.com/jerkeyray/mimori/internal/storage"
 )
 
@@ -17,23 +29,397 @@ func main() {
 
 	peerList := splitPeers(env("MIMORI_PEERS", ""))
 
-	store, err := storage.Open(dataDir)
+	// the cluster metadata, which nodes there are, how the keyspace is split
+	// into ranges and where each range lives, is kept by the meta group, a
+	// raft group of the nodes in MIMORI_PEERS. The environment only seeds a
+	// brand new cluster, later changes go through mimorictl. A node started
+	// with MIMORI_JOIN=true stays out of the meta group, it learns the
+	// metadata from the nodes in MIMORI_PEERS and registers itself.
+	join := env("MIMORI_JOIN", "false") == "true"
+
+	// the keyspace is split into ranges, each replicated by its own raft
+	// group. Without MIMORI_RANGES one range holds everything and every
+	// node in MIMORI_PEERS hosts it.
+	members := []string{addr}
+	for _, p := range peerList {
+		if !slices.Contains(members, p) {
+			members = append(members, p)
+		}
+	}
+	slices.Sort(members)
+	table := ranges.Single(members)
+	if spec := os.Getenv("MIMORI_RANGES"); spec != "" {
+		var err error
+		if table, err = ranges.Parse(spec); err != nil {
+			log.Fatalf("bad MIMORI_RANGES: %v", err)
+		}
+		members = table.Nodes()
+	}
+	var layout ranges.Layout = table
+	config := []*metapb.Setting{{Key: meta.SettingPartitioning, Value: "range"}}
+
+	// MIMORI_PARTITIONING=hash spreads keys by hash over a fixed number of
+	// partitions instead, each placed on MIMORI_REPLICATION of the
+	// registered nodes by a consistent hash ring with MIMORI_VNODES virtual
+	// nodes per node. A node registering or being removed moves only the
+	// partitions whose replicas changed. The mode and the number of
+	// partitions are fixed once the cluster is bootstrapped.
+	switch mode := env("MIMORI_PARTITIONING", "range"); mode {
+	case "range":
+	case "hash":
+		if os.Getenv("MIMORI_RANGES") != "" {
+			log.Fatalf("MIMORI_RANGES can't be used with MIMORI_PARTITIONING=hash")
+		}
+		vnodes, replication, partitions := envInt("MIMORI_VNODES", 64), envInt("MIMORI_REPLICATION", 3), envInt("MIMORI_PARTITIONS", 16)
+		ring, err := ranges.NewRing(members, vnodes, replication, partitions)
+		if err != nil {
+			log.Fatalf("bad hash ring: %v", err)
+		}
+		layout = ring
+		config = []*metapb.Setting{
+			{Key: meta.SettingPartitioning, Value: "hash"},
+			{Key: meta.SettingVnodes, Value: strconv.Itoa(vnodes)},
+			{Key: meta.SettingReplication, Value: strconv.Itoa(replication)},
+			{Key: meta.SettingPartitions, Value: strconv.Itoa(partitions)},
+		}
+	default:
+		log.Fatalf("bad MIMORI_PARTITIONING %q, expected range or hash", mode)
+	}
+
+	// MIMORI_LOCALITY places the node, e.g. region=us-east,zone=b,rack=12,
+	// it is recorded in the node registry and peers learn it from heartbeats
+	locality, err := cluster.ParseLocality(os.Getenv("MIMORI_LOCALITY"))
+	if err != nil {
+		log.Fatalf("bad MIMORI_LOCALITY: %v", err)
+	}
+	// MIMORI_FAILURE_DOMAIN is the level, region, zone or rack, whose loss
+	// every range's quorum has to survive. A new cluster whose ranges would
+	// lose quorum with one such domain, or whose nodes' localities can't be
+	// learned, is still bootstrapped with a warning unless
+	// MIMORI_QUORUM_RISK=refuse, which refuses to.
+	failureDomain, err := cluster.ParseLevel(env("MIMORI_FAILURE_DOMAIN", "zone"))
+	if err != nil {
+		log.Fatalf("bad MIMORI_FAILURE_DOMAIN: %v", err)
+	}
+	refuseRisk := false
+	switch mode := env("MIMORI_QUORUM_RISK", "warn"); mode {
+	case "warn":
+	case "refuse":
+		refuseRisk = true
+	default:
+		log.Fatalf("bad MIMORI_QUORUM_RISK %q, expected warn or refuse", mode)
+	}
+
+	// SIGINT or SIGTERM starts a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := migrateDataDir(dataDir); err != nil {
+		log.Fatalf("failed to migrate data dir: %v", err)
+	}
+	onDisk, err := rangeDirs(dataDir)
 	if err != nil {
-		log.Fatalf("failed to open storage: %v", err)
+		log.Fatalf("failed to read data dir: %v", err)
 	}
-	defer store.Close()
 
-	raftNode := raft.New(raft.NodeID(addr), convertPeersToNodeIDs(peerList))
-	_ = raftNode // save it later when we integrate RPC
+	// raft traffic for every group goes over one long-lived connection per
+	// peer and one server, which hands messages to the right group
+	transport := raft.NewGRPCTransport()
+	raftMux := raft.NewMux()
+
+	// the nodes forming the cluster host the meta group, so do nodes whose
+	// data predates it, together with their peers
+	view := meta.NewView()
+	metaDir := filepath.Join(dataDir, "meta")
+	_, statErr := os.Stat(metaDir)
+	var metaGroup *hosted
+	var metaRaft *raft.Raft
+	if statErr == nil || (!join && slices.Contains(members, addr)) {
+		metaGroup, err = openGroup(metaDir, addr, meta.GroupID, members, join, transport, func(store *storage.PebbleKV) (raft.StateMachine, error) {
+			return meta.NewStateMachine(store, view)
+		})
+		if err != nil {
+			log.Fatalf("failed to open the meta group: %v", err)
+		}
+		metaRaft = metaGroup.replica.Raft
+		raftMux.Add(meta.GroupID, metaRaft)
+		metaRaft.Start(ctx)
+		log.Printf("hosting the meta group")
+	}
+	metaServer := meta.NewServer(addr, view, metaRaft, members)
 
-	clusterMgr := cluster.New(addr, peerList)
+	clusterMgr := cluster.New(addr, locality, nil)
+	clusterMgr.FailureDomain = failureDomain
 	clusterMgr.Start()
-	defer clusterMgr.Stop()
 
+	// requests are served right away since raft traffic for the meta group
+	// has to get through before the routing table is known, until then
+	// requests for keys fail with UNAVAILABLE
+	router := api.NewRouter()
+
+	// followers forward writes and consistent reads to the leader unless
+	// MIMORI_FORWARD_TO_LEADER=false, in which case clients get redirected
+	// with a NOT_LEADER error
+	opts := api.Options{
+		ForwardToLeader: env("MIMORI_FORWARD_TO_LEADER", "true") != "false",
+		Cluster:         clusterMgr,
+		Meta:            metaServer,
+	}
+
+	// mimorictl top shows the busiest keys and prefixes, sampled from one
+	// request in MIMORI_HOTKEY_SAMPLE_RATE (0 turns it off), with prefixes
+	// ending at any of the characters in MIMORI_HOTKEY_DELIMITERS
+	opts.HotKeySampleRate = envInt("MIMORI_HOTKEY_SAMPLE_RATE", 4)
+	opts.HotKeyPrefixDelimiters = env("MIMORI_HOTKEY_DELIMITERS", ":/")
+
+	served := make(chan error, 1)
+	go func() {
+		served <- api.ListenAndServe(ctx, addr, router, raftMux, opts)
+	}()
+
+	// the first meta leader writes the initial metadata, nodes outside the
+	// meta group watch it change, and every node keeps itself registered
+	var background sync.WaitGroup
+	spawn := func(f func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			f()
+		}()
+	}
+	if metaRaft != nil {
+		initial := initialMetadata(layout, members, config, addr, locality)
+		if statErr != nil {
+			checkQuorumRisk(ctx, clusterMgr, initial, refuseRisk)
+		}
+		spawn(func() { metaServer.Bootstrap(ctx, initial) })
+	} else {
+		spawn(func() { metaServer.Follow(ctx) })
+	}
+	spawn(func() { metaServer.KeepRegistered(ctx, &metapb.Node{Addr: addr, Locality: locality.String()}) })
+
+	// ranges are opened and handed off as the routing table changes, range
+	// leaders move hash partitions onto the replicas the ring assigns them
+	// and then drop the old replicas
+	replicas := &replicaSet{
+		ctx:       ctx,
+		dataDir:   dataDir,
+		addr:      addr,
+		transport: transport,
+		mux:       raftMux,
+		router:    router,
+		nodes:     clusterMgr,
+		hosted:    make(map[uint64]*hosted),
+		bootstrap: !join && len(onDisk) == 0,
+		onDisk:    onDisk,
+	}
+	replicas.rebalancer = api.NewRebalancer(router, clusterMgr, replicas.removed)
+	spawn(func() { replicas.rebalancer.Run(ctx, 10*time.Second) })
+	// old versions of keys are kept this long for reads as of a revision or
+	// a time, 0 keeps them forever
+	if retention := envDuration("MIMORI_MVCC_RETENTION", 24*time.Hour); retention > 0 {
+		gc := api.NewGC(router, retention)
+		spawn(func() { gc.Run(ctx, time.Minute) })
+	}
+	spawn(func() { replicas.follow(view) })
+	spawn(func() { watchFailureDomains(ctx, clusterMgr, router) })
 
-	if err := api.ListenAndServe(addr, store, raftNode); err != nil {
+	// blocks until a signal arrives and in-flight requests have drained
+	if err := <-served; err != nil {
 		log.Fatalf("server error: %v", err)
 	}
+
+	// tear down in reverse order of dependency, storage goes last since
+	// raft may still be applying entries until it stops
+	background.Wait()
+	clusterMgr.Stop()
+	groups := replicas.all()
+	if metaGroup != nil {
+		groups = append(groups, metaGroup)
+	}
+	for _, h := range groups {
+		h.replica.Raft.Stop()
+	}
+	if err := transport.Close(); err != nil {
+		log.Printf("failed to close raft transport: %v", err)
+	}
+	for _, h := range groups {
+		h.close()
+	}
+	log.Printf("shutdown complete")
+}
+
+// migrateDataDir moves data written before the keyspace was split into
+// ranges, which holds every key, to where range 1 lives now
+func migrateDataDir(dataDir string) error {
+	legacy := []string{"kv", "raft"}
+	if _, err := os.Stat(filepath.Join(dataDir, legacy[0])); err != nil {
+		return nil
+	}
+	dir := filepath.Join(dataDir, "range-1")
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("both %s and %s exist", filepath.Join(dataDir, legacy[0]), dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, name := range legacy {
+		if err := os.Rename(filepath.Join(dataDir, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	log.Printf("moved existing data to %s", dir)
+	return nil
+}
+
+// checkQuorumRisk looks at the groups a new cluster is about to be
+// bootstrapped with once the localities of their nodes are known, and
+// either refuses to go on when one failure domain holds a quorum of a group
+// or says it goes on anyway
+func checkQuorumRisk(ctx context.Context, nodes *cluster.Cluster, md *metapb.Metadata, refuse bool) {
+	// without labels there's nothing to check, and waiting for the peers'
+	// localities would only hold up the first election
+	if nodes.SelfLocality.IsZero() {
+		if refuse {
+			log.Printf("MIMORI_QUORUM_RISK=refuse has no effect without MIMORI_LOCALITY")
+		}
+		return
+	}
+	var addrs []string
+	for _, n := range md.Nodes {
+		addrs = append(addrs, n.Addr)
+	}
+	nodes.SetPeers(addrs)
+
+	groups := map[string][]string{"the meta group": md.MetaNodes}
+	for _, r := range md.Ranges {
+		groups[fmt.Sprintf("range %d", r.Id)] = r.Replicas
+	}
+
+	// heartbeats bring in the peers' localities, a peer that doesn't send
+	// one in time is taken as unknown
+	var risks []string
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		risks = risks[:0]
+		var unknown []string
+		for name, voters := range groups {
+			risk, u := nodes.QuorumRisk(voters)
+			if risk != "" {
+				risks = append(risks, fmt.Sprintf("%s has a majority of its voters in %s", name, risk))
+			}
+			unknown = append(unknown, u...)
+		}
+		if len(unknown) == 0 || time.Now().After(deadline) {
+			slices.Sort(unknown)
+			if unknown = slices.Compact(unknown); len(unknown) > 0 {
+				risks = append(risks, fmt.Sprintf("no %s known for %v", nodes.FailureDomain, unknown))
+			}
+			break
+		}
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+	}
+	if len(risks) == 0 {
+		log.Printf("no single %s holds a quorum of any group", nodes.FailureDomain)
+		return
+	}
+	slices.Sort(risks)
+	if refuse {
+		log.Fatalf("refusing to bootstrap, losing one %s could lose quorum: %s", nodes.FailureDomain, strings.Join(risks, "; "))
+	}
+	log.Printf("WARNING: bootstrapping anyway though losing one %s could lose quorum, MIMORI_QUORUM_RISK=refuse would refuse: %s",
+		nodes.FailureDomain, strings.Join(risks, "; "))
+}
+
+// watchFailureDomains warns, for every range this node leads, when a single
+// failure domain holds a majority of the range's voters. Peers' localities
+// are learned from heartbeats, so the first check waits for a few of those.
+func watchFailureDomains(ctx context.Context, nodes *cluster.Cluster, router *api.Router) {
+	if nodes.SelfLocality.IsZero() {
+		return
+	}
+	last := make(map[uint64]string)
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for wait := time.After(5 * time.Second); ; wait = ticker.C {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return
+		}
+		for _, rep := range router.Replicas() {
+			if !rep.Raft.IsLeader() {
+				continue
+			}
+			var voters []string
+			for _, id := range rep.Raft.Voters() {
+				voters = append(voters, string(id))
+			}
+			risk, unknown := nodes.QuorumRisk(voters)
+			var msg string
+			switch {
+			case risk != "":
+				msg = fmt.Sprintf("WARNING: range %d has a majority of its voters in %s, losing it loses quorum", rep.ID, risk)
+			case len(unknown) > 0:
+				msg = fmt.Sprintf("range %d: locality of %v unknown, can't tell if a single failure domain holds quorum", rep.ID, unknown)
+			default:
+				msg = fmt.Sprintf("range %d: no single failure domain holds a majority of voters", rep.ID)
+			}
+			// only say it again once something changed
+			if msg != last[rep.ID] {
+				log.Print(msg)
+				last[rep.ID] = msg
+			}
+		}
+	}
+}
+
+// rangeDirs returns the ids of the ranges with data under dataDir
+func rangeDirs(dataDir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dataDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		var id uint64
+		if _, err := fmt.Sscanf(e.Name(), "range-%d", &id); err == nil && e.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func envInt(k string, def int) int {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("bad %s: %q", k, v)
+	}
+	return n
+}
+
+func envDuration(k string, def time.Duration) time.Duration {
+	v := os.Getenv(k)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("bad %s: %q", k, v)
+	}
+	return d
 }
 
 func env(k, def string) string {
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jerkeyray/mimori/internal/api"
+	"github.com/jerkeyray/mimori/internal/cluster"
+	"github.com/jerkeyray/mimori/internal/meta"
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
+	"github.com/jerkeyray/mimori/internal/raft"
+	"github.com/jerkeyray/mimori/internal/ranges"
+	"github.com/jerkeyray/mimori/internal/storage"
+)
+
+// hosted is a raft group this node is a member of, a range or the meta
+// group, along with the stores behind it
+type hosted struct {
+	dir       string
+	replica   *api.Replica
+	store     *storage.PebbleKV
+	raftStore *raft.PebbleStorage
+}
+
+func (h *hosted) close() {
+	if err := h.raftStore.Close(); err != nil {
+		log.Printf("failed to close raft storage of group %d: %v", h.replica.ID, err)
+	}
+	if err := h.store.Close(); err != nil {
+		log.Printf("failed to close storage of group %d: %v", h.replica.ID, err)
+	}
+}
+
+// openGroup opens the stores of one raft group under dir, the state machine
+// data and raft state in separate pebble dbs, and sets up the group
+func openGroup(dir, addr string, groupID uint64, peers []string, join bool, transport raft.Transport, newStateMachine func(*storage.PebbleKV) (raft.StateMachine, error)) (*hosted, error) {
+	store, err := storage.Open(filepath.Join(dir, "kv"))
+	if err != nil {
+		return nil, err
+	}
+	raftStore, err := raft.OpenPebbleStorage(filepath.Join(dir, "raft"))
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	sm, err := newStateMachine(store)
+	if err != nil {
+		raftStore.Close()
+		store.Close()
+		return nil, err
+	}
+
+	// committed entries are applied to the group's store in log order
+	raftNode, err := raft.New(raft.Config{
+		ID:           raft.NodeID(addr),
+		Peers:        convertPeersToNodeIDs(peers),
+		GroupID:      groupID,
+		Join:         join,
+		StateMachine: sm,
+		Storage:      raftStore,
+		Transport:    raft.SharedTransport(transport),
+		SnapshotDir:  filepath.Join(dir, "snapshots"),
+	})
+	if err != nil {
+		raftStore.Close()
+		store.Close()
+		return nil, err
+	}
+	return &hosted{
+		dir:       dir,
+		replica:   &api.Replica{ID: groupID, Store: store, Raft: raftNode},
+		store:     store,
+		raftStore: raftStore,
+	}, nil
+}
+
+// openReplica opens range desc under dataDir/range-<id>
+func openReplica(dataDir, addr string, desc *ranges.Descriptor, join bool, transport raft.Transport) (*hosted, error) {
+	dir := filepath.Join(dataDir, fmt.Sprintf("range-%d", desc.ID))
+	return openGroup(dir, addr, desc.ID, desc.Replicas, join, transport, func(store *storage.PebbleKV) (raft.StateMachine, error) {
+		return api.NewStateMachine(store), nil
+	})
+}
+
+// replicaSet opens and tears down this node's replicas as the routing table
+// in the cluster metadata changes
+type replicaSet struct {
+	ctx        context.Context
+	dataDir    string
+	addr       string
+	transport  raft.Transport
+	mux        *raft.Mux
+	router     *api.Router
+	nodes      *cluster.Cluster
+	rebalancer *api.Rebalancer
+
+	mu     sync.Mutex
+	hosted map[uint64]*hosted // every range open here, serving or leaving
+	// a brand new node that isn't joining forms the raft groups of the
+	// ranges it hosts in the first metadata it sees, everything opened
+	// after that joins the existing replicas
+	bootstrap bool
+	onDisk    []uint64 // ranges found on disk, checked against the first metadata
+}
+
+// follow applies every new version of the metadata, and once in a while the
+// current one again to pick up what a previous attempt left undone
+func (rs *replicaSet) follow(view *meta.View) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	var applied uint64
+	for {
+		md, changed := view.Get()
+		if md.Version > 0 {
+			if md.Version != applied {
+				log.Printf("[meta] cluster metadata is at version %d", md.Version)
+				applied = md.Version
+			}
+			rs.apply(md)
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-rs.ctx.Done():
+			return
+		}
+	}
+}
+
+func (rs *replicaSet) apply(md *metapb.Metadata) {
+	layout, err := meta.Layout(md)
+	if err != nil {
+		log.Printf("[meta] can't route by metadata version %d: %v", md.Version, err)
+		return
+	}
+	rs.router.SetLayout(layout)
+	var peers []string
+	for _, n := range md.Nodes {
+		peers = append(peers, n.Addr)
+	}
+	rs.nodes.SetPeers(peers)
+	rs.nodes.SetSelfLayout(layout.Fingerprint())
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	serving := make(map[uint64]*api.Replica)
+	for _, rep := range rs.router.Replicas() {
+		serving[rep.ID] = rep
+	}
+	for _, desc := range layout.Hosted(rs.addr) {
+		switch {
+		case serving[desc.ID] != nil:
+		case rs.hosted[desc.ID] != nil:
+			// moved off and back again, unless it's being torn down right
+			// now, in which case the next attempt opens it afresh
+			if rep := rs.rebalancer.Reclaim(desc.ID); rep != nil {
+				rs.router.Add(rep)
+				log.Printf("hosting %v again", desc)
+			}
+		default:
+			h, err := rs.open(desc, !rs.bootstrap)
+			if err != nil {
+				log.Printf("failed to open %v, will retry: %v", desc, err)
+				continue
+			}
+			rs.router.Add(h.replica)
+			log.Printf("hosting %v", desc)
+		}
+	}
+
+	// ranges moved elsewhere keep running until the new replicas have taken
+	// over, but requests for them are routed to the new replicas
+	for id, rep := range serving {
+		if desc := layout.Get(id); desc == nil || !desc.HostedBy(rs.addr) {
+			rs.router.Remove(id)
+			rs.rebalancer.Leave(rep)
+			log.Printf("handing off range %d", id)
+		}
+	}
+	for _, id := range rs.onDisk {
+		desc := layout.Get(id)
+		switch {
+		case rs.hosted[id] != nil:
+		case desc == nil:
+			log.Printf("range %d on disk isn't in the routing table, leaving it alone", id)
+		default:
+			h, err := rs.open(desc, true)
+			if err != nil {
+				log.Printf("failed to open %v: %v", desc, err)
+				continue
+			}
+			rs.rebalancer.Leave(h.replica)
+			log.Printf("handing off %v to %v", desc, desc.Replicas)
+		}
+	}
+	rs.onDisk = nil
+	rs.bootstrap = false
+}
+
+func (rs *replicaSet) open(desc *ranges.Descriptor, join bool) (*hosted, error) {
+	h, err := openReplica(rs.dataDir, rs.addr, desc, join, rs.transport)
+	if err != nil {
+		return nil, err
+	}
+	rs.mux.Add(desc.ID, h.replica.Raft)
+	h.replica.Raft.Start(rs.ctx)
+	rs.hosted[desc.ID] = h
+	return h, nil
+}
+
+// removed tears down a replica that is no longer a member of its range
+func (rs *replicaSet) removed(rep *api.Replica) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.mux.Remove(rep.ID)
+	rep.Raft.Stop()
+	h := rs.hosted[rep.ID]
+	h.close()
+	delete(rs.hosted, rep.ID)
+	if err := os.RemoveAll(h.dir); err != nil {
+		log.Printf("failed to remove %s: %v", h.dir, err)
+	}
+}
+
+// all returns every group open here
+func (rs *replicaSet) all() []*hosted {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	out := make([]*hosted, 0, len(rs.hosted))
+	for _, h := range rs.hosted {
+		out = append(out, h)
+	}
+	return out
+}
+
+// initialMetadata is what a brand new cluster starts out with, built from
+// the environment of whichever meta node gets its proposal in first
+func initialMetadata(layout ranges.Layout, metaNodes []string, config []*metapb.Setting, self string, locality cluster.Locality) *metapb.Metadata {
+	md := &metapb.Metadata{Config: config, MetaNodes: metaNodes}
+	addrs := slices.Concat(metaNodes, layout.Nodes())
+	slices.Sort(addrs)
+	for _, addr := range slices.Compact(addrs) {
+		n := &metapb.Node{Addr: addr}
+		if addr == self {
+			n.Locality = locality.String()
+		}
+		md.Nodes = append(md.Nodes, n)
+	}
+	for _, d := range layout.Ranges() {
+		md.Ranges = append(md.Ranges, meta.ToProto(d))
+	}
+	slices.SortFunc(md.Config, func(a, b *metapb.Setting) int { return strings.Compare(a.Key, b.Key) })
+	return md
+}
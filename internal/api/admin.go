@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jerkeyray/mimori/internal/api/adminpb"
+	"github.com/jerkeyray/mimori/internal/cluster"
+	"github.com/jerkeyray/mimori/internal/meta"
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
+	"github.com/jerkeyray/mimori/internal/raft"
+)
+
+// AdminServer serves operator commands against the ranges hosted here
+type AdminServer struct {
+	adminpb.UnimplementedAdminServer
+	router *Router
+	hot    *HotKeys         // nil if hot key tracking is off
+	nodes  *cluster.Cluster // where members are, may be nil
+	meta   *meta.Server     // records membership changes, may be nil
+}
+
+func NewAdminServer(router *Router, hot *HotKeys, nodes *cluster.Cluster, m *meta.Server) *AdminServer {
+	return &AdminServer{router: router, hot: hot, nodes: nodes, meta: m}
+}
+
+// raftFor returns the raft group of a range hosted here
+func (a *AdminServer) raftFor(rangeID uint64) (*raft.Raft, error) {
+	desc, rep := a.router.replica(rangeID)
+	switch {
+	case a.router.Layout() == nil:
+		return nil, status.Error(codes.Unavailable, "routing table not known yet, retry shortly")
+	case desc == nil:
+		return nil, status.Errorf(codes.NotFound, "no range %d", rangeID)
+	case rep == nil:
+		// a node hosting it can take the call
+		return nil, notHostedError(desc)
+	}
+	return rep.Raft, nil
+}
+
+func (a *AdminServer) TransferLeader(ctx context.Context, req *adminpb.TransferLeaderRequest) (*adminpb.TransferLeaderResponse, error) {
+	if req.TargetId == "" {
+		return nil, status.Error(codes.InvalidArgument, "target node is required")
+	}
+	r, err := a.raftFor(req.RangeId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.TransferLeadership(ctx, raft.NodeID(req.TargetId))
+	switch {
+	case err == nil:
+	case errors.Is(err, raft.ErrNotLeader):
+		return nil, notLeaderError(string(r.Leader()))
+	case errors.Is(err, raft.ErrUnknownNode):
+		return nil, status.Errorf(codes.NotFound, "%s is not a member of the cluster", req.TargetId)
+	case errors.Is(err, raft.ErrTransferInProgress):
+		return nil, status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, raft.ErrStopped):
+		return nil, status.Error(codes.Unavailable, "node is shutting down")
+	default:
+		return nil, status.Errorf(codes.DeadlineExceeded, "transfer did not complete: %v", err)
+	}
+	return &adminpb.TransferLeaderResponse{LeaderId: string(r.Leader())}, nil
+}
+
+func (a *AdminServer) AddMember(ctx context.Context, req *adminpb.AddMemberRequest) (*adminpb.AddMemberResponse, error) {
+	if req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "node is required")
+	}
+	r, err := a.raftFor(req.RangeId)
+	if err != nil {
+		return nil, err
+	}
+	add := r.AddVoter
+	if req.Learner {
+		add = r.AddLearner
+	}
+	if err := membershipError(r, add(ctx, raft.NodeID(req.NodeId)), req.NodeId); err != nil {
+		return nil, err
+	}
+	if err := a.recordReplicas(ctx, req.RangeId, r); err != nil {
+		return nil, err
+	}
+	return &adminpb.AddMemberResponse{Members: a.members(r)}, nil
+}
+
+func (a *AdminServer) RemoveMember(ctx context.Context, req *adminpb.RemoveMemberRequest) (*adminpb.RemoveMemberResponse, error) {
+	if req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "node is required")
+	}
+	r, err := a.raftFor(req.RangeId)
+	if err != nil {
+		return nil, err
+	}
+	if err := membershipError(r, r.RemoveNode(ctx, raft.NodeID(req.NodeId)), req.NodeId); err != nil {
+		return nil, err
+	}
+	if err := a.recordReplicas(ctx, req.RangeId, r); err != nil {
+		return nil, err
+	}
+	return &adminpb.RemoveMemberResponse{Members: a.members(r)}, nil
+}
+
+func (a *AdminServer) ListMembers(ctx context.Context, req *adminpb.ListMembersRequest) (*adminpb.ListMembersResponse, error) {
+	r, err := a.raftFor(req.RangeId)
+	if err != nil {
+		return nil, err
+	}
+	// only the leader's view is current, a follower may not have heard of
+	// the latest change yet
+	if !r.IsLeader() {
+		return nil, notLeaderError(string(r.Leader()))
+	}
+	resp := &adminpb.ListMembersResponse{Members: a.members(r)}
+	if a.nodes != nil {
+		var voters []string
+		for _, id := range r.Voters() {
+			voters = append(voters, string(id))
+		}
+		resp.QuorumRisk, _ = a.nodes.QuorumRisk(voters)
+	}
+	return resp, nil
+}
+
+func (a *AdminServer) TopKeys(ctx context.Context, req *adminpb.TopKeysRequest) (*adminpb.TopKeysResponse, error) {
+	if a.hot == nil {
+		return nil, status.Error(codes.FailedPrecondition, "hot key tracking is off on this node")
+	}
+	keys, prefixes := a.hot.Top(int(req.Limit))
+	return &adminpb.TopKeysResponse{Keys: keys, Prefixes: prefixes, SampleRate: a.hot.rate}, nil
+}
+
+// membershipError maps errors from a membership change to grpc statuses
+func membershipError(r *raft.Raft, err error, node string) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, raft.ErrNotLeader):
+		return notLeaderError(string(r.Leader()))
+	case errors.Is(err, raft.ErrUnknownNode):
+		return status.Errorf(codes.NotFound, "%s is not a member of the cluster", node)
+	case errors.Is(err, raft.ErrLastVoter):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, raft.ErrConfigChangePending), errors.Is(err, raft.ErrTransferInProgress):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, raft.ErrStopped):
+		return status.Error(codes.Unavailable, "node is shutting down")
+	default:
+		return status.Errorf(codes.DeadlineExceeded, "change did not commit: %v", err)
+	}
+}
+
+// recordReplicas writes a range's members to the routing table after a
+// membership change, which is what makes an added node open the range and a
+// removed one drop it. In hash mode the ring places replicas instead.
+func (a *AdminServer) recordReplicas(ctx context.Context, rangeID uint64, r *raft.Raft) error {
+	desc, _ := a.router.replica(rangeID)
+	if a.meta == nil || desc == nil || desc.Hashed {
+		return nil
+	}
+	var replicas []string
+	for _, id := range slices.Concat(r.Voters(), r.Learners()) {
+		replicas = append(replicas, string(id))
+	}
+	_, err := a.meta.SetReplicas(ctx, &metapb.SetReplicasRequest{RangeId: desc.ID, Replicas: replicas})
+	if err != nil {
+		st := status.Convert(err)
+		return status.Errorf(st.Code(), "membership changed but the routing table wasn't updated, run the command again: %s", st.Message())
+	}
+	return nil
+}
+
+// members lists the voters and learners r knows of, marking the leader
+func (a *AdminServer) members(r *raft.Raft) []*adminpb.Member {
+	leader := r.Leader()
+	var out []*adminpb.Member
+	for _, id := range r.Voters() {
+		out = append(out, &adminpb.Member{Id: string(id), Leader: id == leader})
+	}
+	for _, id := range r.Learners() {
+		out = append(out, &adminpb.Member{Id: string(id), Learner: true})
+	}
+	if a.nodes != nil {
+		for _, m := range out {
+			if l, ok := a.nodes.Locality(m.Id); ok {
+				m.Locality = l.String()
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/raft"
+	"github.com/jerkeyray/mimori/internal/raft/raftpb"
+	"github.com/jerkeyray/mimori/internal/ranges"
+	"github.com/jerkeyray/mimori/internal/storage"
+)
+
+// testCluster runs n nodes serving the KV and raft services over real gRPC
+// on loopback, each hosting its replicas of the layout's ranges
+type testCluster struct {
+	t      *testing.T
+	addrs  []string
+	layout ranges.Layout
+	nodes  map[string]*testNode
+}
+
+type testNode struct {
+	server  *Server
+	router  *Router
+	client  kv.KVClient
+	stores  map[uint64]*storage.PebbleKV // by range id
+	replica map[uint64]*Replica
+}
+
+// newTestCluster starts n nodes routing by the layout that layout builds
+// over their addresses
+func newTestCluster(t *testing.T, n int, opts Options, layout func(addrs []string) ranges.Layout) *testCluster {
+	t.Helper()
+	c := &testCluster{t: t, nodes: make(map[string]*testNode)}
+	lis := make([]net.Listener, n)
+	for i := range lis {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		lis[i] = l
+		c.addrs = append(c.addrs, l.Addr().String())
+	}
+	c.layout = layout(c.addrs)
+
+	for i, addr := range c.addrs {
+		node := &testNode{
+			router:  NewRouter(),
+			stores:  make(map[uint64]*storage.PebbleKV),
+			replica: make(map[uint64]*Replica),
+		}
+		node.router.SetLayout(c.layout)
+		mux := raft.NewMux()
+		transport := raft.NewGRPCTransport()
+		t.Cleanup(func() { transport.Close() })
+
+		for _, desc := range c.layout.Hosted(addr) {
+			store, err := storage.Open(t.TempDir())
+			if err != nil {
+				t.Fatalf("open store failed: %v", err)
+			}
+			t.Cleanup(func() { store.Close() })
+			var peers []raft.NodeID
+			for _, p := range desc.Replicas {
+				peers = append(peers, raft.NodeID(p))
+			}
+			r, err := raft.New(raft.Config{
+				ID:           raft.NodeID(addr),
+				Peers:        peers,
+				GroupID:      desc.ID,
+				StateMachine: NewStateMachine(store),
+				Storage:      raft.NewMemoryStorage(),
+				Transport:    raft.SharedTransport(transport),
+			})
+			if err != nil {
+				t.Fatalf("new raft failed: %v", err)
+			}
+			mux.Add(desc.ID, r)
+			rep := &Replica{ID: desc.ID, Store: store, Raft: r}
+			node.router.Add(rep)
+			node.stores[desc.ID], node.replica[desc.ID] = store, rep
+		}
+
+		node.server = NewServer(node.router, opts)
+		srv := grpc.NewServer()
+		kv.RegisterKVServer(srv, node.server)
+		raftpb.RegisterRaftServer(srv, mux)
+		go srv.Serve(lis[i])
+		t.Cleanup(srv.Stop)
+		t.Cleanup(node.server.peers.close)
+
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		node.client = kv.NewKVClient(conn)
+		c.nodes[addr] = node
+	}
+
+	// raft goes down before the stores it applies to, cleanups run last
+	// in first out
+	for _, node := range c.nodes {
+		for _, rep := range node.replica {
+			rep.Raft.Start(context.Background())
+			t.Cleanup(rep.Raft.Stop)
+		}
+	}
+	for _, desc := range c.layout.Ranges() {
+		c.leader(desc.ID)
+	}
+	return c
+}
+
+// leader waits for range id to elect a leader that has applied its first
+// entry and that every replica knows of, and returns its address
+func (c *testCluster) leader(id uint64) string {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, addr := range c.layout.Get(id).Replicas {
+			if rep := c.nodes[addr].replica[id]; rep.Raft.IsLeader() && c.known(id, addr) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				_, err := rep.Raft.ReadIndex(ctx)
+				cancel()
+				if err == nil {
+					return addr
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("range %d elected no leader", id)
+	return ""
+}
+
+// known reports whether every replica of range id takes leader for its
+// leader
+func (c *testCluster) known(id uint64, leader string) bool {
+	for _, addr := range c.layout.Get(id).Replicas {
+		if string(c.nodes[addr].replica[id].Raft.Leader()) != leader {
+			return false
+		}
+	}
+	return true
+}
+
+// follower returns a replica of range id that doesn't lead it
+func (c *testCluster) follower(id uint64) string {
+	c.t.Helper()
+	leader := c.leader(id)
+	for _, addr := range c.layout.Get(id).Replicas {
+		if addr != leader {
+			return addr
+		}
+	}
+	c.t.Fatalf("range %d has no followers", id)
+	return ""
+}
+
+// put writes key through the leader of its range
+func (c *testCluster) put(key, value string) *kv.PutResponse {
+	c.t.Helper()
+	leader := c.leader(c.layout.Lookup([]byte(key)).ID)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.nodes[leader].client.Put(ctx, &kv.PutRequest{Key: []byte(key), Value: []byte(value)})
+	if err != nil || !resp.Ok {
+		c.t.Fatalf("put %s failed: %v", key, err)
+	}
+	return resp
+}
+
+// scan reads every page of req from addr, following the page tokens
+func (c *testCluster) scan(addr string, req *kv.ScanRequest) ([][]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var pages [][]string
+	for {
+		stream, err := c.nodes[addr].client.Scan(ctx, req)
+		if err != nil {
+			return pages, err
+		}
+		var page []string
+		var token []byte
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return pages, err
+			}
+			for _, pair := range resp.Kvs {
+				page = append(page, string(pair.Key))
+			}
+			if resp.NextPageToken != nil {
+				token = resp.NextPageToken
+			}
+		}
+		pages = append(pages, page)
+		if token == nil {
+			return pages, nil
+		}
+		req.PageToken = token
+	}
+}
+
+// table splits the keyspace at splits into ranges 1, 2, ... hosted by
+// every node
+func table(splits ...string) func(addrs []string) ranges.Layout {
+	return func(addrs []string) ranges.Layout {
+		var descs []*ranges.Descriptor
+		start := []byte{}
+		for i := 0; i <= len(splits); i++ {
+			d := &ranges.Descriptor{ID: uint64(i + 1), StartKey: start, Replicas: addrs}
+			if i < len(splits) {
+				d.EndKey = []byte(splits[i])
+				start = d.EndKey
+			}
+			descs = append(descs, d)
+		}
+		t, err := ranges.NewTable(descs)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/ranges"
+)
+
+// set on requests a follower forwards to the leader, so a node that has
+// lost leadership in the meantime redirects instead of bouncing it on
+const forwardedHeader = "x-mimori-forwarded"
+
+// set on requests a node passes to another one hosting the key's range, the
+// receiver may still forward it to the range's leader but never routes it
+// on again
+const routedHeader = "x-mimori-routed"
+
+// notLeaderError builds the FAILED_PRECONDITION error carrying the leader address
+func notLeaderError(leader string) error {
+	st, err := status.New(codes.FailedPrecondition, "not the leader").
+		WithDetails(&kv.NotLeader{LeaderAddr: leader})
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, "not the leader")
+	}
+	return st.Err()
+}
+
+// notHostedError is returned for a range this node has no replica of when
+// the request can't be passed on. It names the replicas but no leader, as
+// this node can't know which one leads.
+func notHostedError(desc *ranges.Descriptor) error {
+	return status.Errorf(codes.Unavailable, "range %d is not hosted here, its replicas are %v", desc.ID, desc.Replicas)
+}
+
+// leaderFromError returns the leader address carried by a NOT_LEADER error
+func leaderFromError(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return "", false
+	}
+	for _, d := range st.Details() {
+		if nl, ok := d.(*kv.NotLeader); ok {
+			return nl.LeaderAddr, true
+		}
+	}
+	return "", false
+}
+
+func isForwarded(ctx context.Context) bool {
+	return hasHeader(ctx, forwardedHeader)
+}
+
+func hasHeader(ctx context.Context, key string) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(key)) > 0
+}
+
+// hop is where a request goes when this node cannot serve it
+type hop struct {
+	addrs  []string // tried in order until one is reachable
+	header string   // marks the request so it is not passed on again
+}
+
+// replicaFor finds the local replica to serve key, which with leader set
+// must also lead its range. Otherwise it returns where to send the request
+// instead, or a NOT_LEADER error for the client to act on when the request
+// may not be passed on.
+func (s *Server) replicaFor(ctx context.Context, key []byte, leader bool) (*Replica, *hop, error) {
+	desc, rep := s.router.route(key)
+	if desc == nil {
+		return nil, nil, status.Error(codes.Unavailable, "routing table not known yet, retry shortly")
+	}
+	if rep == nil {
+		// any replica of the range can take it from here
+		if !s.opts.ForwardToLeader || isForwarded(ctx) || hasHeader(ctx, routedHeader) {
+			return nil, nil, notHostedError(desc)
+		}
+		return nil, &hop{addrs: s.nearestFirst(desc.Replicas), header: routedHeader}, nil
+	}
+
+	if leader && !rep.Raft.IsLeader() {
+		lead := string(rep.Raft.Leader())
+		if !s.opts.ForwardToLeader || lead == "" || isForwarded(ctx) {
+			return nil, nil, notLeaderError(lead)
+		}
+		return nil, &hop{addrs: []string{lead}, header: forwardedHeader}, nil
+	}
+	return rep, nil, nil
+}
+
+// nearestFirst orders addrs by how many failure domains they share with
+// this node, so stale reads are served from the same zone where possible
+func (s *Server) nearestFirst(addrs []string) []string {
+	nodes := s.opts.Cluster
+	if nodes == nil || nodes.SelfLocality.IsZero() {
+		return addrs
+	}
+	closeness := make(map[string]int, len(addrs))
+	for _, addr := range addrs {
+		if l, ok := nodes.Locality(addr); ok {
+			closeness[addr] = nodes.SelfLocality.Closeness(l)
+		}
+	}
+	sorted := slices.Clone(addrs)
+	slices.SortStableFunc(sorted, func(a, b string) int { return closeness[b] - closeness[a] })
+	return sorted
+}
+
+// forward passes a request on along h, moving to the next address only
+// while the ones tried are unreachable
+func forward[T any](ctx context.Context, s *Server, h *hop, call func(context.Context, kv.KVClient) (T, error)) (T, error) {
+	var resp T
+	var err error
+	ctx = metadata.AppendToOutgoingContext(ctx, h.header, "1")
+	for _, addr := range h.addrs {
+		var conn *grpc.ClientConn
+		conn, err = s.peers.get(addr)
+		if err != nil {
+			continue
+		}
+		resp, err = call(ctx, kv.NewKVClient(conn))
+		if status.Code(err) != codes.Unavailable {
+			break
+		}
+	}
+	return resp, err
+}
+
+// connPool keeps one client connection per node we talk to
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newConnPool() *connPool {
+	return &connPool{conns: make(map[string]*grpc.ClientConn)}
+}
+
+func (p *connPool) get(addr string) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conn := range p.conns {
+		_ = conn.Close()
+		delete(p.conns, addr)
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/ranges"
+)
+
+// checkNotLeader fails unless err is the NOT_LEADER error naming leader
+func checkNotLeader(t *testing.T, err error, leader string) {
+	t.Helper()
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FAILED_PRECONDITION, got %v", err)
+	}
+	got, ok := leaderFromError(err)
+	if !ok || got != leader {
+		t.Fatalf("expected NOT_LEADER details naming %s, got %q (%v)", leader, got, ok)
+	}
+}
+
+func TestNotLeaderError(t *testing.T) {
+	checkNotLeader(t, notLeaderError("10.0.0.1:4000"), "10.0.0.1:4000")
+	// no leader known yet is still a NOT_LEADER error
+	checkNotLeader(t, notLeaderError(""), "")
+
+	for _, err := range []error{
+		status.Error(codes.FailedPrecondition, "not the leader"),
+		status.Error(codes.Unavailable, "down"),
+		context.DeadlineExceeded,
+	} {
+		if _, ok := leaderFromError(err); ok {
+			t.Fatalf("%v taken for a NOT_LEADER error", err)
+		}
+	}
+}
+
+func TestForwardToLeader(t *testing.T) {
+	c := newTestCluster(t, 3, Options{ForwardToLeader: true}, table())
+	leader, follower := c.leader(1), c.follower(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := c.nodes[follower].client.Put(ctx, &kv.PutRequest{Key: []byte("k"), Value: []byte("v")})
+	if err != nil || !resp.Ok {
+		t.Fatalf("put on a follower failed: %v", err)
+	}
+	got, err := c.nodes[follower].client.Get(ctx, &kv.GetRequest{Key: []byte("k")})
+	if err != nil || string(got.Value) != "v" {
+		t.Fatalf("expected v read through a follower, got %q (%v)", got.GetValue(), err)
+	}
+
+	// a forwarded request that lands on a follower anyway is redirected,
+	// not forwarded again
+	fwd := metadata.AppendToOutgoingContext(ctx, forwardedHeader, "1")
+	_, err = c.nodes[follower].client.Put(fwd, &kv.PutRequest{Key: []byte("k"), Value: []byte("again")})
+	checkNotLeader(t, err, leader)
+	_, err = c.nodes[follower].client.Delete(fwd, &kv.DeleteRequest{Key: []byte("k")})
+	checkNotLeader(t, err, leader)
+	if got := c.get("k", 0); string(got.Value) != "v" {
+		t.Fatalf("redirected writes changed k to %q", got.Value)
+	}
+}
+
+func TestNotLeaderWithoutForwarding(t *testing.T) {
+	c := newTestCluster(t, 3, Options{}, table())
+	leader, follower := c.leader(1), c.follower(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.nodes[follower].client.Put(ctx, &kv.PutRequest{Key: []byte("k"), Value: []byte("v")})
+	checkNotLeader(t, err, leader)
+	_, err = c.nodes[follower].client.Delete(ctx, &kv.DeleteRequest{Key: []byte("k")})
+	checkNotLeader(t, err, leader)
+	_, err = c.nodes[follower].client.Get(ctx, &kv.GetRequest{Key: []byte("k")})
+	checkNotLeader(t, err, leader)
+	if c.get("k", 0).Found {
+		t.Fatalf("a redirected put was written")
+	}
+
+	// stale reads are served by any replica
+	if _, err := c.nodes[follower].client.Get(ctx, &kv.GetRequest{Key: []byte("k"), Consistency: kv.Consistency_STALE}); err != nil {
+		t.Fatalf("stale read on a follower failed: %v", err)
+	}
+}
+
+func TestRouteToRange(t *testing.T) {
+	// the last node hosts only the second range
+	c := newTestCluster(t, 3, Options{ForwardToLeader: true}, func(addrs []string) ranges.Layout {
+		layout, err := ranges.NewTable([]*ranges.Descriptor{
+			{ID: 1, EndKey: []byte("m"), Replicas: addrs[:2]},
+			{ID: 2, StartKey: []byte("m"), Replicas: addrs[1:]},
+		})
+		if err != nil {
+			panic(err)
+		}
+		return layout
+	})
+	outsider := c.addrs[2]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// passed to a replica of the range, which may still forward it
+	resp, err := c.nodes[outsider].client.Put(ctx, &kv.PutRequest{Key: []byte("a"), Value: []byte("v")})
+	if err != nil || !resp.Ok {
+		t.Fatalf("put on a node without the range failed: %v", err)
+	}
+	if got := c.get("a", 0); string(got.Value) != "v" {
+		t.Fatalf("expected a=v, got %q", got.Value)
+	}
+
+	// but a request that was routed here already, or forwarded, stops,
+	// without naming a replica that may not lead the range as its leader
+	for _, header := range []string{routedHeader, forwardedHeader} {
+		hop := metadata.AppendToOutgoingContext(ctx, header, "1")
+		_, err := c.nodes[outsider].client.Put(hop, &kv.PutRequest{Key: []byte("a"), Value: []byte("again")})
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected UNAVAILABLE with the %s header, got %v", header, err)
+		}
+		if _, ok := leaderFromError(err); ok {
+			t.Fatalf("expected no leader hint from a node without the range, got %v", err)
+		}
+	}
+	if got := c.get("a", 0); string(got.Value) != "v" {
+		t.Fatalf("a put that hit the hop limit was written: %q", got.Value)
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/storage"
+)
+
+// GC drops the versions of keys that are older than the retention window.
+// Each range's leader finds the last revision written before the window and
+// compacts up to it through the raft log, so every replica drops the same
+// versions and reads as of anything inside the window keep working.
+type GC struct {
+	router    *Router
+	retention time.Duration
+}
+
+// NewGC keeps retention worth of history for the ranges router has replicas
+// of
+func NewGC(router *Router, retention time.Duration) *GC {
+	return &GC{router: router, retention: retention}
+}
+
+// Run compacts every range led here once per interval until ctx is done
+func (g *GC) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, rep := range g.router.Replicas() {
+			if rep.Raft.IsLeader() {
+				if err := g.collect(ctx, rep); err != nil && ctx.Err() == nil {
+					log.Printf("[gc] range %d: %v", rep.ID, err)
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *GC) collect(ctx context.Context, rep *Replica) error {
+	rev, ok, err := rep.Store.RevisionAt(time.Now().Add(-g.retention))
+	switch {
+	case errors.Is(err, storage.ErrCompacted):
+		// already compacted past the window
+		return nil
+	case err != nil:
+		return err
+	case !ok || rev <= rep.Store.Compacted():
+		return nil
+	}
+
+	data, err := proto.Marshal(&kv.Command{Op: kv.CommandOp_OP_COMPACT, Revision: rev})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if _, err := rep.Raft.Propose(ctx, data); err != nil {
+		return fmt.Errorf("compacting up to revision %d: %w", rev, err)
+	}
+	log.Printf("[gc] range %d compacted up to revision %d", rep.ID, rev)
+	return nil
+}
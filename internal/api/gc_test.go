@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+)
+
+func TestGC(t *testing.T) {
+	c := newTestCluster(t, 3, Options{}, table())
+	before := time.Now()
+	old := c.put("k", "v0")
+	kept := c.put("k", "v1")
+	between := time.Now()
+	time.Sleep(500 * time.Millisecond)
+	latest := c.put("k", "v2")
+
+	// followers leave it to the leader
+	leader := c.leader(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for _, addr := range c.addrs {
+		if addr != leader {
+			go NewGC(c.nodes[addr].router, 300*time.Millisecond).Run(ctx, 10*time.Millisecond)
+		}
+	}
+	<-ctx.Done()
+	for _, addr := range c.addrs {
+		if got := c.nodes[addr].stores[1].Compacted(); got != 0 {
+			t.Fatalf("%s compacted up to %d with only followers collecting", addr, got)
+		}
+	}
+
+	// v1 is the key as of the start of the window, only v0 is older
+	if err := NewGC(c.nodes[leader].router, 300*time.Millisecond).collect(context.Background(), c.nodes[leader].replica[1]); err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, addr := range c.addrs {
+		for c.nodes[addr].stores[1].Compacted() != kept.ModRevision {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s compacted up to %d, expected %d", addr, c.nodes[addr].stores[1].Compacted(), kept.ModRevision)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	get := func(req *kv.GetRequest) (*kv.GetResponse, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req.Key = []byte("k")
+		return c.nodes[leader].client.Get(ctx, req)
+	}
+	for _, req := range []*kv.GetRequest{
+		{AsOfRevision: old.ModRevision},
+		{AsOfTime: before.UnixNano()},
+	} {
+		if _, err := get(req); status.Code(err) != codes.OutOfRange {
+			t.Fatalf("expected OutOfRange reading compacted history with %v, got %v", req, err)
+		}
+	}
+	for _, tc := range []struct {
+		req  *kv.GetRequest
+		want string
+	}{
+		{&kv.GetRequest{AsOfRevision: kept.ModRevision}, "v1"},
+		{&kv.GetRequest{AsOfTime: between.UnixNano()}, "v1"},
+		{&kv.GetRequest{}, "v2"},
+		{&kv.GetRequest{AsOfRevision: latest.ModRevision}, "v2"},
+	} {
+		resp, err := get(tc.req)
+		if err != nil || string(resp.Value) != tc.want {
+			t.Fatalf("expected %s reading with %v, got %q (%v)", tc.want, tc.req, resp.GetValue(), err)
+		}
+	}
+
+	// nothing more to do until more of the history leaves the window
+	if err := NewGC(c.nodes[leader].router, time.Hour).collect(context.Background(), c.nodes[leader].replica[1]); err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	if got := c.nodes[leader].stores[1].Compacted(); got != kept.ModRevision {
+		t.Fatalf("compacted moved to %d with nothing outside the window", got)
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"container/heap"
+	"math/rand/v2"
+	"sort"
+	"sync"
+
+	"github.com/jerkeyray/mimori/internal/api/adminpb"
+)
+
+// hotKeyCapacity is how many keys, and separately prefixes, are tracked
+const hotKeyCapacity = 256
+
+// HotKeys estimates which keys and key prefixes get the most requests. It
+// samples one request in every sampleRate and counts them with the
+// space-saving algorithm: there is a fixed number of counters, and a key
+// that isn't tracked yet takes over the smallest one. Whatever that counter
+// held becomes the key's error, as the key may have been seen that often
+// before. Memory stays fixed however many distinct keys there are, and a
+// key getting a large share of the requests is never pushed out.
+type HotKeys struct {
+	rate   uint32
+	delims string
+
+	mu       sync.Mutex
+	keys     *topK
+	prefixes *topK
+}
+
+// NewHotKeys tracks keys, and prefixes ending in one of the characters in
+// delims, sampling one request in sampleRate. It returns nil, which records
+// nothing, when sampleRate is 0.
+func NewHotKeys(sampleRate int, delims string) *HotKeys {
+	if sampleRate <= 0 {
+		return nil
+	}
+	return &HotKeys{
+		rate:     uint32(sampleRate),
+		delims:   delims,
+		keys:     newTopK(hotKeyCapacity),
+		prefixes: newTopK(hotKeyCapacity),
+	}
+}
+
+// Record notes a request for key that read or wrote n bytes
+func (h *HotKeys) Record(key []byte, write bool, n int) {
+	if h == nil || (h.rate > 1 && rand.Uint32N(h.rate) != 0) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys.add(string(key), write, n)
+	// the prefix runs up to and including the first delimiter
+	if i := bytes.IndexAny(key, h.delims); i >= 0 {
+		h.prefixes.add(string(key[:i+1]), write, n)
+	}
+}
+
+// Top returns up to limit of the busiest keys and prefixes, all of them when
+// limit is 0, with the sampled counts scaled back up
+func (h *HotKeys) Top(limit int) (keys, prefixes []*adminpb.KeyStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.keys.top(limit, h.rate), h.prefixes.top(limit, h.rate)
+}
+
+// counter tracks one key. reads, writes and bytes only count what was seen
+// since the key got the counter, err is what the counter held before.
+type counter struct {
+	key                  string
+	reads, writes, bytes uint64
+	err                  uint64
+	index                int // position in the heap
+}
+
+// count is the estimated number of requests for the key, never below the
+// real number and at most err above it
+func (c *counter) count() uint64 {
+	return c.err + c.reads + c.writes
+}
+
+type topK struct {
+	capacity int
+	byKey    map[string]*counter
+	heap     counterHeap
+}
+
+func newTopK(capacity int) *topK {
+	return &topK{capacity: capacity, byKey: make(map[string]*counter, capacity)}
+}
+
+func (t *topK) add(key string, write bool, n int) {
+	c, ok := t.byKey[key]
+	switch {
+	case ok:
+	case len(t.heap) < t.capacity:
+		c = &counter{key: key}
+		heap.Push(&t.heap, c)
+		t.byKey[key] = c
+	default:
+		// take over the smallest counter
+		c = t.heap[0]
+		delete(t.byKey, c.key)
+		*c = counter{key: key, err: c.count(), index: c.index}
+		t.byKey[key] = c
+	}
+
+	if write {
+		c.writes++
+	} else {
+		c.reads++
+	}
+	c.bytes += uint64(n)
+	heap.Fix(&t.heap, c.index)
+}
+
+func (t *topK) top(limit int, scale uint32) []*adminpb.KeyStats {
+	counters := make([]*counter, len(t.heap))
+	copy(counters, t.heap)
+	sort.Slice(counters, func(i, j int) bool {
+		if a, b := counters[i].count(), counters[j].count(); a != b {
+			return a > b
+		}
+		return counters[i].key < counters[j].key
+	})
+	if limit > 0 && len(counters) > limit {
+		counters = counters[:limit]
+	}
+
+	s := uint64(scale)
+	out := make([]*adminpb.KeyStats, len(counters))
+	for i, c := range counters {
+		out[i] = &adminpb.KeyStats{
+			Key:    []byte(c.key),
+			Reads:  c.reads * s,
+			Writes: c.writes * s,
+			Bytes:  c.bytes * s,
+			Error:  c.err * s,
+		}
+	}
+	return out
+}
+
+// counterHeap is a min-heap of counters by count
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].count() < h[j].count() }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x any) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+)
+
+// heavy keys survive a stream of one-off keys far larger than the number of
+// counters, with counts that never fall short of the real ones
+func TestTopKHeavyKeys(t *testing.T) {
+	tk := newTopK(8)
+	actual := make(map[string]uint64)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("cold-%d", i)
+		switch {
+		case i%2 == 0:
+			key = "hot"
+		case i%5 == 0:
+			key = "warm"
+		}
+		tk.add(key, i%3 == 0, 10)
+		actual[key]++
+	}
+
+	top := tk.top(2, 1)
+	if len(top) != 2 || string(top[0].Key) != "hot" || string(top[1].Key) != "warm" {
+		t.Fatalf("expected hot and warm on top, got %v", top)
+	}
+	for _, st := range tk.top(0, 1) {
+		seen := st.Reads + st.Writes
+		if want := actual[string(st.Key)]; seen > want || seen+st.Error < want {
+			t.Fatalf("%s counted %d with error %d, really %d", st.Key, seen, st.Error, want)
+		}
+	}
+	if hot := top[0]; hot.Bytes != 10*(hot.Reads+hot.Writes) {
+		t.Fatalf("expected 10 bytes per request for hot, got %d over %d", hot.Bytes, hot.Reads+hot.Writes)
+	}
+}
+
+func TestHotKeysPrefixes(t *testing.T) {
+	h := NewHotKeys(1, ":/")
+	for i := 0; i < 30; i++ {
+		h.Record([]byte(fmt.Sprintf("user:%d:name", i)), false, 1)
+	}
+	h.Record([]byte("img/1.png"), true, 1)
+	h.Record([]byte("plain"), true, 1)
+
+	keys, prefixes := h.Top(0)
+	if len(keys) != 32 {
+		t.Fatalf("expected 32 keys, got %d", len(keys))
+	}
+	if len(prefixes) != 2 {
+		t.Fatalf("expected 2 prefixes, got %v", prefixes)
+	}
+	if p := prefixes[0]; string(p.Key) != "user:" || p.Reads != 30 {
+		t.Fatalf("expected 30 reads for user:, got %v", p)
+	}
+	if p := prefixes[1]; string(p.Key) != "img/" || p.Writes != 1 {
+		t.Fatalf("expected 1 write for img/, got %v", p)
+	}
+
+	if NewHotKeys(0, ":") != nil {
+		t.Fatalf("expected a sample rate of 0 to turn tracking off")
+	}
+}
@@ -21,13 +21,121 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
-// Messages
+// Consistency picks how fresh a read must be
+type Consistency int32
+
+const (
+	// confirm leadership with a heartbeat round before reading (ReadIndex)
+	Consistency_LINEARIZABLE Consistency = 0
+	// read on the leader while it holds a lease, relies on bounded clock drift
+	Consistency_LEASE Consistency = 1
+	// read whatever the node that receives the request has applied
+	Consistency_STALE Consistency = 2
+)
+
+// Enum value maps for Consistency.
+var (
+	Consistency_name = map[int32]string{
+		0: "LINEARIZABLE",
+		1: "LEASE",
+		2: "STALE",
+	}
+	Consistency_value = map[string]int32{
+		"LINEARIZABLE": 0,
+		"LEASE":        1,
+		"STALE":        2,
+	}
+)
+
+func (x Consistency) Enum() *Consistency {
+	p := new(Consistency)
+	*p = x
+	return p
+}
+
+func (x Consistency) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Consistency) Descriptor() protoreflect.EnumDescriptor {
+	return file_kv_proto_enumTypes[0].Descriptor()
+}
+
+func (Consistency) Type() protoreflect.EnumType {
+	return &file_kv_proto_enumTypes[0]
+}
+
+func (x Consistency) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Consistency.Descriptor instead.
+func (Consistency) EnumDescriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{0}
+}
+
+// CommandOp is the kind of mutation carried by a Command.
+type CommandOp int32
+
+const (
+	CommandOp_OP_PUT     CommandOp = 0
+	CommandOp_OP_DELETE  CommandOp = 1
+	CommandOp_OP_BATCH   CommandOp = 2
+	CommandOp_OP_COMPACT CommandOp = 3
+)
+
+// Enum value maps for CommandOp.
+var (
+	CommandOp_name = map[int32]string{
+		0: "OP_PUT",
+		1: "OP_DELETE",
+		2: "OP_BATCH",
+		3: "OP_COMPACT",
+	}
+	CommandOp_value = map[string]int32{
+		"OP_PUT":     0,
+		"OP_DELETE":  1,
+		"OP_BATCH":   2,
+		"OP_COMPACT": 3,
+	}
+)
+
+func (x CommandOp) Enum() *CommandOp {
+	p := new(CommandOp)
+	*p = x
+	return p
+}
+
+func (x CommandOp) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (CommandOp) Descriptor() protoreflect.EnumDescriptor {
+	return file_kv_proto_enumTypes[1].Descriptor()
+}
+
+func (CommandOp) Type() protoreflect.EnumType {
+	return &file_kv_proto_enumTypes[1]
+}
+
+func (x CommandOp) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use CommandOp.Descriptor instead.
+func (CommandOp) EnumDescriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{1}
+}
+
 type PutRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
-	Value         []byte                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Key   []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value []byte                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	// if not 0, the put only goes ahead if the key was last written at this
+	// revision
+	ExpectedModRevision uint64 `protobuf:"varint,3,opt,name=expected_mod_revision,json=expectedModRevision,proto3" json:"expected_mod_revision,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
 }
 
 func (x *PutRequest) Reset() {
@@ -74,11 +182,23 @@ func (x *PutRequest) GetValue() []byte {
 	return nil
 }
 
+func (x *PutRequest) GetExpectedModRevision() uint64 {
+	if x != nil {
+		return x.ExpectedModRevision
+	}
+	return 0
+}
+
+// PutResponse carries the key's revisions after the put, or its current
+// ones when ok is false because expected_mod_revision did not match
 type PutResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Ok            bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Ok             bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	CreateRevision uint64                 `protobuf:"varint,2,opt,name=create_revision,json=createRevision,proto3" json:"create_revision,omitempty"`
+	ModRevision    uint64                 `protobuf:"varint,3,opt,name=mod_revision,json=modRevision,proto3" json:"mod_revision,omitempty"`
+	Version        uint64                 `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *PutResponse) Reset() {
@@ -118,9 +238,35 @@ func (x *PutResponse) GetOk() bool {
 	return false
 }
 
+func (x *PutResponse) GetCreateRevision() uint64 {
+	if x != nil {
+		return x.CreateRevision
+	}
+	return 0
+}
+
+func (x *PutResponse) GetModRevision() uint64 {
+	if x != nil {
+		return x.ModRevision
+	}
+	return 0
+}
+
+func (x *PutResponse) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
 type GetRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Key         []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Consistency Consistency            `protobuf:"varint,2,opt,name=consistency,proto3,enum=kv.Consistency" json:"consistency,omitempty"`
+	// read the key as it was at this revision of its range, 0 for the latest
+	AsOfRevision uint64 `protobuf:"varint,3,opt,name=as_of_revision,json=asOfRevision,proto3" json:"as_of_revision,omitempty"`
+	// or as it was at this time, in unix nanoseconds
+	AsOfTime      int64 `protobuf:"varint,4,opt,name=as_of_time,json=asOfTime,proto3" json:"as_of_time,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -162,12 +308,36 @@ func (x *GetRequest) GetKey() []byte {
 	return nil
 }
 
+func (x *GetRequest) GetConsistency() Consistency {
+	if x != nil {
+		return x.Consistency
+	}
+	return Consistency_LINEARIZABLE
+}
+
+func (x *GetRequest) GetAsOfRevision() uint64 {
+	if x != nil {
+		return x.AsOfRevision
+	}
+	return 0
+}
+
+func (x *GetRequest) GetAsOfTime() int64 {
+	if x != nil {
+		return x.AsOfTime
+	}
+	return 0
+}
+
 type GetResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Value         []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
-	Found         bool                   `protobuf:"varint,2,opt,name=found,proto3" json:"found,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Value          []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	Found          bool                   `protobuf:"varint,2,opt,name=found,proto3" json:"found,omitempty"`
+	CreateRevision uint64                 `protobuf:"varint,3,opt,name=create_revision,json=createRevision,proto3" json:"create_revision,omitempty"`
+	ModRevision    uint64                 `protobuf:"varint,4,opt,name=mod_revision,json=modRevision,proto3" json:"mod_revision,omitempty"`
+	Version        uint64                 `protobuf:"varint,5,opt,name=version,proto3" json:"version,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *GetResponse) Reset() {
@@ -214,6 +384,27 @@ func (x *GetResponse) GetFound() bool {
 	return false
 }
 
+func (x *GetResponse) GetCreateRevision() uint64 {
+	if x != nil {
+		return x.CreateRevision
+	}
+	return 0
+}
+
+func (x *GetResponse) GetModRevision() uint64 {
+	if x != nil {
+		return x.ModRevision
+	}
+	return 0
+}
+
+func (x *GetResponse) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
 type DeleteRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
@@ -302,26 +493,30 @@ func (x *DeleteResponse) GetDeleted() bool {
 	return false
 }
 
-type HealthRequest struct {
+// BatchOp is one write in a batch, a put unless delete is set
+type BatchOp struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Delete        bool                   `protobuf:"varint,3,opt,name=delete,proto3" json:"delete,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *HealthRequest) Reset() {
-	*x = HealthRequest{}
+func (x *BatchOp) Reset() {
+	*x = BatchOp{}
 	mi := &file_kv_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *HealthRequest) String() string {
+func (x *BatchOp) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*HealthRequest) ProtoMessage() {}
+func (*BatchOp) ProtoMessage() {}
 
-func (x *HealthRequest) ProtoReflect() protoreflect.Message {
+func (x *BatchOp) ProtoReflect() protoreflect.Message {
 	mi := &file_kv_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -333,32 +528,55 @@ func (x *HealthRequest) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use HealthRequest.ProtoReflect.Descriptor instead.
-func (*HealthRequest) Descriptor() ([]byte, []int) {
+// Deprecated: Use BatchOp.ProtoReflect.Descriptor instead.
+func (*BatchOp) Descriptor() ([]byte, []int) {
 	return file_kv_proto_rawDescGZIP(), []int{6}
 }
 
-type HealthResponse struct {
+func (x *BatchOp) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *BatchOp) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+func (x *BatchOp) GetDelete() bool {
+	if x != nil {
+		return x.Delete
+	}
+	return false
+}
+
+// BatchRequest applies ops in order, all of them or none. The keys must all
+// be in the same range, writes to several ranges are not atomic.
+type BatchRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Ops           []*BatchOp             `protobuf:"bytes,1,rep,name=ops,proto3" json:"ops,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *HealthResponse) Reset() {
-	*x = HealthResponse{}
+func (x *BatchRequest) Reset() {
+	*x = BatchRequest{}
 	mi := &file_kv_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *HealthResponse) String() string {
+func (x *BatchRequest) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*HealthResponse) ProtoMessage() {}
+func (*BatchRequest) ProtoMessage() {}
 
-func (x *HealthResponse) ProtoReflect() protoreflect.Message {
+func (x *BatchRequest) ProtoReflect() protoreflect.Message {
 	mi := &file_kv_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -370,46 +588,930 @@ func (x *HealthResponse) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use HealthResponse.ProtoReflect.Descriptor instead.
-func (*HealthResponse) Descriptor() ([]byte, []int) {
+// Deprecated: Use BatchRequest.ProtoReflect.Descriptor instead.
+func (*BatchRequest) Descriptor() ([]byte, []int) {
 	return file_kv_proto_rawDescGZIP(), []int{7}
 }
 
-func (x *HealthResponse) GetStatus() string {
+func (x *BatchRequest) GetOps() []*BatchOp {
 	if x != nil {
-		return x.Status
+		return x.Ops
 	}
-	return ""
+	return nil
 }
 
-var File_kv_proto protoreflect.FileDescriptor
+type BatchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ok            bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
 
-const file_kv_proto_rawDesc = "" +
-	"\n" +
-	"\bkv.proto\x12\x02kv\"4\n" +
-	"\n" +
-	"PutRequest\x12\x10\n" +
-	"\x03key\x18\x01 \x01(\fR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\fR\x05value\"\x1d\n" +
-	"\vPutResponse\x12\x0e\n" +
-	"\x02ok\x18\x01 \x01(\bR\x02ok\"\x1e\n" +
-	"\n" +
-	"GetRequest\x12\x10\n" +
-	"\x03key\x18\x01 \x01(\fR\x03key\"9\n" +
-	"\vGetResponse\x12\x14\n" +
-	"\x05value\x18\x01 \x01(\fR\x05value\x12\x14\n" +
-	"\x05found\x18\x02 \x01(\bR\x05found\"!\n" +
-	"\rDeleteRequest\x12\x10\n" +
-	"\x03key\x18\x01 \x01(\fR\x03key\"*\n" +
-	"\x0eDeleteResponse\x12\x18\n" +
-	"\adeleted\x18\x01 \x01(\bR\adeleted\"\x0f\n" +
-	"\rHealthRequest\"(\n" +
-	"\x0eHealthResponse\x12\x16\n" +
-	"\x06status\x18\x01 \x01(\tR\x06status2\xb6\x01\n" +
+func (x *BatchResponse) Reset() {
+	*x = BatchResponse{}
+	mi := &file_kv_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchResponse) ProtoMessage() {}
+
+func (x *BatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchResponse.ProtoReflect.Descriptor instead.
+func (*BatchResponse) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *BatchResponse) GetOk() bool {
+	if x != nil {
+		return x.Ok
+	}
+	return false
+}
+
+// PutIfAbsent writes value only if key does not exist yet
+type PutIfAbsentRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PutIfAbsentRequest) Reset() {
+	*x = PutIfAbsentRequest{}
+	mi := &file_kv_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PutIfAbsentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PutIfAbsentRequest) ProtoMessage() {}
+
+func (x *PutIfAbsentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PutIfAbsentRequest.ProtoReflect.Descriptor instead.
+func (*PutIfAbsentRequest) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *PutIfAbsentRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *PutIfAbsentRequest) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+// CompareAndSwap writes value only if key currently holds expected
+type CompareAndSwapRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Expected      []byte                 `protobuf:"bytes,2,opt,name=expected,proto3" json:"expected,omitempty"`
+	Value         []byte                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CompareAndSwapRequest) Reset() {
+	*x = CompareAndSwapRequest{}
+	mi := &file_kv_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CompareAndSwapRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CompareAndSwapRequest) ProtoMessage() {}
+
+func (x *CompareAndSwapRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CompareAndSwapRequest.ProtoReflect.Descriptor instead.
+func (*CompareAndSwapRequest) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *CompareAndSwapRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *CompareAndSwapRequest) GetExpected() []byte {
+	if x != nil {
+		return x.Expected
+	}
+	return nil
+}
+
+func (x *CompareAndSwapRequest) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+// CompareAndDelete deletes key only if it currently holds expected
+type CompareAndDeleteRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Expected      []byte                 `protobuf:"bytes,2,opt,name=expected,proto3" json:"expected,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CompareAndDeleteRequest) Reset() {
+	*x = CompareAndDeleteRequest{}
+	mi := &file_kv_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CompareAndDeleteRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CompareAndDeleteRequest) ProtoMessage() {}
+
+func (x *CompareAndDeleteRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CompareAndDeleteRequest.ProtoReflect.Descriptor instead.
+func (*CompareAndDeleteRequest) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *CompareAndDeleteRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *CompareAndDeleteRequest) GetExpected() []byte {
+	if x != nil {
+		return x.Expected
+	}
+	return nil
+}
+
+// ConditionalResponse tells whether a conditional write went ahead. When its
+// condition failed nothing was written, and the key's current value is
+// returned instead.
+type ConditionalResponse struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	Succeeded          bool                   `protobuf:"varint,1,opt,name=succeeded,proto3" json:"succeeded,omitempty"`
+	CurrentValue       []byte                 `protobuf:"bytes,2,opt,name=current_value,json=currentValue,proto3" json:"current_value,omitempty"`  // only when the condition failed
+	CurrentFound       bool                   `protobuf:"varint,3,opt,name=current_found,json=currentFound,proto3" json:"current_found,omitempty"` // false if the key does not exist
+	CurrentModRevision uint64                 `protobuf:"varint,4,opt,name=current_mod_revision,json=currentModRevision,proto3" json:"current_mod_revision,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *ConditionalResponse) Reset() {
+	*x = ConditionalResponse{}
+	mi := &file_kv_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConditionalResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConditionalResponse) ProtoMessage() {}
+
+func (x *ConditionalResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConditionalResponse.ProtoReflect.Descriptor instead.
+func (*ConditionalResponse) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ConditionalResponse) GetSucceeded() bool {
+	if x != nil {
+		return x.Succeeded
+	}
+	return false
+}
+
+func (x *ConditionalResponse) GetCurrentValue() []byte {
+	if x != nil {
+		return x.CurrentValue
+	}
+	return nil
+}
+
+func (x *ConditionalResponse) GetCurrentFound() bool {
+	if x != nil {
+		return x.CurrentFound
+	}
+	return false
+}
+
+func (x *ConditionalResponse) GetCurrentModRevision() uint64 {
+	if x != nil {
+		return x.CurrentModRevision
+	}
+	return 0
+}
+
+// Condition is what a key must hold for a conditional Command to be applied
+type Condition struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Absent bool                   `protobuf:"varint,1,opt,name=absent,proto3" json:"absent,omitempty"` // the key must not exist
+	Value  []byte                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`    // unless absent, the key must hold exactly this
+	// if not 0, the key must have last been written at this revision, and
+	// value is not checked
+	ModRevision   uint64 `protobuf:"varint,3,opt,name=mod_revision,json=modRevision,proto3" json:"mod_revision,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Condition) Reset() {
+	*x = Condition{}
+	mi := &file_kv_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Condition) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Condition) ProtoMessage() {}
+
+func (x *Condition) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Condition.ProtoReflect.Descriptor instead.
+func (*Condition) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *Condition) GetAbsent() bool {
+	if x != nil {
+		return x.Absent
+	}
+	return false
+}
+
+func (x *Condition) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+func (x *Condition) GetModRevision() uint64 {
+	if x != nil {
+		return x.ModRevision
+	}
+	return 0
+}
+
+// ScanRequest reads the pairs from start up to end, narrowed down to the keys
+// starting with prefix when one is set. Pairs come in key order, or from the
+// largest key down when reverse is set.
+type ScanRequest struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Start       []byte                 `protobuf:"bytes,1,opt,name=start,proto3" json:"start,omitempty"` // inclusive, empty for the start of the keyspace
+	End         []byte                 `protobuf:"bytes,2,opt,name=end,proto3" json:"end,omitempty"`     // exclusive, empty for the end of the keyspace
+	Prefix      []byte                 `protobuf:"bytes,3,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	Reverse     bool                   `protobuf:"varint,4,opt,name=reverse,proto3" json:"reverse,omitempty"`
+	Limit       uint32                 `protobuf:"varint,5,opt,name=limit,proto3" json:"limit,omitempty"` // most pairs to return, 0 for all of them
+	Consistency Consistency            `protobuf:"varint,6,opt,name=consistency,proto3,enum=kv.Consistency" json:"consistency,omitempty"`
+	// next_page_token of the previous page, the rest of the request must be
+	// the same as for that page
+	PageToken []byte `protobuf:"bytes,7,opt,name=page_token,json=pageToken,proto3" json:"page_token,omitempty"`
+	// internal: scan only this range, which the receiver hosts, rather than
+	// the whole keyspace
+	RangeId uint64 `protobuf:"varint,8,opt,name=range_id,json=rangeId,proto3" json:"range_id,omitempty"`
+	// read the keys as they were at this revision, only for scans within
+	// one range as every range counts its own
+	AsOfRevision uint64 `protobuf:"varint,9,opt,name=as_of_revision,json=asOfRevision,proto3" json:"as_of_revision,omitempty"`
+	// or as they were at this time, in unix nanoseconds
+	AsOfTime      int64 `protobuf:"varint,10,opt,name=as_of_time,json=asOfTime,proto3" json:"as_of_time,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ScanRequest) Reset() {
+	*x = ScanRequest{}
+	mi := &file_kv_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ScanRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanRequest) ProtoMessage() {}
+
+func (x *ScanRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanRequest.ProtoReflect.Descriptor instead.
+func (*ScanRequest) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *ScanRequest) GetStart() []byte {
+	if x != nil {
+		return x.Start
+	}
+	return nil
+}
+
+func (x *ScanRequest) GetEnd() []byte {
+	if x != nil {
+		return x.End
+	}
+	return nil
+}
+
+func (x *ScanRequest) GetPrefix() []byte {
+	if x != nil {
+		return x.Prefix
+	}
+	return nil
+}
+
+func (x *ScanRequest) GetReverse() bool {
+	if x != nil {
+		return x.Reverse
+	}
+	return false
+}
+
+func (x *ScanRequest) GetLimit() uint32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *ScanRequest) GetConsistency() Consistency {
+	if x != nil {
+		return x.Consistency
+	}
+	return Consistency_LINEARIZABLE
+}
+
+func (x *ScanRequest) GetPageToken() []byte {
+	if x != nil {
+		return x.PageToken
+	}
+	return nil
+}
+
+func (x *ScanRequest) GetRangeId() uint64 {
+	if x != nil {
+		return x.RangeId
+	}
+	return 0
+}
+
+func (x *ScanRequest) GetAsOfRevision() uint64 {
+	if x != nil {
+		return x.AsOfRevision
+	}
+	return 0
+}
+
+func (x *ScanRequest) GetAsOfTime() int64 {
+	if x != nil {
+		return x.AsOfTime
+	}
+	return 0
+}
+
+type KeyValue struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *KeyValue) Reset() {
+	*x = KeyValue{}
+	mi := &file_kv_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *KeyValue) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyValue) ProtoMessage() {}
+
+func (x *KeyValue) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyValue.ProtoReflect.Descriptor instead.
+func (*KeyValue) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *KeyValue) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *KeyValue) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+// ScanResponse is one batch of a scan's pairs
+type ScanResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Kvs   []*KeyValue            `protobuf:"bytes,1,rep,name=kvs,proto3" json:"kvs,omitempty"`
+	// set on the last batch when the limit cut the scan short, pass it as
+	// page_token to read the next page
+	NextPageToken []byte `protobuf:"bytes,2,opt,name=next_page_token,json=nextPageToken,proto3" json:"next_page_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ScanResponse) Reset() {
+	*x = ScanResponse{}
+	mi := &file_kv_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ScanResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanResponse) ProtoMessage() {}
+
+func (x *ScanResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanResponse.ProtoReflect.Descriptor instead.
+func (*ScanResponse) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *ScanResponse) GetKvs() []*KeyValue {
+	if x != nil {
+		return x.Kvs
+	}
+	return nil
+}
+
+func (x *ScanResponse) GetNextPageToken() []byte {
+	if x != nil {
+		return x.NextPageToken
+	}
+	return nil
+}
+
+type HealthRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HealthRequest) Reset() {
+	*x = HealthRequest{}
+	mi := &file_kv_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HealthRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HealthRequest) ProtoMessage() {}
+
+func (x *HealthRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HealthRequest.ProtoReflect.Descriptor instead.
+func (*HealthRequest) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{17}
+}
+
+type HealthResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HealthResponse) Reset() {
+	*x = HealthResponse{}
+	mi := &file_kv_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HealthResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HealthResponse) ProtoMessage() {}
+
+func (x *HealthResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HealthResponse.ProtoReflect.Descriptor instead.
+func (*HealthResponse) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *HealthResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+// NotLeader is attached to FAILED_PRECONDITION errors returned by a node
+// that cannot accept a write, so the client can retry on the leader. A node
+// that does not host the key's range at all names one that does.
+type NotLeader struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	LeaderAddr    string                 `protobuf:"bytes,1,opt,name=leader_addr,json=leaderAddr,proto3" json:"leader_addr,omitempty"` // empty while an election is in progress
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NotLeader) Reset() {
+	*x = NotLeader{}
+	mi := &file_kv_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NotLeader) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NotLeader) ProtoMessage() {}
+
+func (x *NotLeader) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NotLeader.ProtoReflect.Descriptor instead.
+func (*NotLeader) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *NotLeader) GetLeaderAddr() string {
+	if x != nil {
+		return x.LeaderAddr
+	}
+	return ""
+}
+
+// Command is a mutation replicated through the raft log.
+// It is internal to mimori and never sent by clients.
+type Command struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Op            CommandOp              `protobuf:"varint,1,opt,name=op,proto3,enum=kv.CommandOp" json:"op,omitempty"`
+	Key           []byte                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Value         []byte                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	Ops           []*BatchOp             `protobuf:"bytes,4,rep,name=ops,proto3" json:"ops,omitempty"`              // for OP_BATCH
+	Condition     *Condition             `protobuf:"bytes,5,opt,name=condition,proto3" json:"condition,omitempty"`  // applied only if it holds, for OP_PUT and OP_DELETE
+	Timestamp     int64                  `protobuf:"varint,6,opt,name=timestamp,proto3" json:"timestamp,omitempty"` // when it was proposed, in unix nanoseconds
+	Revision      uint64                 `protobuf:"varint,7,opt,name=revision,proto3" json:"revision,omitempty"`   // for OP_COMPACT, the revision to compact up to
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Command) Reset() {
+	*x = Command{}
+	mi := &file_kv_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Command) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Command) ProtoMessage() {}
+
+func (x *Command) ProtoReflect() protoreflect.Message {
+	mi := &file_kv_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Command.ProtoReflect.Descriptor instead.
+func (*Command) Descriptor() ([]byte, []int) {
+	return file_kv_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *Command) GetOp() CommandOp {
+	if x != nil {
+		return x.Op
+	}
+	return CommandOp_OP_PUT
+}
+
+func (x *Command) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *Command) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+func (x *Command) GetOps() []*BatchOp {
+	if x != nil {
+		return x.Ops
+	}
+	return nil
+}
+
+func (x *Command) GetCondition() *Condition {
+	if x != nil {
+		return x.Condition
+	}
+	return nil
+}
+
+func (x *Command) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Command) GetRevision() uint64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+var File_kv_proto protoreflect.FileDescriptor
+
+const file_kv_proto_rawDesc = "" +
+	"\n" +
+	"\bkv.proto\x12\x02kv\"h\n" +
+	"\n" +
+	"PutRequest\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\fR\x05value\x122\n" +
+	"\x15expected_mod_revision\x18\x03 \x01(\x04R\x13expectedModRevision\"\x83\x01\n" +
+	"\vPutResponse\x12\x0e\n" +
+	"\x02ok\x18\x01 \x01(\bR\x02ok\x12'\n" +
+	"\x0fcreate_revision\x18\x02 \x01(\x04R\x0ecreateRevision\x12!\n" +
+	"\fmod_revision\x18\x03 \x01(\x04R\vmodRevision\x12\x18\n" +
+	"\aversion\x18\x04 \x01(\x04R\aversion\"\x95\x01\n" +
+	"\n" +
+	"GetRequest\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x121\n" +
+	"\vconsistency\x18\x02 \x01(\x0e2\x0f.kv.ConsistencyR\vconsistency\x12$\n" +
+	"\x0eas_of_revision\x18\x03 \x01(\x04R\fasOfRevision\x12\x1c\n" +
+	"\n" +
+	"as_of_time\x18\x04 \x01(\x03R\basOfTime\"\x9f\x01\n" +
+	"\vGetResponse\x12\x14\n" +
+	"\x05value\x18\x01 \x01(\fR\x05value\x12\x14\n" +
+	"\x05found\x18\x02 \x01(\bR\x05found\x12'\n" +
+	"\x0fcreate_revision\x18\x03 \x01(\x04R\x0ecreateRevision\x12!\n" +
+	"\fmod_revision\x18\x04 \x01(\x04R\vmodRevision\x12\x18\n" +
+	"\aversion\x18\x05 \x01(\x04R\aversion\"!\n" +
+	"\rDeleteRequest\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\"*\n" +
+	"\x0eDeleteResponse\x12\x18\n" +
+	"\adeleted\x18\x01 \x01(\bR\adeleted\"I\n" +
+	"\aBatchOp\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\fR\x05value\x12\x16\n" +
+	"\x06delete\x18\x03 \x01(\bR\x06delete\"-\n" +
+	"\fBatchRequest\x12\x1d\n" +
+	"\x03ops\x18\x01 \x03(\v2\v.kv.BatchOpR\x03ops\"\x1f\n" +
+	"\rBatchResponse\x12\x0e\n" +
+	"\x02ok\x18\x01 \x01(\bR\x02ok\"<\n" +
+	"\x12PutIfAbsentRequest\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\fR\x05value\"[\n" +
+	"\x15CompareAndSwapRequest\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x1a\n" +
+	"\bexpected\x18\x02 \x01(\fR\bexpected\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\fR\x05value\"G\n" +
+	"\x17CompareAndDeleteRequest\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x1a\n" +
+	"\bexpected\x18\x02 \x01(\fR\bexpected\"\xaf\x01\n" +
+	"\x13ConditionalResponse\x12\x1c\n" +
+	"\tsucceeded\x18\x01 \x01(\bR\tsucceeded\x12#\n" +
+	"\rcurrent_value\x18\x02 \x01(\fR\fcurrentValue\x12#\n" +
+	"\rcurrent_found\x18\x03 \x01(\bR\fcurrentFound\x120\n" +
+	"\x14current_mod_revision\x18\x04 \x01(\x04R\x12currentModRevision\"\\\n" +
+	"\tCondition\x12\x16\n" +
+	"\x06absent\x18\x01 \x01(\bR\x06absent\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\fR\x05value\x12!\n" +
+	"\fmod_revision\x18\x03 \x01(\x04R\vmodRevision\"\xae\x02\n" +
+	"\vScanRequest\x12\x14\n" +
+	"\x05start\x18\x01 \x01(\fR\x05start\x12\x10\n" +
+	"\x03end\x18\x02 \x01(\fR\x03end\x12\x16\n" +
+	"\x06prefix\x18\x03 \x01(\fR\x06prefix\x12\x18\n" +
+	"\areverse\x18\x04 \x01(\bR\areverse\x12\x14\n" +
+	"\x05limit\x18\x05 \x01(\rR\x05limit\x121\n" +
+	"\vconsistency\x18\x06 \x01(\x0e2\x0f.kv.ConsistencyR\vconsistency\x12\x1d\n" +
+	"\n" +
+	"page_token\x18\a \x01(\fR\tpageToken\x12\x19\n" +
+	"\brange_id\x18\b \x01(\x04R\arangeId\x12$\n" +
+	"\x0eas_of_revision\x18\t \x01(\x04R\fasOfRevision\x12\x1c\n" +
+	"\n" +
+	"as_of_time\x18\n" +
+	" \x01(\x03R\basOfTime\"2\n" +
+	"\bKeyValue\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\fR\x05value\"V\n" +
+	"\fScanResponse\x12\x1e\n" +
+	"\x03kvs\x18\x01 \x03(\v2\f.kv.KeyValueR\x03kvs\x12&\n" +
+	"\x0fnext_page_token\x18\x02 \x01(\fR\rnextPageToken\"\x0f\n" +
+	"\rHealthRequest\"(\n" +
+	"\x0eHealthResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\",\n" +
+	"\tNotLeader\x12\x1f\n" +
+	"\vleader_addr\x18\x01 \x01(\tR\n" +
+	"leaderAddr\"\xd6\x01\n" +
+	"\aCommand\x12\x1d\n" +
+	"\x02op\x18\x01 \x01(\x0e2\r.kv.CommandOpR\x02op\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\fR\x03key\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\fR\x05value\x12\x1d\n" +
+	"\x03ops\x18\x04 \x03(\v2\v.kv.BatchOpR\x03ops\x12+\n" +
+	"\tcondition\x18\x05 \x01(\v2\r.kv.ConditionR\tcondition\x12\x1c\n" +
+	"\ttimestamp\x18\x06 \x01(\x03R\ttimestamp\x12\x1a\n" +
+	"\brevision\x18\a \x01(\x04R\brevision*5\n" +
+	"\vConsistency\x12\x10\n" +
+	"\fLINEARIZABLE\x10\x00\x12\t\n" +
+	"\x05LEASE\x10\x01\x12\t\n" +
+	"\x05STALE\x10\x02*D\n" +
+	"\tCommandOp\x12\n" +
+	"\n" +
+	"\x06OP_PUT\x10\x00\x12\r\n" +
+	"\tOP_DELETE\x10\x01\x12\f\n" +
+	"\bOP_BATCH\x10\x02\x12\x0e\n" +
+	"\n" +
+	"OP_COMPACT\x10\x032\xe1\x03\n" +
 	"\x02KV\x12&\n" +
 	"\x03Put\x12\x0e.kv.PutRequest\x1a\x0f.kv.PutResponse\x12&\n" +
 	"\x03Get\x12\x0e.kv.GetRequest\x1a\x0f.kv.GetResponse\x12/\n" +
-	"\x06Delete\x12\x11.kv.DeleteRequest\x1a\x12.kv.DeleteResponse\x12/\n" +
+	"\x06Delete\x12\x11.kv.DeleteRequest\x1a\x12.kv.DeleteResponse\x12+\n" +
+	"\x04Scan\x12\x0f.kv.ScanRequest\x1a\x10.kv.ScanResponse0\x01\x12,\n" +
+	"\x05Batch\x12\x10.kv.BatchRequest\x1a\x11.kv.BatchResponse\x12>\n" +
+	"\vPutIfAbsent\x12\x16.kv.PutIfAbsentRequest\x1a\x17.kv.ConditionalResponse\x12D\n" +
+	"\x0eCompareAndSwap\x12\x19.kv.CompareAndSwapRequest\x1a\x17.kv.ConditionalResponse\x12H\n" +
+	"\x10CompareAndDelete\x12\x1b.kv.CompareAndDeleteRequest\x1a\x17.kv.ConditionalResponse\x12/\n" +
 	"\x06Health\x12\x11.kv.HealthRequest\x1a\x12.kv.HealthResponseB\x14Z\x12internal/api/kv;kvb\x06proto3"
 
 var (
@@ -424,31 +1526,64 @@ func file_kv_proto_rawDescGZIP() []byte {
 	return file_kv_proto_rawDescData
 }
 
-var file_kv_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_kv_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_kv_proto_msgTypes = make([]protoimpl.MessageInfo, 21)
 var file_kv_proto_goTypes = []any{
-	(*PutRequest)(nil),     // 0: kv.PutRequest
-	(*PutResponse)(nil),    // 1: kv.PutResponse
-	(*GetRequest)(nil),     // 2: kv.GetRequest
-	(*GetResponse)(nil),    // 3: kv.GetResponse
-	(*DeleteRequest)(nil),  // 4: kv.DeleteRequest
-	(*DeleteResponse)(nil), // 5: kv.DeleteResponse
-	(*HealthRequest)(nil),  // 6: kv.HealthRequest
-	(*HealthResponse)(nil), // 7: kv.HealthResponse
+	(Consistency)(0),                // 0: kv.Consistency
+	(CommandOp)(0),                  // 1: kv.CommandOp
+	(*PutRequest)(nil),              // 2: kv.PutRequest
+	(*PutResponse)(nil),             // 3: kv.PutResponse
+	(*GetRequest)(nil),              // 4: kv.GetRequest
+	(*GetResponse)(nil),             // 5: kv.GetResponse
+	(*DeleteRequest)(nil),           // 6: kv.DeleteRequest
+	(*DeleteResponse)(nil),          // 7: kv.DeleteResponse
+	(*BatchOp)(nil),                 // 8: kv.BatchOp
+	(*BatchRequest)(nil),            // 9: kv.BatchRequest
+	(*BatchResponse)(nil),           // 10: kv.BatchResponse
+	(*PutIfAbsentRequest)(nil),      // 11: kv.PutIfAbsentRequest
+	(*CompareAndSwapRequest)(nil),   // 12: kv.CompareAndSwapRequest
+	(*CompareAndDeleteRequest)(nil), // 13: kv.CompareAndDeleteRequest
+	(*ConditionalResponse)(nil),     // 14: kv.ConditionalResponse
+	(*Condition)(nil),               // 15: kv.Condition
+	(*ScanRequest)(nil),             // 16: kv.ScanRequest
+	(*KeyValue)(nil),                // 17: kv.KeyValue
+	(*ScanResponse)(nil),            // 18: kv.ScanResponse
+	(*HealthRequest)(nil),           // 19: kv.HealthRequest
+	(*HealthResponse)(nil),          // 20: kv.HealthResponse
+	(*NotLeader)(nil),               // 21: kv.NotLeader
+	(*Command)(nil),                 // 22: kv.Command
 }
 var file_kv_proto_depIdxs = []int32{
-	0, // 0: kv.KV.Put:input_type -> kv.PutRequest
-	2, // 1: kv.KV.Get:input_type -> kv.GetRequest
-	4, // 2: kv.KV.Delete:input_type -> kv.DeleteRequest
-	6, // 3: kv.KV.Health:input_type -> kv.HealthRequest
-	1, // 4: kv.KV.Put:output_type -> kv.PutResponse
-	3, // 5: kv.KV.Get:output_type -> kv.GetResponse
-	5, // 6: kv.KV.Delete:output_type -> kv.DeleteResponse
-	7, // 7: kv.KV.Health:output_type -> kv.HealthResponse
-	4, // [4:8] is the sub-list for method output_type
-	0, // [0:4] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0,  // 0: kv.GetRequest.consistency:type_name -> kv.Consistency
+	8,  // 1: kv.BatchRequest.ops:type_name -> kv.BatchOp
+	0,  // 2: kv.ScanRequest.consistency:type_name -> kv.Consistency
+	17, // 3: kv.ScanResponse.kvs:type_name -> kv.KeyValue
+	1,  // 4: kv.Command.op:type_name -> kv.CommandOp
+	8,  // 5: kv.Command.ops:type_name -> kv.BatchOp
+	15, // 6: kv.Command.condition:type_name -> kv.Condition
+	2,  // 7: kv.KV.Put:input_type -> kv.PutRequest
+	4,  // 8: kv.KV.Get:input_type -> kv.GetRequest
+	6,  // 9: kv.KV.Delete:input_type -> kv.DeleteRequest
+	16, // 10: kv.KV.Scan:input_type -> kv.ScanRequest
+	9,  // 11: kv.KV.Batch:input_type -> kv.BatchRequest
+	11, // 12: kv.KV.PutIfAbsent:input_type -> kv.PutIfAbsentRequest
+	12, // 13: kv.KV.CompareAndSwap:input_type -> kv.CompareAndSwapRequest
+	13, // 14: kv.KV.CompareAndDelete:input_type -> kv.CompareAndDeleteRequest
+	19, // 15: kv.KV.Health:input_type -> kv.HealthRequest
+	3,  // 16: kv.KV.Put:output_type -> kv.PutResponse
+	5,  // 17: kv.KV.Get:output_type -> kv.GetResponse
+	7,  // 18: kv.KV.Delete:output_type -> kv.DeleteResponse
+	18, // 19: kv.KV.Scan:output_type -> kv.ScanResponse
+	10, // 20: kv.KV.Batch:output_type -> kv.BatchResponse
+	14, // 21: kv.KV.PutIfAbsent:output_type -> kv.ConditionalResponse
+	14, // 22: kv.KV.CompareAndSwap:output_type -> kv.ConditionalResponse
+	14, // 23: kv.KV.CompareAndDelete:output_type -> kv.ConditionalResponse
+	20, // 24: kv.KV.Health:output_type -> kv.HealthResponse
+	16, // [16:25] is the sub-list for method output_type
+	7,  // [7:16] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
 }
 
 func init() { file_kv_proto_init() }
@@ -461,13 +1596,14 @@ func file_kv_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_kv_proto_rawDesc), len(file_kv_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   8,
+			NumEnums:      2,
+			NumMessages:   21,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_kv_proto_goTypes,
 		DependencyIndexes: file_kv_proto_depIdxs,
+		EnumInfos:         file_kv_proto_enumTypes,
 		MessageInfos:      file_kv_proto_msgTypes,
 	}.Build()
 	File_kv_proto = out.File
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jerkeyray/mimori/internal/api/adminpb"
+	"github.com/jerkeyray/mimori/internal/cluster"
+	"github.com/jerkeyray/mimori/internal/raft"
+	"github.com/jerkeyray/mimori/internal/ranges"
+)
+
+// Rebalancer moves hash partitions onto the nodes the ring assigns them to.
+// Each range's leader changes its membership one step at a time: a missing
+// replica joins as a learner, is promoted once it has caught up, and only
+// then are the replicas the ring dropped removed, so a range never has fewer
+// copies than it should. Only the ranges whose replicas changed move. Key
+// ranges are only moved by hand, with mimorictl member.
+//
+// Nothing is moved until every node advertises the same layout, otherwise
+// nodes that haven't caught up with the latest metadata would undo each
+// other's changes.
+//
+// Replicas the routing table moved off this node, in either mode, are handed
+// to Leave and torn down once they are no longer members of their range.
+type Rebalancer struct {
+	router    *Router
+	nodes     *cluster.Cluster
+	onRemoved func(*Replica)
+	peers     *connPool
+
+	mu      sync.Mutex
+	leaving []*Replica // replicas this node keeps running until removed
+}
+
+// NewRebalancer rebalances the ranges router has replicas of. onRemoved is
+// called, from Run, once a leaving replica is no longer a member of its
+// range.
+func NewRebalancer(router *Router, nodes *cluster.Cluster, onRemoved func(*Replica)) *Rebalancer {
+	return &Rebalancer{
+		router:    router,
+		nodes:     nodes,
+		onRemoved: onRemoved,
+		peers:     newConnPool(),
+	}
+}
+
+// Leave keeps rep running, no longer serving requests, until this node has
+// been removed from its range
+func (b *Rebalancer) Leave(rep *Replica) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.leaving = append(b.leaving, rep)
+}
+
+// Reclaim takes back the leaving replica of range id, if there is one, after
+// the routing table moved the range back here
+func (b *Rebalancer) Reclaim(id uint64) *Replica {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := slices.IndexFunc(b.leaving, func(rep *Replica) bool { return rep.ID == id })
+	if i < 0 {
+		return nil
+	}
+	rep := b.leaving[i]
+	b.leaving = slices.Delete(b.leaving, i, i+1)
+	return rep
+}
+
+// Run checks every range once per interval until ctx is done
+func (b *Rebalancer) Run(ctx context.Context, interval time.Duration) {
+	defer b.peers.close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	waitingFor := ""
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		b.mu.Lock()
+		leaving := slices.Clone(b.leaving)
+		b.mu.Unlock()
+
+		switch ok, peer := b.nodes.Agreed(); {
+		case !b.hashed():
+			// key ranges only move by hand
+		case !ok:
+			if peer != waitingFor {
+				log.Printf("[rebalance] waiting for %s to be up with the same layout before moving ranges", peer)
+				waitingFor = peer
+			}
+		default:
+			waitingFor = ""
+			for _, rep := range append(b.router.Replicas(), leaving...) {
+				if desc := b.desc(rep); desc != nil && desc.Hashed && rep.Raft.IsLeader() {
+					b.step(ctx, rep, desc, interval)
+				}
+			}
+		}
+
+		for _, rep := range leaving {
+			if !b.removed(ctx, rep) {
+				continue
+			}
+			// unless the range moved back meanwhile
+			if b.Reclaim(rep.ID) == rep {
+				log.Printf("[rebalance] range %d moved off this node", rep.ID)
+				b.onRemoved(rep)
+			}
+		}
+	}
+}
+
+// hashed reports whether keys are routed to hash partitions, which are
+// placed by the ring
+func (b *Rebalancer) hashed() bool {
+	desc, _ := b.router.route(nil)
+	return desc != nil && desc.Hashed
+}
+
+// desc returns rep's range as the routing table has it now
+func (b *Rebalancer) desc(rep *Replica) *ranges.Descriptor {
+	desc, _ := b.router.replica(rep.ID)
+	return desc
+}
+
+// step makes the next membership change that brings rep's range closer to
+// its replicas in the layout, if any
+func (b *Rebalancer) step(ctx context.Context, rep *Replica, desc *ranges.Descriptor, timeout time.Duration) {
+	m := nextMove(desc.Replicas, rep.Raft.Voters(), rep.Raft.Learners(), raft.NodeID(b.nodes.SelfAddr))
+	var do func(context.Context, raft.NodeID) error
+	switch m.change {
+	case addLearner:
+		do = rep.Raft.AddLearner
+	case promote:
+		// waits for the learner to catch up
+		do = rep.Raft.AddVoter
+	case remove:
+		do = rep.Raft.RemoveNode
+	default:
+		return
+	}
+
+	log.Printf("[rebalance] %v: %s %s", desc, m.change, m.node)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := do(ctx, m.node); err != nil {
+		log.Printf("[rebalance] %v: %s %s failed, will retry: %v", desc, m.change, m.node, err)
+	}
+}
+
+// a membership change the rebalancer makes
+type change string
+
+const (
+	addLearner change = "adding learner"
+	promote    change = "promoting"
+	remove     change = "removing"
+)
+
+type move struct {
+	change change // empty when the range is where it should be
+	node   raft.NodeID
+}
+
+// nextMove picks the next change that brings a range with voters and
+// learners closer to the want replicas, led by self: adding the missing
+// ones as learners and promoting them in the order of want, then dropping
+// the rest, self last
+func nextMove(want []string, voters, learners []raft.NodeID, self raft.NodeID) move {
+	for _, addr := range want {
+		id := raft.NodeID(addr)
+		switch {
+		case !slices.Contains(voters, id) && !slices.Contains(learners, id):
+			return move{addLearner, id}
+		case slices.Contains(learners, id):
+			return move{promote, id}
+		}
+	}
+	// with every wanted replica voting, drop the rest, ourselves last
+	var m move
+	for _, id := range append(slices.Clone(learners), voters...) {
+		if !slices.Contains(want, string(id)) && (id != self || m.change == "") {
+			m = move{remove, id}
+		}
+	}
+	return m
+}
+
+// removed reports whether this node is out of a leaving replica's range. A
+// removed follower hears nothing more from the leader, so the range's new
+// replicas are asked.
+func (b *Rebalancer) removed(ctx context.Context, rep *Replica) bool {
+	self := raft.NodeID(b.nodes.SelfAddr)
+	if rep.Raft.IsLeader() {
+		return false
+	}
+	// a leader that removed itself knows
+	if !slices.Contains(rep.Raft.Voters(), self) && !slices.Contains(rep.Raft.Learners(), self) {
+		return true
+	}
+
+	desc := b.desc(rep)
+	if desc == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	targets := slices.Clone(desc.Replicas)
+	for i := 0; i < len(targets); i++ {
+		conn, err := b.peers.get(targets[i])
+		if err != nil {
+			continue
+		}
+		resp, err := adminpb.NewAdminClient(conn).ListMembers(ctx, &adminpb.ListMembersRequest{RangeId: rep.ID})
+		if leader, ok := leaderFromError(err); ok && leader != "" && !slices.Contains(targets, leader) {
+			targets = append(targets, leader)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, m := range resp.Members {
+			if m.Id == string(self) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/jerkeyray/mimori/internal/raft"
+	"github.com/jerkeyray/mimori/internal/ranges"
+)
+
+func ids(addrs ...string) []raft.NodeID {
+	out := make([]raft.NodeID, len(addrs))
+	for i, a := range addrs {
+		out[i] = raft.NodeID(a)
+	}
+	return out
+}
+
+func TestNextMove(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		want     []string
+		voters   []raft.NodeID
+		learners []raft.NodeID
+		self     raft.NodeID
+		move     move
+	}{
+		{"balanced", []string{"a", "b", "c"}, ids("c", "a", "b"), nil, "a", move{}},
+		{"missing replica", []string{"a", "b", "d"}, ids("a", "b", "c"), nil, "a", move{addLearner, "d"}},
+		{"caught up learner", []string{"a", "b", "d"}, ids("a", "b", "c"), ids("d"), "a", move{promote, "d"}},
+		{"extra voter", []string{"a", "b", "d"}, ids("a", "b", "c", "d"), nil, "a", move{remove, "c"}},
+		{"extra learner", []string{"a", "b"}, ids("a", "b"), ids("c"), "a", move{remove, "c"}},
+		{"leader leaves last", []string{"b", "c", "d"}, ids("a", "b", "c", "d", "e"), nil, "a", move{remove, "e"}},
+		{"leader leaves", []string{"b", "c", "d"}, ids("a", "b", "c", "d"), nil, "a", move{remove, "a"}},
+	} {
+		if got := nextMove(tc.want, tc.voters, tc.learners, tc.self); got != tc.move {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.move, got)
+		}
+	}
+}
+
+// rebalance plays nextMove on every range of from until it is placed as in
+// to, and returns the moves made per range
+func rebalance(t *testing.T, from, to ranges.Layout) map[uint64][]move {
+	t.Helper()
+	moves := make(map[uint64][]move)
+	for _, desc := range to.Ranges() {
+		voters, learners := ids(from.Get(desc.ID).Replicas...), []raft.NodeID(nil)
+		for {
+			// the first voter leads, whoever that is
+			m := nextMove(desc.Replicas, voters, learners, voters[0])
+			if m.change == "" {
+				break
+			}
+			moves[desc.ID] = append(moves[desc.ID], m)
+			if len(moves[desc.ID]) > 10 {
+				t.Fatalf("range %d never settles: %v", desc.ID, moves[desc.ID])
+			}
+			switch m.change {
+			case addLearner:
+				learners = append(learners, m.node)
+			case promote:
+				learners = slices.DeleteFunc(learners, func(id raft.NodeID) bool { return id == m.node })
+				voters = append(voters, m.node)
+			case remove:
+				learners = slices.DeleteFunc(learners, func(id raft.NodeID) bool { return id == m.node })
+				voters = slices.DeleteFunc(voters, func(id raft.NodeID) bool { return id == m.node })
+			}
+			if len(voters) < len(desc.Replicas) {
+				t.Fatalf("range %d down to voters %v on its way to %v", desc.ID, voters, desc.Replicas)
+			}
+		}
+		slices.Sort(voters)
+		if want := ids(desc.Replicas...); !slices.Equal(voters, slices.Sorted(slices.Values(want))) || len(learners) > 0 {
+			t.Fatalf("range %d ended up on %v and learners %v, expected %v", desc.ID, voters, learners, want)
+		}
+	}
+	return moves
+}
+
+func TestRebalanceMoves(t *testing.T) {
+	newRing := func(nodes ...string) *ranges.Ring {
+		r, err := ranges.NewRing(nodes, 16, 3, 32)
+		if err != nil {
+			t.Fatalf("new ring failed: %v", err)
+		}
+		return r
+	}
+	before := newRing("a:1", "b:1", "c:1", "d:1")
+
+	// nothing moves while the layout is what the ranges already have
+	if moves := rebalance(t, before, before); len(moves) != 0 {
+		t.Fatalf("expected no moves for a balanced layout, got %v", moves)
+	}
+
+	// a node joins: only the partitions the ring gives it move, each
+	// gaining it and losing one other replica
+	after := newRing("a:1", "b:1", "c:1", "d:1", "e:1")
+	moves := rebalance(t, before, after)
+	if len(moves) == 0 {
+		t.Fatalf("expected some partitions to move to the new node")
+	}
+	for _, desc := range after.Ranges() {
+		got, moved := moves[desc.ID]
+		was := slices.Sorted(slices.Values(before.Get(desc.ID).Replicas))
+		if changed := !slices.Equal(was, slices.Sorted(slices.Values(desc.Replicas))); changed != moved {
+			t.Fatalf("range %d: replicas changed %v, but moves %v", desc.ID, changed, got)
+		}
+		if !moved {
+			continue
+		}
+		if len(got) != 3 || got[0] != (move{addLearner, "e:1"}) || got[1] != (move{promote, "e:1"}) || got[2].change != remove {
+			t.Fatalf("range %d: expected e:1 added, promoted and another replica removed, got %v", desc.ID, got)
+		}
+	}
+
+	// and leaving again moves them back
+	back := rebalance(t, after, before)
+	for id := range moves {
+		if len(back[id]) == 0 {
+			t.Fatalf("range %d did not move back", id)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"github.com/jerkeyray/mimori/internal/raft"
+	"github.com/jerkeyray/mimori/internal/ranges"
+	"github.com/jerkeyray/mimori/internal/storage"
+)
+
+// Replica is a range hosted on this node: its raft group and the store the
+// group applies to
+type Replica struct {
+	ID    uint64 // the range id
+	Store storage.KV
+	Raft  *raft.Raft
+}
+
+// Router finds the range holding a key, and the local replica of it if this
+// node hosts one. Both change as the cluster metadata does.
+type Router struct {
+	mu       sync.RWMutex
+	layout   ranges.Layout // nil until the routing table is known
+	replicas map[uint64]*Replica
+}
+
+func NewRouter() *Router {
+	return &Router{replicas: make(map[uint64]*Replica)}
+}
+
+// SetLayout routes keys by layout from now on
+func (rt *Router) SetLayout(layout ranges.Layout) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.layout = layout
+}
+
+// Layout returns the layout keys are routed by, nil if not known yet
+func (rt *Router) Layout() ranges.Layout {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.layout
+}
+
+// Add starts serving requests for rep's range from rep
+func (rt *Router) Add(rep *Replica) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.replicas[rep.ID] = rep
+}
+
+// Remove stops serving range id locally, requests for it are routed to
+// other nodes
+func (rt *Router) Remove(id uint64) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	delete(rt.replicas, id)
+}
+
+// Replicas returns the replicas serving requests here, by range id
+func (rt *Router) Replicas() []*Replica {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	out := make([]*Replica, 0, len(rt.replicas))
+	for _, rep := range rt.replicas {
+		out = append(out, rep)
+	}
+	slices.SortFunc(out, func(a, b *Replica) int { return cmp.Compare(a.ID, b.ID) })
+	return out
+}
+
+// route returns the range holding key, and our replica of it or nil. The
+// range is nil too while the routing table isn't known.
+func (rt *Router) route(key []byte) (*ranges.Descriptor, *Replica) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if rt.layout == nil {
+		return nil, nil
+	}
+	desc := rt.layout.Lookup(key)
+	return desc, rt.replicas[desc.ID]
+}
+
+// replica returns our replica of range id, 0 meaning the first range, and
+// the range itself, which is nil if the id is unknown
+func (rt *Router) replica(id uint64) (*ranges.Descriptor, *Replica) {
+	if id == 0 {
+		return rt.route(nil)
+	}
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if rt.layout == nil {
+		return nil, nil
+	}
+	return rt.layout.Get(id), rt.replicas[id]
+}
@@ -0,0 +1,364 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/ranges"
+	"github.com/jerkeyray/mimori/internal/storage"
+)
+
+const (
+	// pairs read from a range at a time
+	scanBatch = 256
+	// pairs sent to the client per message
+	scanChunk = 100
+)
+
+// Scan reads the pairs of every range overlapping the request, in key
+// order. Ranges split by key are read one after the other, hash partitions
+// hold keys from all over the keyspace so they are read side by side and
+// merged.
+func (s *Server) Scan(req *kv.ScanRequest, stream grpc.ServerStreamingServer[kv.ScanResponse]) error {
+	if req.RangeId != 0 {
+		return s.scanReplica(req, stream)
+	}
+	layout := s.router.Layout()
+	if layout == nil {
+		return status.Error(codes.Unavailable, "routing table not known yet, retry shortly")
+	}
+
+	start, end := storage.ScanOptions{Start: req.Start, End: nilIfEmpty(req.End), Prefix: req.Prefix}.Bounds()
+	// the page token is the first key of the page in key order, and the
+	// first key past it when reversed, either way inside the scan's bounds
+	if token := req.PageToken; len(token) > 0 {
+		below, above := bytes.Compare(token, start), 1
+		if end != nil {
+			above = bytes.Compare(end, token)
+		}
+		switch {
+		case !req.Reverse && below >= 0 && above > 0:
+			start = token
+		case req.Reverse && below > 0 && above >= 0:
+			end = token
+		default:
+			return status.Errorf(codes.InvalidArgument, "page token %q is not from a scan of the same keys", token)
+		}
+	}
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return nil
+	}
+
+	batch := scanBatch
+	if req.Limit > 0 && int(req.Limit) < batch {
+		// one more to tell whether there is a next page
+		batch = int(req.Limit) + 1
+	}
+	descs := layout.Ranges()
+	var parts []scanner
+	for _, desc := range descs {
+		lo, hi, ok := start, end, true
+		if !desc.Hashed {
+			lo, hi, ok = clip(start, end, desc)
+		}
+		if ok {
+			parts = append(parts, &rangeScan{s: s, desc: desc, req: req, start: lo, end: hi, batch: batch})
+		}
+	}
+	if req.AsOfRevision != 0 && len(parts) > 1 {
+		return status.Error(codes.InvalidArgument, "every range counts its own revisions, scan as of a time across ranges instead")
+	}
+	var src scanner
+	if descs[0].Hashed {
+		src = &mergeScan{parts: parts, reverse: req.Reverse}
+	} else {
+		if req.Reverse {
+			slices.Reverse(parts)
+		}
+		src = &chainScan{parts: parts}
+	}
+
+	ctx := stream.Context()
+	var out []*kv.KeyValue
+	sent := 0
+	for {
+		pair, err := src.peek(ctx)
+		if err != nil {
+			return err
+		}
+		if pair == nil {
+			break
+		}
+		if req.Limit > 0 && sent == int(req.Limit) {
+			token := pair.Key
+			if req.Reverse {
+				token = append(bytes.Clone(pair.Key), 0)
+			}
+			return stream.Send(&kv.ScanResponse{Kvs: out, NextPageToken: token})
+		}
+		src.pop()
+		out = append(out, pair)
+		sent++
+		if len(out) == scanChunk {
+			if err := stream.Send(&kv.ScanResponse{Kvs: out}); err != nil {
+				return err
+			}
+			out = nil
+		}
+	}
+	if len(out) > 0 {
+		return stream.Send(&kv.ScanResponse{Kvs: out})
+	}
+	return nil
+}
+
+// scanReplica serves another node's read of one range hosted here
+func (s *Server) scanReplica(req *kv.ScanRequest, stream grpc.ServerStreamingServer[kv.ScanResponse]) error {
+	desc, rep := s.router.replica(req.RangeId)
+	switch {
+	case desc == nil:
+		return status.Errorf(codes.NotFound, "no range %d", req.RangeId)
+	case rep == nil:
+		return notHostedError(desc)
+	case req.Consistency != kv.Consistency_STALE && !rep.Raft.IsLeader():
+		return notLeaderError(string(rep.Raft.Leader()))
+	}
+	pairs, err := s.scanLocal(stream.Context(), rep, req)
+	if err != nil {
+		return err
+	}
+	for len(pairs) > 0 {
+		n := min(len(pairs), scanChunk)
+		if err := stream.Send(&kv.ScanResponse{Kvs: pairs[:n]}); err != nil {
+			return err
+		}
+		pairs = pairs[n:]
+	}
+	return nil
+}
+
+// scanLocal reads up to req.Limit pairs from our replica of a range
+func (s *Server) scanLocal(ctx context.Context, rep *Replica, req *kv.ScanRequest) ([]*kv.KeyValue, error) {
+	if req.Consistency != kv.Consistency_STALE {
+		if err := s.readBarrier(ctx, rep, req.Consistency); err != nil {
+			return nil, err
+		}
+	}
+	rev, ok, err := readRevision(rep.Store, req.AsOfRevision, req.AsOfTime)
+	if err != nil || !ok {
+		return nil, err
+	}
+	it, err := rep.Store.Scan(storage.ScanOptions{
+		Start:    req.Start,
+		End:      nilIfEmpty(req.End),
+		Prefix:   req.Prefix,
+		Reverse:  req.Reverse,
+		Limit:    int(req.Limit),
+		Revision: rev,
+	})
+	if err != nil {
+		return nil, storageError(err)
+	}
+	defer it.Close()
+	var pairs []*kv.KeyValue
+	for it.Next() {
+		pairs = append(pairs, &kv.KeyValue{Key: bytes.Clone(it.Key()), Value: bytes.Clone(it.Value())})
+	}
+	return pairs, it.Err()
+}
+
+// scanRange reads up to req.Limit pairs from range desc, from our replica
+// when it can serve the read and from another node's otherwise
+func (s *Server) scanRange(ctx context.Context, desc *ranges.Descriptor, req *kv.ScanRequest) ([]*kv.KeyValue, error) {
+	stale := req.Consistency == kv.Consistency_STALE
+	_, rep := s.router.replica(desc.ID)
+	if rep != nil && (stale || rep.Raft.IsLeader()) {
+		return s.scanLocal(ctx, rep, req)
+	}
+
+	addrs := s.nearestFirst(desc.Replicas)
+	if rep != nil && !stale {
+		if lead := rep.Raft.Leader(); lead != "" {
+			addrs = append([]string{string(lead)}, addrs...)
+		}
+	}
+	req.RangeId = desc.ID
+	err := status.Errorf(codes.Unavailable, "no replica of range %d reachable", desc.ID)
+	tried := make(map[string]bool)
+	for len(addrs) > 0 {
+		addr := addrs[0]
+		addrs = addrs[1:]
+		if tried[addr] {
+			continue
+		}
+		tried[addr] = true
+
+		var pairs []*kv.KeyValue
+		if pairs, err = s.scanRemote(ctx, addr, req); err == nil {
+			return pairs, nil
+		}
+		lead, notLeader := leaderFromError(err)
+		if lead != "" {
+			addrs = append([]string{lead}, addrs...)
+		}
+		if !notLeader && status.Code(err) != codes.Unavailable {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (s *Server) scanRemote(ctx context.Context, addr string, req *kv.ScanRequest) ([]*kv.KeyValue, error) {
+	conn, err := s.peers.get(addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := kv.NewKVClient(conn).Scan(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []*kv.KeyValue
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return pairs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, resp.Kvs...)
+	}
+}
+
+// clip narrows start and end down to the keys of a range split by key,
+// false if none of them are in it
+func clip(start, end []byte, desc *ranges.Descriptor) ([]byte, []byte, bool) {
+	if bytes.Compare(desc.StartKey, start) > 0 {
+		start = desc.StartKey
+	}
+	if desc.EndKey != nil && (end == nil || bytes.Compare(desc.EndKey, end) < 0) {
+		end = desc.EndKey
+	}
+	return start, end, end == nil || bytes.Compare(start, end) < 0
+}
+
+func nilIfEmpty(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// scanner yields the pairs of a scan one at a time, peek returns nil once
+// there are none left
+type scanner interface {
+	peek(ctx context.Context) (*kv.KeyValue, error)
+	pop()
+}
+
+// rangeScan reads one range's share of a scan, a batch at a time
+type rangeScan struct {
+	s          *Server
+	desc       *ranges.Descriptor
+	req        *kv.ScanRequest
+	start, end []byte // what's left to read
+	batch      int
+	buf        []*kv.KeyValue
+	done       bool
+}
+
+func (r *rangeScan) peek(ctx context.Context) (*kv.KeyValue, error) {
+	if len(r.buf) == 0 && !r.done {
+		pairs, err := r.s.scanRange(ctx, r.desc, &kv.ScanRequest{
+			Start:        r.start,
+			End:          r.end,
+			Reverse:      r.req.Reverse,
+			Limit:        uint32(r.batch),
+			Consistency:  r.req.Consistency,
+			AsOfRevision: r.req.AsOfRevision,
+			AsOfTime:     r.req.AsOfTime,
+		})
+		if err != nil {
+			return nil, err
+		}
+		r.buf = pairs
+		if len(pairs) < r.batch {
+			r.done = true
+		} else if last := pairs[len(pairs)-1].Key; r.req.Reverse {
+			// an empty end would mean no bound at all, but nothing is below
+			// the empty key anyway
+			r.end, r.done = last, len(last) == 0
+		} else {
+			r.start = append(bytes.Clone(last), 0)
+		}
+	}
+	if len(r.buf) == 0 {
+		return nil, nil
+	}
+	return r.buf[0], nil
+}
+
+func (r *rangeScan) pop() {
+	r.buf = r.buf[1:]
+}
+
+// chainScan reads ranges split by key one after the other
+type chainScan struct {
+	parts []scanner
+}
+
+func (c *chainScan) peek(ctx context.Context) (*kv.KeyValue, error) {
+	for len(c.parts) > 0 {
+		pair, err := c.parts[0].peek(ctx)
+		if err != nil || pair != nil {
+			return pair, err
+		}
+		c.parts = c.parts[1:]
+	}
+	return nil, nil
+}
+
+func (c *chainScan) pop() {
+	c.parts[0].pop()
+}
+
+// mergeScan reads hash partitions side by side, always yielding the
+// smallest key next, or the largest when reversed
+type mergeScan struct {
+	parts   []scanner
+	reverse bool
+	next    scanner // the part holding the pair last peeked at
+}
+
+func (m *mergeScan) peek(ctx context.Context) (*kv.KeyValue, error) {
+	var best *kv.KeyValue
+	m.next = nil
+	for _, p := range m.parts {
+		pair, err := p.peek(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if pair == nil {
+			continue
+		}
+		if best == nil {
+			best, m.next = pair, p
+			continue
+		}
+		if c := bytes.Compare(pair.Key, best.Key); (!m.reverse && c < 0) || (m.reverse && c > 0) {
+			best, m.next = pair, p
+		}
+	}
+	return best, nil
+}
+
+func (m *mergeScan) pop() {
+	m.next.pop()
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/ranges"
+)
+
+// ring hashes keys over the given number of partitions, each on every node
+func ring(partitions int) func(addrs []string) ranges.Layout {
+	return func(addrs []string) ranges.Layout {
+		r, err := ranges.NewRing(addrs, 8, len(addrs), partitions)
+		if err != nil {
+			panic(err)
+		}
+		return r
+	}
+}
+
+// writeKeys puts n keys named k00, k01, ... and returns them in order
+func writeKeys(c *testCluster, n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%02d", i)
+		c.put(keys[i], keys[i])
+	}
+	return keys
+}
+
+// checkPages fails unless pages hold want in order, limit at a time
+func checkPages(t *testing.T, pages [][]string, want []string, limit int) {
+	t.Helper()
+	var got []string
+	for i, page := range pages {
+		if len(page) != limit && i != len(pages)-1 {
+			t.Fatalf("page %d holds %d pairs, expected %d: %v", i, len(page), limit, pages)
+		}
+		got = append(got, page...)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got pages %v", want, pages)
+	}
+}
+
+func TestScanPagesAcrossRanges(t *testing.T) {
+	// the second page starts in the first range and ends in the second
+	c := newTestCluster(t, 3, Options{ForwardToLeader: true}, table("k05"))
+	keys := writeKeys(c, 10)
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+
+	for _, addr := range c.addrs {
+		pages, err := c.scan(addr, &kv.ScanRequest{Limit: 3})
+		if err != nil {
+			t.Fatalf("scan from %s failed: %v", addr, err)
+		}
+		checkPages(t, pages, keys, 3)
+		if len(pages) != 4 {
+			t.Fatalf("expected 4 pages of 10 keys, got %v", pages)
+		}
+
+		pages, err = c.scan(addr, &kv.ScanRequest{Limit: 3, Reverse: true})
+		if err != nil {
+			t.Fatalf("reverse scan from %s failed: %v", addr, err)
+		}
+		checkPages(t, pages, reversed, 3)
+	}
+
+	// bounds hold across the boundary too
+	pages, err := c.scan(c.addrs[0], &kv.ScanRequest{Start: []byte("k03"), End: []byte("k08"), Limit: 2, Reverse: true})
+	if err != nil {
+		t.Fatalf("bounded scan failed: %v", err)
+	}
+	checkPages(t, pages, []string{"k07", "k06", "k05", "k04", "k03"}, 2)
+}
+
+func TestScanMergesHashPartitions(t *testing.T) {
+	c := newTestCluster(t, 3, Options{ForwardToLeader: true}, ring(4))
+	keys := writeKeys(c, 20)
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+
+	// keys are spread over the partitions but come back in key order
+	spread := make(map[uint64]bool)
+	for _, k := range keys {
+		spread[c.layout.Lookup([]byte(k)).ID] = true
+	}
+	if len(spread) < 2 {
+		t.Fatalf("expected the keys to land in several partitions, got %v", spread)
+	}
+
+	pages, err := c.scan(c.addrs[0], &kv.ScanRequest{})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	checkPages(t, pages, keys, len(keys))
+
+	pages, err = c.scan(c.addrs[1], &kv.ScanRequest{Limit: 6})
+	if err != nil {
+		t.Fatalf("paged scan failed: %v", err)
+	}
+	checkPages(t, pages, keys, 6)
+
+	pages, err = c.scan(c.addrs[2], &kv.ScanRequest{Limit: 7, Reverse: true})
+	if err != nil {
+		t.Fatalf("reverse scan failed: %v", err)
+	}
+	checkPages(t, pages, reversed, 7)
+
+	pages, err = c.scan(c.addrs[0], &kv.ScanRequest{Prefix: []byte("k1"), Limit: 4})
+	if err != nil {
+		t.Fatalf("prefix scan failed: %v", err)
+	}
+	checkPages(t, pages, keys[10:], 4)
+}
+
+func TestScanLimit(t *testing.T) {
+	c := newTestCluster(t, 1, Options{}, table("k05"))
+	keys := writeKeys(c, 10)
+
+	for _, tc := range []struct {
+		limit uint32
+		pages int
+	}{
+		{0, 1},  // everything at once
+		{1, 10}, // a page per key
+		{5, 2},  // the last page ends the scan, with no token
+		{10, 1},
+		{50, 1},
+	} {
+		pages, err := c.scan(c.addrs[0], &kv.ScanRequest{Limit: tc.limit})
+		if err != nil {
+			t.Fatalf("scan with limit %d failed: %v", tc.limit, err)
+		}
+		if len(pages) != tc.pages {
+			t.Fatalf("expected %d pages with limit %d, got %v", tc.pages, tc.limit, pages)
+		}
+		checkPages(t, pages, keys, max(int(tc.limit), len(keys)/tc.pages))
+	}
+}
+
+func TestScanRejectsMalformedTokens(t *testing.T) {
+	c := newTestCluster(t, 1, Options{}, table("k05"))
+	writeKeys(c, 10)
+
+	for _, req := range []*kv.ScanRequest{
+		// tokens from outside the keys scanned
+		{Start: []byte("k03"), PageToken: []byte("k01")},
+		{End: []byte("k05"), PageToken: []byte("k07")},
+		{End: []byte("k05"), PageToken: []byte("k05")},
+		{Prefix: []byte("k0"), PageToken: []byte("z")},
+		{Start: []byte("k03"), Reverse: true, PageToken: []byte("k03")},
+		{End: []byte("k05"), Reverse: true, PageToken: []byte("k06")},
+	} {
+		if _, err := c.scan(c.addrs[0], req); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expected InvalidArgument for %v, got %v", req, err)
+		}
+	}
+
+	// the last key in the bounds is a fine place to resume
+	pages, err := c.scan(c.addrs[0], &kv.ScanRequest{End: []byte("k05"), PageToken: []byte("k04")})
+	if err != nil {
+		t.Fatalf("scan from a token failed: %v", err)
+	}
+	checkPages(t, pages, []string{"k04"}, 1)
+}
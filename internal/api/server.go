@@ -2,62 +2,322 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
+	"github.com/jerkeyray/mimori/internal/api/adminpb"
 	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/cluster"
+	"github.com/jerkeyray/mimori/internal/meta"
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
+	"github.com/jerkeyray/mimori/internal/raft"
 	"github.com/jerkeyray/mimori/internal/raft/raftpb"
 	"github.com/jerkeyray/mimori/internal/storage"
 )
 
+// Options tunes how a node serves requests
+type Options struct {
+	// ForwardToLeader makes followers pass writes and non-stale reads on to
+	// the leader. When false, or when no leader is known, followers reject
+	// them with a NOT_LEADER error naming the leader instead.
+	ForwardToLeader bool
+
+	// HotKeySampleRate makes one request in this many count towards the
+	// busiest keys reported by TopKeys, 0 turns tracking off
+	HotKeySampleRate int
+
+	// HotKeyPrefixDelimiters lists the characters that end a key prefix, with
+	// ":" the key user:42:name counts towards the prefix user:
+	HotKeyPrefixDelimiters string
+
+	// Cluster knows where this node and its peers are, /healthz advertises
+	// our locality and requests passed to another range are sent to the
+	// nearest replica first. May be nil.
+	Cluster *cluster.Cluster
+
+	// Meta serves the cluster metadata, and records the replicas of ranges
+	// whose membership is changed through the admin service. May be nil.
+	Meta *meta.Server
+}
+
 // gRPC service implementation
 type Server struct {
 	kv.UnimplementedKVServer
-	store storage.KV // pebble wrapper
+	router *Router // finds the range, and our replica of it, for each key
+	opts   Options
+	peers  *connPool // connections used to forward to other nodes
+	hot    *HotKeys  // busiest keys among requests served here, nil if off
 }
 
-func NewServer(store storage.KV) *Server {
-	return &Server{store: store}
+func NewServer(router *Router, opts Options) *Server {
+	return &Server{
+		router: router,
+		opts:   opts,
+		peers:  newConnPool(),
+		hot:    NewHotKeys(opts.HotKeySampleRate, opts.HotKeyPrefixDelimiters),
+	}
 }
 
 // gRPC method implementations
 
 func (s *Server) Put(ctx context.Context, req *kv.PutRequest) (*kv.PutResponse, error) {
-	err := s.store.Put(req.Key, req.Value)
+	rep, h, err := s.replicaFor(ctx, req.Key, true)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		return forward(ctx, s, h, func(ctx context.Context, c kv.KVClient) (*kv.PutResponse, error) {
+			return c.Put(ctx, req)
+		})
+	}
+	s.hot.Record(req.Key, true, len(req.Key)+len(req.Value))
+
+	cmd := &kv.Command{Op: kv.CommandOp_OP_PUT, Key: req.Key, Value: req.Value}
+	if req.ExpectedModRevision != 0 {
+		cmd.Condition = &kv.Condition{ModRevision: req.ExpectedModRevision}
+	}
+	res, err := s.propose(ctx, rep, cmd)
 	if err != nil {
 		return &kv.PutResponse{Ok: false}, err
 	}
-	return &kv.PutResponse{Ok: true}, nil
+	if failed, ok := res.(*storage.ConditionFailedError); ok {
+		return putResponse(false, failed.Meta), nil
+	}
+	return putResponse(true, res.(storage.KeyMeta)), nil
+}
+
+func putResponse(ok bool, m storage.KeyMeta) *kv.PutResponse {
+	return &kv.PutResponse{Ok: ok, CreateRevision: m.CreateRevision, ModRevision: m.ModRevision, Version: m.Version}
 }
 
 func (s *Server) Get(ctx context.Context, req *kv.GetRequest) (*kv.GetResponse, error) {
-	val, found, err := s.store.Get(req.Key)
+	// stale reads are served by any replica of the range
+	rep, h, err := s.replicaFor(ctx, req.Key, req.Consistency != kv.Consistency_STALE)
 	if err != nil {
 		return nil, err
 	}
-	return &kv.GetResponse{Value: val, Found: found}, nil
+	if h != nil {
+		return forward(ctx, s, h, func(ctx context.Context, c kv.KVClient) (*kv.GetResponse, error) {
+			return c.Get(ctx, req)
+		})
+	}
+
+	if req.Consistency != kv.Consistency_STALE {
+		if err := s.readBarrier(ctx, rep, req.Consistency); err != nil {
+			return nil, err
+		}
+	}
+
+	rev, ok, err := readRevision(rep.Store, req.AsOfRevision, req.AsOfTime)
+	if err != nil || !ok {
+		return &kv.GetResponse{}, err
+	}
+	val, meta, found, err := rep.Store.GetAt(req.Key, rev)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	s.hot.Record(req.Key, false, len(req.Key)+len(val))
+	return &kv.GetResponse{
+		Value:          val,
+		Found:          found,
+		CreateRevision: meta.CreateRevision,
+		ModRevision:    meta.ModRevision,
+		Version:        meta.Version,
+	}, nil
 }
 
 func (s *Server) Delete(ctx context.Context, req *kv.DeleteRequest) (*kv.DeleteResponse, error) {
-	err := s.store.Delete(req.Key)
+	rep, h, err := s.replicaFor(ctx, req.Key, true)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		return forward(ctx, s, h, func(ctx context.Context, c kv.KVClient) (*kv.DeleteResponse, error) {
+			return c.Delete(ctx, req)
+		})
+	}
+	s.hot.Record(req.Key, true, len(req.Key))
+
+	_, err = s.propose(ctx, rep, &kv.Command{Op: kv.CommandOp_OP_DELETE, Key: req.Key})
 	if err != nil {
 		return nil, err
 	}
 	return &kv.DeleteResponse{Deleted: true}, nil
 }
 
+func (s *Server) Batch(ctx context.Context, req *kv.BatchRequest) (*kv.BatchResponse, error) {
+	if len(req.Ops) == 0 {
+		return &kv.BatchResponse{Ok: true}, nil
+	}
+	// a batch is one raft entry, so it can only go to one range
+	first, _ := s.router.route(req.Ops[0].Key)
+	for _, op := range req.Ops[1:] {
+		if desc, _ := s.router.route(op.Key); desc != nil && first != nil && desc.ID != first.ID {
+			return nil, status.Errorf(codes.InvalidArgument, "batch spans ranges: %q is in range %d but %q is in range %d",
+				req.Ops[0].Key, first.ID, op.Key, desc.ID)
+		}
+	}
+
+	rep, h, err := s.replicaFor(ctx, req.Ops[0].Key, true)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		return forward(ctx, s, h, func(ctx context.Context, c kv.KVClient) (*kv.BatchResponse, error) {
+			return c.Batch(ctx, req)
+		})
+	}
+	for _, op := range req.Ops {
+		s.hot.Record(op.Key, true, len(op.Key)+len(op.Value))
+	}
+
+	_, err = s.propose(ctx, rep, &kv.Command{Op: kv.CommandOp_OP_BATCH, Ops: req.Ops})
+	if err != nil {
+		return nil, err
+	}
+	return &kv.BatchResponse{Ok: true}, nil
+}
+
+func (s *Server) PutIfAbsent(ctx context.Context, req *kv.PutIfAbsentRequest) (*kv.ConditionalResponse, error) {
+	cmd := &kv.Command{Op: kv.CommandOp_OP_PUT, Key: req.Key, Value: req.Value, Condition: &kv.Condition{Absent: true}}
+	return s.conditional(ctx, cmd, func(ctx context.Context, c kv.KVClient) (*kv.ConditionalResponse, error) {
+		return c.PutIfAbsent(ctx, req)
+	})
+}
+
+func (s *Server) CompareAndSwap(ctx context.Context, req *kv.CompareAndSwapRequest) (*kv.ConditionalResponse, error) {
+	cmd := &kv.Command{Op: kv.CommandOp_OP_PUT, Key: req.Key, Value: req.Value, Condition: &kv.Condition{Value: req.Expected}}
+	return s.conditional(ctx, cmd, func(ctx context.Context, c kv.KVClient) (*kv.ConditionalResponse, error) {
+		return c.CompareAndSwap(ctx, req)
+	})
+}
+
+func (s *Server) CompareAndDelete(ctx context.Context, req *kv.CompareAndDeleteRequest) (*kv.ConditionalResponse, error) {
+	cmd := &kv.Command{Op: kv.CommandOp_OP_DELETE, Key: req.Key, Condition: &kv.Condition{Value: req.Expected}}
+	return s.conditional(ctx, cmd, func(ctx context.Context, c kv.KVClient) (*kv.ConditionalResponse, error) {
+		return c.CompareAndDelete(ctx, req)
+	})
+}
+
+// conditional proposes a write carrying a condition on the leader of its
+// key's range, which checks the condition as the write is applied so no
+// other write to the key can slip in between
+func (s *Server) conditional(ctx context.Context, cmd *kv.Command, call func(context.Context, kv.KVClient) (*kv.ConditionalResponse, error)) (*kv.ConditionalResponse, error) {
+	rep, h, err := s.replicaFor(ctx, cmd.Key, true)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		return forward(ctx, s, h, call)
+	}
+	s.hot.Record(cmd.Key, true, len(cmd.Key)+len(cmd.Value))
+
+	res, err := s.propose(ctx, rep, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if failed, ok := res.(*storage.ConditionFailedError); ok {
+		return &kv.ConditionalResponse{CurrentValue: failed.Value, CurrentFound: failed.Found, CurrentModRevision: failed.Meta.ModRevision}, nil
+	}
+	return &kv.ConditionalResponse{Succeeded: true}, nil
+}
+
 func (s *Server) Health(ctx context.Context, _ *kv.HealthRequest) (*kv.HealthResponse, error) {
 	return &kv.HealthResponse{Status: "ok"}, nil
 }
 
-// server launcher
-func ListenAndServe(addr string, store storage.KV, raftNode raftpb.RaftServer) error {
+// readBarrier waits until a local read is guaranteed to see every write
+// acknowledged before it was called
+func (s *Server) readBarrier(ctx context.Context, rep *Replica, c kv.Consistency) error {
+	var index uint64
+	var err error
+	if c == kv.Consistency_LEASE {
+		index, err = rep.Raft.LeaseReadIndex(ctx)
+	} else {
+		index, err = rep.Raft.ReadIndex(ctx)
+	}
+	if err == nil {
+		err = rep.Raft.WaitApplied(ctx, index)
+	}
+	return raftError(rep, err)
+}
+
+// readRevision returns the revision a read as of asOfRev or asOfTime, unix
+// nanoseconds, goes to on store, 0 for the latest when neither is set. It is
+// false when nothing had been written by then.
+func readRevision(store storage.KV, asOfRev uint64, asOfTime int64) (uint64, bool, error) {
+	if asOfTime == 0 {
+		return asOfRev, true, nil
+	}
+	if asOfRev != 0 {
+		return 0, false, status.Error(codes.InvalidArgument, "read as of a revision or a time, not both")
+	}
+	rev, ok, err := store.RevisionAt(time.Unix(0, asOfTime))
+	if err != nil {
+		return 0, false, storageError(err)
+	}
+	return rev, ok, nil
+}
+
+// storageError maps a read as of a compacted revision onto OutOfRange
+func storageError(err error) error {
+	if errors.Is(err, storage.ErrCompacted) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	return err
+}
+
+// propose replicates cmd through the range's raft group and waits until it
+// has been applied locally, returning what the state machine made of it.
+// Writes are stamped with this node's clock for reads as of a time.
+func (s *Server) propose(ctx context.Context, rep *Replica, cmd *kv.Command) (interface{}, error) {
+	cmd.Timestamp = time.Now().UnixNano()
+	data, err := proto.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	res, err := rep.Raft.Propose(ctx, data)
+	return res, raftError(rep, err)
+}
+
+// raftError maps raft errors onto gRPC status errors
+func raftError(rep *Replica, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, raft.ErrNotLeader):
+		// lost leadership since the caller checked
+		return notLeaderError(string(rep.Raft.Leader()))
+	case errors.Is(err, raft.ErrProposalDropped):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, raft.ErrStopped):
+		return status.Error(codes.Unavailable, "node is shutting down")
+	case errors.Is(err, raft.ErrTransferInProgress):
+		return status.Error(codes.Unavailable, "leadership transfer in progress, retry shortly")
+	default:
+		return status.FromContextError(err).Err()
+	}
+}
+
+// in-flight requests get this long to finish on shutdown before their
+// connections are cut
+const shutdownTimeout = 10 * time.Second
+
+// server launcher, serves until ctx is cancelled and then shuts down
+// gracefully, returning once every in-flight request is done
+func ListenAndServe(ctx context.Context, addr string, router *Router, raftMux *raft.Mux, opts Options) error {
 	// listen on the main gRPC address
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -66,28 +326,76 @@ func ListenAndServe(addr string, store storage.KV, raftNode raftpb.RaftServer) e
 
 	// HTTP health endpoint
 	// if node listens on :4000, HTTP health runs on :4001
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if opts.Cluster != nil && !opts.Cluster.SelfLocality.IsZero() {
+			w.Header().Set(cluster.LocalityHeader, opts.Cluster.SelfLocality.String())
+		}
+		if opts.Cluster != nil {
+			w.Header().Set(cluster.LayoutHeader, opts.Cluster.SelfLayout())
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", parsePort(addr)+1), Handler: mux}
 	go func() {
-		httpPort := parsePort(addr) + 1
-		httpAddr := fmt.Sprintf(":%d", httpPort)
-		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte("ok"))
-		})
-		log.Printf("[http] health endpoint at %s", httpAddr)
-		_ = http.ListenAndServe(httpAddr, nil)
+		log.Printf("[http] health endpoint at %s", httpServer.Addr)
+		_ = httpServer.ListenAndServe()
 	}()
 
-	// create gRPC server
-	grpcServer := grpc.NewServer()
+	// create gRPC server, raft peers keep their connections alive with
+	// pings every few seconds which the default policy would reject
+	grpcServer := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             5 * time.Second,
+		PermitWithoutStream: true,
+	}))
 
 	// register KV service
-	kv.RegisterKVServer(grpcServer, NewServer(store))
+	server := NewServer(router, opts)
+	kv.RegisterKVServer(grpcServer, server)
+
+	// register raft RPC service, shared by every range hosted here
+	raftpb.RegisterRaftServer(grpcServer, raftMux)
 
-	// register raft RPC service
-	raftpb.RegisterRaftServer(grpcServer, raftNode)
+	// register admin service
+	adminpb.RegisterAdminServer(grpcServer, NewAdminServer(router, server.hot, opts.Cluster, opts.Meta))
+
+	// register metadata service
+	if opts.Meta != nil {
+		metapb.RegisterMetaServer(grpcServer, opts.Meta)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		log.Printf("[api] shutting down")
+		if opts.Meta != nil {
+			opts.Meta.Close()
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(shutdownTimeout):
+			grpcServer.Stop()
+		}
+
+		_ = httpServer.Shutdown(context.Background())
+		server.peers.close()
+	}()
 
 	fmt.Printf("Mimori node listening on %s\n", addr)
-	return grpcServer.Serve(lis)
+	if err := grpcServer.Serve(lis); err != nil {
+		return err
+	}
+	// Serve returns as soon as GracefulStop starts, wait for it to finish
+	<-done
+	return nil
 }
 
 // extracts port from string and returns the number
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+)
+
+// get reads key linearizably from the leader of its range
+func (c *testCluster) get(key string, asOfRev uint64) *kv.GetResponse {
+	c.t.Helper()
+	leader := c.leader(c.layout.Lookup([]byte(key)).ID)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.nodes[leader].client.Get(ctx, &kv.GetRequest{Key: []byte(key), AsOfRevision: asOfRev})
+	if err != nil {
+		c.t.Fatalf("get %s failed: %v", key, err)
+	}
+	return resp
+}
+
+func TestBatch(t *testing.T) {
+	c := newTestCluster(t, 3, Options{ForwardToLeader: true}, table("m"))
+	before := c.put("c", "old").ModRevision
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a and z live in different ranges, neither is written
+	_, err := c.nodes[c.addrs[0]].client.Batch(ctx, &kv.BatchRequest{Ops: []*kv.BatchOp{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("z"), Value: []byte("2")},
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a batch spanning ranges, got %v", err)
+	}
+	if c.get("a", 0).Found || c.get("z", 0).Found {
+		t.Fatalf("a batch spanning ranges wrote some of its keys")
+	}
+
+	// sent to a follower, which forwards it
+	resp, err := c.nodes[c.follower(1)].client.Batch(ctx, &kv.BatchRequest{Ops: []*kv.BatchOp{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("c"), Delete: true},
+		{Key: []byte("a"), Value: []byte("3")},
+	}})
+	if err != nil || !resp.Ok {
+		t.Fatalf("batch failed: %v", err)
+	}
+
+	// every op lands at the one revision, nothing of it before
+	a, b := c.get("a", 0), c.get("b", 0)
+	if string(a.Value) != "3" || string(b.Value) != "2" || c.get("c", 0).Found {
+		t.Fatalf("expected a=3, b=2 and c deleted, got a=%q b=%q", a.Value, b.Value)
+	}
+	if a.ModRevision != b.ModRevision || a.ModRevision <= before || a.Version != 2 {
+		t.Fatalf("expected a put twice and b at the same revision, got a at %d version %d, b at %d", a.ModRevision, a.Version, b.ModRevision)
+	}
+	prev := a.ModRevision - 1
+	if c.get("a", prev).Found || c.get("b", prev).Found || string(c.get("c", prev).Value) != "old" {
+		t.Fatalf("part of the batch is visible as of revision %d", prev)
+	}
+}
+
+func TestFailedConditions(t *testing.T) {
+	c := newTestCluster(t, 3, Options{ForwardToLeader: true}, table())
+	cur := c.put("lock", "alice")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// failed conditions are answers rather than errors, also when forwarded
+	for _, addr := range []string{c.leader(1), c.follower(1)} {
+		client := c.nodes[addr].client
+		for name, call := range map[string]func() (*kv.ConditionalResponse, error){
+			"put if absent": func() (*kv.ConditionalResponse, error) {
+				return client.PutIfAbsent(ctx, &kv.PutIfAbsentRequest{Key: []byte("lock"), Value: []byte("bob")})
+			},
+			"compare and swap": func() (*kv.ConditionalResponse, error) {
+				return client.CompareAndSwap(ctx, &kv.CompareAndSwapRequest{Key: []byte("lock"), Expected: []byte("carol"), Value: []byte("bob")})
+			},
+			"compare and delete": func() (*kv.ConditionalResponse, error) {
+				return client.CompareAndDelete(ctx, &kv.CompareAndDeleteRequest{Key: []byte("lock"), Expected: []byte("carol")})
+			},
+		} {
+			resp, err := call()
+			if err != nil {
+				t.Fatalf("%s via %s failed with %v, expected a failed condition", name, addr, err)
+			}
+			if resp.Succeeded || string(resp.CurrentValue) != "alice" || !resp.CurrentFound || resp.CurrentModRevision != cur.ModRevision {
+				t.Fatalf("%s via %s: expected to fail on alice at %d, got %v", name, addr, cur.ModRevision, resp)
+			}
+		}
+
+		resp, err := client.Put(ctx, &kv.PutRequest{Key: []byte("lock"), Value: []byte("bob"), ExpectedModRevision: cur.ModRevision + 100})
+		if err != nil || resp.Ok || resp.ModRevision != cur.ModRevision || resp.Version != cur.Version {
+			t.Fatalf("put at the wrong revision via %s: expected not ok at %d, got %v (%v)", addr, cur.ModRevision, resp, err)
+		}
+	}
+
+	resp, err := c.nodes[c.leader(1)].client.CompareAndDelete(ctx, &kv.CompareAndDeleteRequest{Key: []byte("missing"), Expected: []byte("x")})
+	if err != nil || resp.Succeeded || resp.CurrentFound {
+		t.Fatalf("compare and delete of a missing key: expected to fail with nothing found, got %v (%v)", resp, err)
+	}
+	if got := c.get("lock", 0); string(got.Value) != "alice" || got.ModRevision != cur.ModRevision {
+		t.Fatalf("failed conditions changed the key to %q at %d", got.Value, got.ModRevision)
+	}
+
+	// and a condition that holds goes through
+	swapped, err := c.nodes[c.follower(1)].client.CompareAndSwap(ctx, &kv.CompareAndSwapRequest{Key: []byte("lock"), Expected: []byte("alice"), Value: []byte("bob")})
+	if err != nil || !swapped.Succeeded {
+		t.Fatalf("compare and swap from alice failed: %v (%v)", swapped, err)
+	}
+	if got := c.get("lock", 0); string(got.Value) != "bob" {
+		t.Fatalf("expected bob after the swap, got %q", got.Value)
+	}
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jerkeyray/mimori/internal/api/kv"
+	"github.com/jerkeyray/mimori/internal/raft"
+	"github.com/jerkeyray/mimori/internal/raft/raftpb"
+	"github.com/jerkeyray/mimori/internal/storage"
+)
+
+// StateMachine applies committed kv commands to a PebbleKV
+type StateMachine struct {
+	store *storage.PebbleKV
+}
+
+var _ raft.BatchStateMachine = (*StateMachine)(nil)
+
+func NewStateMachine(store *storage.PebbleKV) *StateMachine {
+	return &StateMachine{store: store}
+}
+
+// Apply decodes the command in entry and writes it together with the entry's index
+func (sm *StateMachine) Apply(entry *raftpb.LogEntry) interface{} {
+	return sm.ApplyBatch([]*raftpb.LogEntry{entry})[0]
+}
+
+// ApplyBatch applies entries one after the other and then waits for the
+// disk once for all of them, so writers whose entries commit together share
+// an fsync
+func (sm *StateMachine) ApplyBatch(entries []*raftpb.LogEntry) []interface{} {
+	results := make([]interface{}, len(entries))
+	for i, e := range entries {
+		results[i] = sm.applyEntry(e)
+	}
+	if err := sm.store.Sync(); err != nil {
+		log.Fatalf("[api] failed to sync up to index %d: %v", entries[len(entries)-1].Index, err)
+	}
+	return results
+}
+
+func (sm *StateMachine) applyEntry(entry *raftpb.LogEntry) interface{} {
+	// nothing to write for raft's own entries, but the index still moves
+	if entry.Type != raftpb.EntryType_ENTRY_NORMAL {
+		if _, err := sm.store.Apply(nil, entry.Index, uint64(entry.Term)); err != nil {
+			log.Fatalf("[api] failed to apply index %d: %v", entry.Index, err)
+		}
+		return nil
+	}
+
+	var cmd kv.Command
+	if err := proto.Unmarshal(entry.Data, &cmd); err != nil {
+		log.Fatalf("[api] corrupt command at index %d: %v", entry.Index, err)
+	}
+
+	if cmd.Op == kv.CommandOp_OP_COMPACT {
+		if err := sm.store.Compact(cmd.Revision, entry.Index, uint64(entry.Term)); err != nil {
+			log.Fatalf("[api] failed to apply index %d: %v", entry.Index, err)
+		}
+		return nil
+	}
+
+	var cond *storage.Condition
+	if cmd.Condition != nil {
+		cond = &storage.Condition{Absent: cmd.Condition.Absent, Value: cmd.Condition.Value, ModRevision: cmd.Condition.ModRevision}
+	}
+	var muts []storage.Mutation
+	switch cmd.Op {
+	case kv.CommandOp_OP_PUT:
+		muts = append(muts, storage.Mutation{Key: cmd.Key, Value: cmd.Value, If: cond})
+	case kv.CommandOp_OP_DELETE:
+		muts = append(muts, storage.Mutation{Delete: true, Key: cmd.Key, If: cond})
+	case kv.CommandOp_OP_BATCH:
+		for _, op := range cmd.Ops {
+			muts = append(muts, storage.Mutation{Delete: op.Delete, Key: op.Key, Value: op.Value})
+		}
+	}
+
+	// the write is timed by the proposer's clock, so every replica records
+	// the same time for it
+	var at time.Time
+	if cmd.Timestamp != 0 {
+		at = time.Unix(0, cmd.Timestamp)
+	}
+
+	// a failed condition is the proposer's answer, every replica fails it
+	// alike, but a replica that fails to apply otherwise would silently
+	// diverge from the others
+	metas, err := sm.store.ApplyAt(muts, entry.Index, uint64(entry.Term), at)
+	var failed *storage.ConditionFailedError
+	if errors.As(err, &failed) {
+		return failed
+	}
+	if err != nil {
+		log.Fatalf("[api] failed to apply index %d: %v", entry.Index, err)
+	}
+	// a put answers with the key's revisions
+	if cmd.Op == kv.CommandOp_OP_PUT {
+		return metas[0]
+	}
+	return nil
+}
+
+func (sm *StateMachine) Applied() (uint64, int32, error) {
+	index, term, err := sm.store.Applied()
+	return index, int32(term), err
+}
+
+func (sm *StateMachine) Snapshot(w io.Writer) (uint64, int32, error) {
+	index, term, err := sm.store.Snapshot(w)
+	return index, int32(term), err
+}
+
+func (sm *StateMachine) Restore(r io.Reader) error {
+	return sm.store.Restore(r)
+}
@@ -4,50 +4,104 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// LocalityHeader carries a node's locality labels on its /healthz responses
+const LocalityHeader = "X-Mimori-Locality"
+
+// LayoutHeader carries the fingerprint of the layout a node routes keys by,
+// nodes only move ranges around once they all agree on it
+const LayoutHeader = "X-Mimori-Layout"
+
 // Node represents each know peer in the cluster
 type Node struct {
-	Addr   string
-	Alive  bool
-	LastOK time.Time
+	Addr     string
+	Alive    bool
+	LastOK   time.Time
+	Locality Locality // as last advertised by the node, zero until heard from
+	Layout   string   // fingerprint of the node's layout, empty until heard from
 }
 
 // Cluster holds info about the current Node's peers
 type Cluster struct {
-	SelfAddr string
-	Peers    []*Node
-	mu       sync.RWMutex
-	stop     chan struct{}
+	SelfAddr     string
+	SelfLocality Locality
+	// FailureDomain is the level whose loss quorum has to survive, set
+	// before Start
+	FailureDomain Level
+	Peers         []*Node // replaced, never modified in place, by SetPeers
+	selfLayout    string
+	mu            sync.RWMutex
+	stop          chan struct{}
+	done          chan struct{} // closed once the heartbeat loop has exited
+	started       bool          // whether Start ran, under mu
 }
 
 // New creates a new cluster manager given this node’s address and its peers.
 // filters out itself
 // build slice of Nodes for other peers
 // return ready to use cluster manager 
-func New(selfAddr string, peers []string) *Cluster {
-	nodes := make([]*Node, 0, len(peers))
-	for _, addr := range peers {
-		if addr == selfAddr {
+func New(selfAddr string, locality Locality, peers []string) *Cluster {
+	c := &Cluster{
+		SelfAddr:     selfAddr,
+		SelfLocality: locality,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	c.SetPeers(peers)
+	return c
+}
+
+// SetPeers replaces the peers with the nodes at addrs, keeping what is
+// known about the ones already there
+func (c *Cluster) SetPeers(addrs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := make([]*Node, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr == c.SelfAddr || slices.ContainsFunc(nodes, func(n *Node) bool { return n.Addr == addr }) {
 			continue
 		}
-		nodes = append(nodes, &Node{Addr: addr})
-	}
-	return &Cluster{
-		SelfAddr: selfAddr,
-		Peers:    nodes,
-		stop:     make(chan struct{}),
+		i := slices.IndexFunc(c.Peers, func(n *Node) bool { return n.Addr == addr })
+		if i >= 0 {
+			nodes = append(nodes, c.Peers[i])
+		} else {
+			nodes = append(nodes, &Node{Addr: addr})
+		}
 	}
+	c.Peers = nodes
+}
+
+// SetSelfLayout sets the fingerprint of the layout this node routes keys by
+func (c *Cluster) SetSelfLayout(layout string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.selfLayout = layout
+}
+
+// SelfLayout returns the fingerprint of the layout this node routes keys by
+func (c *Cluster) SelfLayout() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.selfLayout
 }
 
 // Start begins periodic heartbeat checks to all peers
 // call c.pingPeers every 2 seconds until stopped
 func (c *Cluster) Start() {
+	c.mu.Lock()
+	c.started = true
+	c.mu.Unlock()
+
 	ticker := time.NewTicker(2 * time.Second)
 	go func() {
+		defer close(c.done)
 		for {
 			select {
 			case <-ticker.C:
@@ -61,40 +115,124 @@ func (c *Cluster) Start() {
 	log.Printf("[cluster] started heartbeat routine with %d peers", len(c.Peers))
 }
 
-// Stop ends the heartbeat loop
-func (c *Cluster) Stop() { close(c.stop) }
+// Stop ends the heartbeat loop and waits for a ping round in progress to
+// finish, there is nothing to wait for if Start never ran
+func (c *Cluster) Stop() {
+	c.mu.RLock()
+	started := c.started
+	c.mu.RUnlock()
+
+	close(c.stop)
+	if started {
+		<-c.done
+	}
+}
 
 // pingPeers performs a heartbeat check on all known peers
 func (c *Cluster) pingPeers() {
-	// lock the mutex so no one reads from peers while they are being updated
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	// ping without holding the lock so readers aren't stuck behind a slow
+	// peer, only the results are written under it
+	c.mu.RLock()
+	peers := c.Peers
+	c.mu.RUnlock()
+	for _, peer := range peers {
+		locality, layout, err := ping(peer.Addr)
 
-	for _, peer := range c.Peers {
-		// for each peer
-		// build an http GET request, wrap in a 800ms timeout context
-		// send request with http.DefaultClient
-		// if responds with OK, mark peer alive and update LastOK
-		// else mark peer dead
-		ctx, cancel := context.WithTimeout(context.Background(), 800*time.Millisecond)
-		req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/healthz", peer.Addr), nil)
-		resp, err := http.DefaultClient.Do(req)
-		cancel()
-
-		if err == nil && resp.StatusCode == http.StatusOK {
+		c.mu.Lock()
+		if err == nil {
 			if !peer.Alive {
 				log.Printf("[cluster] peer %s is now alive", peer.Addr)
 			}
+			if locality != peer.Locality {
+				log.Printf("[cluster] peer %s is in %q", peer.Addr, locality)
+			}
 			peer.Alive = true
 			peer.LastOK = time.Now()
-			_ = resp.Body.Close()
+			peer.Locality = locality
+			peer.Layout = layout
 		} else {
 			if peer.Alive {
-				log.Printf("[cluster] peer %s seems dead", peer.Addr)
+				log.Printf("[cluster] peer %s seems dead: %v", peer.Addr, err)
 			}
 			peer.Alive = false
 		}
+		c.mu.Unlock()
+	}
+}
+
+// ping sends a GET to the peer's /healthz endpoint, which is served one port
+// above its gRPC address, and returns the locality and layout it advertises
+func ping(addr string) (Locality, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 800*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/healthz", healthAddr(addr)), nil)
+	if err != nil {
+		return Locality{}, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Locality{}, "", err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Locality{}, "", fmt.Errorf("health check returned %s", resp.Status)
 	}
+	// nodes without labels, or from before they existed, send none
+	locality, err := ParseLocality(resp.Header.Get(LocalityHeader))
+	if err != nil {
+		log.Printf("[cluster] peer %s sent bad locality: %v", addr, err)
+	}
+	return locality, resp.Header.Get(LayoutHeader), nil
+}
+
+// healthAddr returns the address of the HTTP health endpoint of the node
+// serving gRPC on addr
+func healthAddr(addr string) string {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port+1))
+}
+
+// Agreed reports whether every peer is up and routing keys by the same
+// layout as this node, and if not names a peer that isn't
+func (c *Cluster) Agreed() (bool, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, p := range c.Peers {
+		if !p.Alive || p.Layout != c.selfLayout {
+			return false, p.Addr
+		}
+	}
+	return true, ""
+}
+
+// Locality returns the locality of the node at addr, which may be this one,
+// and false if it hasn't advertised one
+func (c *Cluster) Locality(addr string) (Locality, bool) {
+	if addr == c.SelfAddr {
+		return c.SelfLocality, !c.SelfLocality.IsZero()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, p := range c.Peers {
+		if p.Addr == addr {
+			return p.Locality, !p.Locality.IsZero()
+		}
+	}
+	return Locality{}, false
+}
+
+// QuorumRisk returns the failure domain at c.FailureDomain holding a
+// majority of voters, see QuorumRisk
+func (c *Cluster) QuorumRisk(voters []string) (domain string, unknown []string) {
+	return QuorumRisk(voters, c.FailureDomain, c.Locality)
 }
 
 // PeersStatus returns a snapshot of the current peer states.
@@ -0,0 +1,25 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStop(t *testing.T) {
+	for _, start := range []bool{false, true} {
+		c := New("127.0.0.1:1", Locality{}, []string{"127.0.0.1:2"})
+		if start {
+			c.Start()
+		}
+		stopped := make(chan struct{})
+		go func() {
+			c.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Stop hung (started: %v)", start)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Locality places a node in nested failure domains: a region holds zones and
+// a zone holds racks. Labels left empty are unknown.
+type Locality struct {
+	Region string
+	Zone   string
+	Rack   string
+}
+
+// ParseLocality reads labels written as "region=us-east,zone=b,rack=12",
+// any of which may be left out
+func ParseLocality(s string) (Locality, error) {
+	var l Locality
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok || v == "" {
+			return Locality{}, fmt.Errorf("locality: %q is not label=value", part)
+		}
+		switch k {
+		case "region":
+			l.Region = v
+		case "zone":
+			l.Zone = v
+		case "rack":
+			l.Rack = v
+		default:
+			return Locality{}, fmt.Errorf("locality: unknown label %q, expected region, zone or rack", k)
+		}
+	}
+	return l, nil
+}
+
+func (l Locality) String() string {
+	// the narrowest domain is named by every label
+	d := l.domains()
+	if len(d) == 0 {
+		return ""
+	}
+	return d[len(d)-1]
+}
+
+func (l Locality) IsZero() bool {
+	return l == Locality{}
+}
+
+// domains returns the failure domains the node sits in from the widest to
+// the narrowest, each named with the labels leading to it
+func (l Locality) domains() []string {
+	var out []string
+	var path []string
+	for _, label := range []struct{ k, v string }{{"region", l.Region}, {"zone", l.Zone}, {"rack", l.Rack}} {
+		if label.v == "" {
+			continue
+		}
+		path = append(path, label.k+"="+label.v)
+		out = append(out, strings.Join(path, ","))
+	}
+	return out
+}
+
+// Closeness counts the failure domains two nodes share, higher is nearer
+func (l Locality) Closeness(other Locality) int {
+	a, b := l.domains(), other.domains()
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// Level is a kind of failure domain, from the widest to the narrowest
+type Level int
+
+const (
+	Region Level = iota
+	Zone
+	Rack
+)
+
+var levels = []string{"region", "zone", "rack"}
+
+// ParseLevel reads a level written as region, zone or rack
+func ParseLevel(s string) (Level, error) {
+	i := slices.Index(levels, s)
+	if i < 0 {
+		return 0, fmt.Errorf("locality: unknown level %q, expected region, zone or rack", s)
+	}
+	return Level(i), nil
+}
+
+func (l Level) String() string {
+	return levels[l]
+}
+
+// domain names the failure domain at level the node sits in, or "" if its
+// label for that level isn't set
+func (l Locality) domain(level Level) string {
+	labels := []string{l.Region, l.Zone, l.Rack}
+	if labels[level] == "" {
+		return ""
+	}
+	var path []string
+	for i, v := range labels[:level+1] {
+		if v != "" {
+			path = append(path, levels[i]+"="+v)
+		}
+	}
+	return strings.Join(path, ",")
+}
+
+// QuorumRisk returns the failure domain at level holding a majority of
+// voters, whose loss would leave the group without a quorum, or "" if any
+// one of them can be lost. Wider domains are taken not to fail. unknown
+// lists voters with no label at level, which weren't counted.
+func QuorumRisk(voters []string, level Level, locality func(addr string) (Locality, bool)) (domain string, unknown []string) {
+	count := make(map[string]int)
+	for _, v := range voters {
+		l, _ := locality(v)
+		d := l.domain(level)
+		if d == "" {
+			unknown = append(unknown, v)
+			continue
+		}
+		count[d]++
+	}
+
+	quorum := len(voters)/2 + 1
+	for d, n := range count {
+		if n >= quorum {
+			// at most one domain can hold a majority
+			return d, unknown
+		}
+	}
+	return "", unknown
+}
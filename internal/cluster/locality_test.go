@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseLocality(t *testing.T) {
+	l, err := ParseLocality("region=eu, zone=eu-1,rack=r7")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if l != (Locality{Region: "eu", Zone: "eu-1", Rack: "r7"}) {
+		t.Fatalf("unexpected locality %+v", l)
+	}
+	if got := l.String(); got != "region=eu,zone=eu-1,rack=r7" {
+		t.Fatalf("unexpected string %q", got)
+	}
+	if l, err := ParseLocality(""); err != nil || !l.IsZero() {
+		t.Fatalf("expected no labels to parse to nothing, got %+v, %v", l, err)
+	}
+	for _, bad := range []string{"region", "rack=", "row=3"} {
+		if _, err := ParseLocality(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestQuorumRisk(t *testing.T) {
+	localities := map[string]Locality{
+		"a": {Region: "us", Zone: "1", Rack: "x"},
+		"b": {Region: "us", Zone: "1", Rack: "y"},
+		"c": {Region: "us", Zone: "2", Rack: "x"},
+		"d": {Region: "us", Zone: "1", Rack: "x"},
+		"e": {Region: "eu", Zone: "1", Rack: "x"},
+		"f": {Region: "ap", Zone: "1", Rack: "x"},
+	}
+	lookup := func(addr string) (Locality, bool) {
+		l, ok := localities[addr]
+		return l, ok
+	}
+
+	for _, tc := range []struct {
+		voters []string
+		level  Level
+		risk   string
+	}{
+		// three racks in one zone lose quorum with the zone but not with
+		// any one rack
+		{[]string{"a", "b", "c"}, Zone, "region=us,zone=1"},
+		{[]string{"a", "b", "c"}, Rack, ""},
+		{[]string{"a", "e", "f"}, Region, ""},
+		{[]string{"a", "c", "e"}, Region, "region=us"},
+		{[]string{"a", "c", "e"}, Zone, ""},
+		// rack x in zone 1 and rack x in zone 2 are different racks, a and
+		// d share one, which is all it takes out of three
+		{[]string{"a", "c", "e"}, Rack, ""},
+		{[]string{"a", "d", "e"}, Rack, "region=us,zone=1,rack=x"},
+		{[]string{"a", "b", "c", "e"}, Region, "region=us"},
+		{[]string{"a", "b", "c", "e"}, Zone, ""},
+	} {
+		risk, unknown := QuorumRisk(tc.voters, tc.level, lookup)
+		if risk != tc.risk || len(unknown) != 0 {
+			t.Fatalf("voters %v by %s: expected risk %q, got %q with unknown %v", tc.voters, tc.level, tc.risk, risk, unknown)
+		}
+	}
+
+	// a node we know nothing of can't be counted in any domain, nor can one
+	// without a label at the level asked about
+	localities["g"] = Locality{Region: "us", Zone: "1"}
+	risk, unknown := QuorumRisk([]string{"a", "e", "z"}, Zone, lookup)
+	if risk != "" || !slices.Equal(unknown, []string{"z"}) {
+		t.Fatalf("expected z to be unknown and no risk, got %q and %v", risk, unknown)
+	}
+	risk, unknown = QuorumRisk([]string{"a", "b", "g"}, Rack, lookup)
+	if risk != "" || !slices.Equal(unknown, []string{"g"}) {
+		t.Fatalf("expected g's rack to be unknown and no risk, got %q and %v", risk, unknown)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, s := range []string{"region", "zone", "rack"} {
+		l, err := ParseLevel(s)
+		if err != nil || l.String() != s {
+			t.Fatalf("parsing %q: got %v, %v", s, l, err)
+		}
+	}
+	if _, err := ParseLevel("row"); err == nil {
+		t.Fatalf("expected an error for an unknown level")
+	}
+}
+
+func TestCloseness(t *testing.T) {
+	self := Locality{Region: "us", Zone: "1", Rack: "x"}
+	for other, want := range map[Locality]int{
+		{Region: "us", Zone: "1", Rack: "x"}: 3,
+		{Region: "us", Zone: "1", Rack: "y"}: 2,
+		{Region: "us", Zone: "2", Rack: "x"}: 1,
+		{Region: "eu", Zone: "1", Rack: "x"}: 0,
+		{}:                                   0,
+	} {
+		if got := self.Closeness(other); got != want {
+			t.Fatalf("closeness to %v: expected %d, got %d", other, want, got)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package meta keeps the cluster metadata, the registry of nodes, the
+// routing table and cluster-wide settings, in a raft group of its own. Every
+// node caches the latest metadata it has seen and routes keys by it.
+package meta
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
+	"github.com/jerkeyray/mimori/internal/ranges"
+)
+
+// GroupID is the raft group id of the meta group, range ids start at 1
+const GroupID = 0
+
+// settings that shape the routing table, the partitioning mode and the
+// number of partitions are fixed once the cluster is bootstrapped
+const (
+	SettingPartitioning = "partitioning" // range or hash
+	SettingVnodes       = "vnodes"       // virtual nodes per node on the ring
+	SettingReplication  = "replication"  // replicas per partition
+	SettingPartitions   = "partitions"   // number of hash partitions
+)
+
+// View is the latest metadata a node knows of, shared by everything on the
+// node that needs it. The metadata it hands out must not be modified.
+type View struct {
+	mu      sync.Mutex
+	md      *metapb.Metadata
+	changed chan struct{} // closed and replaced on every change
+}
+
+func NewView() *View {
+	return &View{md: &metapb.Metadata{}, changed: make(chan struct{})}
+}
+
+// Get returns the metadata along with a channel closed once it changes
+func (v *View) Get() (*metapb.Metadata, <-chan struct{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.md, v.changed
+}
+
+// Version returns the version of the metadata, 0 if there is none yet
+func (v *View) Version() uint64 {
+	md, _ := v.Get()
+	return md.Version
+}
+
+// set replaces the metadata if md is newer
+func (v *View) set(md *metapb.Metadata) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if md.Version > v.md.Version {
+		v.replaceLocked(md)
+	}
+}
+
+// reset replaces the metadata even if md is older, after a snapshot was
+// restored
+func (v *View) reset(md *metapb.Metadata) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.replaceLocked(md)
+}
+
+func (v *View) replaceLocked(md *metapb.Metadata) {
+	v.md = md
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+// Layout builds the layout keys are routed by from the routing table
+func Layout(md *metapb.Metadata) (ranges.Layout, error) {
+	descs := make([]*ranges.Descriptor, 0, len(md.Ranges))
+	for _, r := range md.Ranges {
+		descs = append(descs, FromProto(r))
+	}
+	return ranges.NewTable(descs)
+}
+
+func FromProto(r *metapb.RangeDescriptor) *ranges.Descriptor {
+	d := &ranges.Descriptor{ID: r.Id, StartKey: r.StartKey, Replicas: slices.Clone(r.Replicas), Hashed: r.Hashed}
+	if len(r.EndKey) > 0 {
+		d.EndKey = r.EndKey
+	}
+	return d
+}
+
+func ToProto(d *ranges.Descriptor) *metapb.RangeDescriptor {
+	return &metapb.RangeDescriptor{Id: d.ID, StartKey: d.StartKey, EndKey: d.EndKey, Replicas: slices.Clone(d.Replicas), Hashed: d.Hashed}
+}
+
+// Setting returns the value of a cluster-wide setting, empty if unset
+func Setting(md *metapb.Metadata, key string) string {
+	for _, s := range md.Config {
+		if s.Key == key {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+// Hashed reports whether keys are spread over the ranges by hash, in which
+// case the ring decides where ranges live rather than operators
+func Hashed(md *metapb.Metadata) bool {
+	return Setting(md, SettingPartitioning) == "hash"
+}
+
+// IsMetaNode reports whether addr hosts the meta group
+func IsMetaNode(md *metapb.Metadata, addr string) bool {
+	return slices.Contains(md.MetaNodes, addr)
+}
+
+// ring recomputes the hash partitions over the registered nodes
+func ring(md *metapb.Metadata) ([]*metapb.RangeDescriptor, error) {
+	var params [3]int
+	for i, key := range []string{SettingVnodes, SettingReplication, SettingPartitions} {
+		n, err := strconv.Atoi(Setting(md, key))
+		if err != nil {
+			return nil, fmt.Errorf("bad %s setting: %v", key, err)
+		}
+		params[i] = n
+	}
+	var addrs []string
+	for _, n := range md.Nodes {
+		addrs = append(addrs, n.Addr)
+	}
+	r, err := ranges.NewRing(addrs, params[0], params[1], params[2])
+	if err != nil {
+		return nil, err
+	}
+	var out []*metapb.RangeDescriptor
+	for _, d := range r.Ranges() {
+		out = append(out, ToProto(d))
+	}
+	return out, nil
+}
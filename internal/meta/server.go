@@ -0,0 +1,320 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
+	"github.com/jerkeyray/mimori/internal/raft"
+)
+
+// counts the nodes a metadata change has been passed through, a node
+// outside the meta group passes it to a meta node, which passes it to the
+// meta leader, and that's as far as it goes
+const hopsHeader = "x-mimori-meta-hops"
+
+const maxHops = 2
+
+// Server serves the metadata from a node's View. Changes are proposed to the
+// meta group when this node leads it and passed on towards the leader
+// otherwise.
+type Server struct {
+	metapb.UnimplementedMetaServer
+	self  string
+	view  *View
+	raft  *raft.Raft // nil on nodes outside the meta group
+	seeds []string   // asked until the metadata names the meta nodes
+
+	mu      sync.Mutex
+	conns   map[string]*grpc.ClientConn
+	closing chan struct{} // closed by Close, ends the watches served
+	once    sync.Once
+}
+
+// NewServer serves view on the node at self. r is the node's member of the
+// meta group, nil if it isn't one, in which case view is kept current by
+// Follow.
+func NewServer(self string, view *View, r *raft.Raft, seeds []string) *Server {
+	return &Server{
+		self:    self,
+		view:    view,
+		raft:    r,
+		seeds:   seeds,
+		conns:   make(map[string]*grpc.ClientConn),
+		closing: make(chan struct{}),
+	}
+}
+
+// View returns the metadata this server serves
+func (s *Server) View() *View {
+	return s.view
+}
+
+func (s *Server) Get(ctx context.Context, _ *metapb.GetRequest) (*metapb.Metadata, error) {
+	md, _ := s.view.Get()
+	return md, nil
+}
+
+func (s *Server) Watch(req *metapb.WatchRequest, stream grpc.ServerStreamingServer[metapb.Metadata]) error {
+	after := req.AfterVersion
+	for {
+		md, changed := s.view.Get()
+		if md.Version > after {
+			if err := stream.Send(md); err != nil {
+				return err
+			}
+			after = md.Version
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		case <-s.closing:
+			return status.Error(codes.Unavailable, "node is shutting down")
+		}
+	}
+}
+
+func (s *Server) RegisterNode(ctx context.Context, req *metapb.RegisterNodeRequest) (*metapb.Metadata, error) {
+	return s.write(ctx, &metapb.Command{Op: metapb.CommandOp_OP_REGISTER_NODE, Node: req.Node}, func(ctx context.Context, c metapb.MetaClient) (*metapb.Metadata, error) {
+		return c.RegisterNode(ctx, req)
+	})
+}
+
+func (s *Server) RemoveNode(ctx context.Context, req *metapb.RemoveNodeRequest) (*metapb.Metadata, error) {
+	return s.write(ctx, &metapb.Command{Op: metapb.CommandOp_OP_REMOVE_NODE, Addr: req.Addr}, func(ctx context.Context, c metapb.MetaClient) (*metapb.Metadata, error) {
+		return c.RemoveNode(ctx, req)
+	})
+}
+
+func (s *Server) SetConfig(ctx context.Context, req *metapb.SetConfigRequest) (*metapb.Metadata, error) {
+	return s.write(ctx, &metapb.Command{Op: metapb.CommandOp_OP_SET_CONFIG, Setting: req.Setting}, func(ctx context.Context, c metapb.MetaClient) (*metapb.Metadata, error) {
+		return c.SetConfig(ctx, req)
+	})
+}
+
+func (s *Server) SetReplicas(ctx context.Context, req *metapb.SetReplicasRequest) (*metapb.Metadata, error) {
+	return s.write(ctx, &metapb.Command{Op: metapb.CommandOp_OP_SET_REPLICAS, RangeId: req.RangeId, Replicas: req.Replicas}, func(ctx context.Context, c metapb.MetaClient) (*metapb.Metadata, error) {
+		return c.SetReplicas(ctx, req)
+	})
+}
+
+// write proposes cmd if this node leads the meta group, otherwise it makes
+// the same call on a node closer to the leader
+func (s *Server) write(ctx context.Context, cmd *metapb.Command, call func(context.Context, metapb.MetaClient) (*metapb.Metadata, error)) (*metapb.Metadata, error) {
+	if s.raft != nil && s.raft.IsLeader() {
+		return s.propose(ctx, cmd)
+	}
+
+	var targets []string
+	if s.raft != nil {
+		if leader := s.raft.Leader(); leader != "" {
+			targets = []string{string(leader)}
+		}
+	} else {
+		targets = s.metaNodes()
+	}
+	hops := hopsSoFar(ctx)
+	if len(targets) == 0 || hops >= maxHops {
+		return nil, status.Error(codes.Unavailable, "the meta group has no leader, retry shortly")
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, hopsHeader, strconv.Itoa(hops+1))
+	var err error
+	for _, addr := range targets {
+		var conn *grpc.ClientConn
+		if conn, err = s.conn(addr); err != nil {
+			continue
+		}
+		var md *metapb.Metadata
+		md, err = call(ctx, metapb.NewMetaClient(conn))
+		if err == nil {
+			// a meta node's view follows its own log instead
+			if s.raft == nil {
+				s.view.set(md)
+			}
+			return md, nil
+		}
+		if status.Code(err) != codes.Unavailable {
+			break
+		}
+	}
+	return nil, err
+}
+
+// propose replicates cmd through the meta group and returns the metadata
+// once it has been applied here
+func (s *Server) propose(ctx context.Context, cmd *metapb.Command) (*metapb.Metadata, error) {
+	data, err := proto.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.raft.Propose(ctx, data)
+	switch {
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrProposalDropped), errors.Is(err, raft.ErrTransferInProgress):
+		return nil, status.Errorf(codes.Unavailable, "meta leadership changed, retry shortly: %v", err)
+	case errors.Is(err, raft.ErrStopped):
+		return nil, status.Error(codes.Unavailable, "node is shutting down")
+	case err != nil:
+		return nil, status.FromContextError(err).Err()
+	}
+	if err, ok := res.(error); ok && err != nil {
+		return nil, err
+	}
+	md, _ := s.view.Get()
+	return md, nil
+}
+
+func hopsSoFar(ctx context.Context) int {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(hopsHeader)) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(md.Get(hopsHeader)[0])
+	return n
+}
+
+// metaNodes returns the nodes to send changes and watches to, the meta
+// nodes once known and the seeds before that
+func (s *Server) metaNodes() []string {
+	md, _ := s.view.Get()
+	nodes := md.MetaNodes
+	if len(nodes) == 0 {
+		nodes = s.seeds
+	}
+	return slices.DeleteFunc(slices.Clone(nodes), func(addr string) bool { return addr == s.self })
+}
+
+func (s *Server) conn(addr string) (*grpc.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, ok := s.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	s.conns[addr] = conn
+	return conn, nil
+}
+
+// Close ends the watches served, which would otherwise hold up a graceful
+// shutdown, and drops the connections to other nodes
+func (s *Server) Close() {
+	s.once.Do(func() { close(s.closing) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, conn := range s.conns {
+		_ = conn.Close()
+		delete(s.conns, addr)
+	}
+}
+
+// Bootstrap proposes initial as the cluster's first metadata whenever this
+// node leads the meta group, until the cluster has metadata. Every meta node
+// runs it, the first proposal to commit wins.
+func (s *Server) Bootstrap(ctx context.Context, initial *metapb.Metadata) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for s.view.Version() == 0 {
+		if s.raft.IsLeader() {
+			if _, err := s.propose(ctx, &metapb.Command{Op: metapb.CommandOp_OP_BOOTSTRAP, Bootstrap: initial}); err != nil {
+				log.Printf("[meta] bootstrap failed, will retry: %v", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Follow keeps the view of a node outside the meta group current by
+// watching the meta nodes, moving on to the next one when a watch breaks
+func (s *Server) Follow(ctx context.Context) {
+	for i := 0; ctx.Err() == nil; i++ {
+		targets := s.metaNodes()
+		if len(targets) > 0 {
+			if err := s.watch(ctx, targets[i%len(targets)]); err != nil && ctx.Err() == nil {
+				log.Printf("[meta] watching %s failed: %v", targets[i%len(targets)], err)
+			}
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (s *Server) watch(ctx context.Context, addr string) error {
+	conn, err := s.conn(addr)
+	if err != nil {
+		return err
+	}
+	stream, err := metapb.NewMetaClient(conn).Watch(ctx, &metapb.WatchRequest{AfterVersion: s.view.Version()})
+	if err != nil {
+		return err
+	}
+	for {
+		md, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		s.view.set(md)
+	}
+}
+
+// KeepRegistered registers node once the cluster is bootstrapped, and again
+// when its details in the registry are out of date. A node that drops out
+// of the registry after being in it was removed, and is left out until it
+// restarts.
+func (s *Server) KeepRegistered(ctx context.Context, node *metapb.Node) {
+	registered, failing := false, false
+	for {
+		md, changed := s.view.Get()
+		i := slices.IndexFunc(md.Nodes, func(n *metapb.Node) bool { return n.Addr == node.Addr })
+		switch {
+		case i >= 0:
+			registered = true
+		case registered:
+			log.Printf("[meta] %s was removed from the registry", node.Addr)
+			return
+		}
+		if md.Version > 0 && (i < 0 || !proto.Equal(md.Nodes[i], node)) {
+			rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			_, err := s.RegisterNode(rctx, &metapb.RegisterNodeRequest{Node: node})
+			cancel()
+			switch {
+			case err == nil:
+				log.Printf("[meta] registered %s", node.Addr)
+				failing = false
+			case !failing && ctx.Err() == nil:
+				log.Printf("[meta] failed to register, will retry: %v", err)
+				failing = true
+			}
+			if err != nil {
+				changed = nil // retry on the timer
+			}
+		}
+		select {
+		case <-changed:
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package meta
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
+	"github.com/jerkeyray/mimori/internal/raft"
+	"github.com/jerkeyray/mimori/internal/raft/raftpb"
+	"github.com/jerkeyray/mimori/internal/storage"
+)
+
+// the whole metadata is kept under one key, it is small and every change
+// rewrites it in one atomic write along with the applied index
+var metadataKey = []byte("metadata")
+
+// metadata versions between compactions of the store
+const compactEvery = 100
+
+// StateMachine applies metadata commands, publishing every new version to a
+// View. Apply returns a status error for commands that would leave the
+// metadata invalid, those change nothing.
+type StateMachine struct {
+	store *storage.PebbleKV
+	md    *metapb.Metadata // as of the last entry applied, only touched by raft's applier
+	view  *View
+}
+
+var _ raft.BatchStateMachine = (*StateMachine)(nil)
+
+// NewStateMachine loads the metadata already in store into view
+func NewStateMachine(store *storage.PebbleKV, view *View) (*StateMachine, error) {
+	sm := &StateMachine{store: store, view: view}
+	md, err := sm.load()
+	if err != nil {
+		return nil, err
+	}
+	sm.md = md
+	view.reset(md)
+	return sm, nil
+}
+
+func (sm *StateMachine) load() (*metapb.Metadata, error) {
+	data, found, err := sm.store.Get(metadataKey)
+	if err != nil || !found {
+		return &metapb.Metadata{}, err
+	}
+	md := &metapb.Metadata{}
+	if err := proto.Unmarshal(data, md); err != nil {
+		return nil, fmt.Errorf("meta: corrupt metadata: %w", err)
+	}
+	return md, nil
+}
+
+func (sm *StateMachine) Apply(entry *raftpb.LogEntry) interface{} {
+	return sm.ApplyBatch([]*raftpb.LogEntry{entry})[0]
+}
+
+// ApplyBatch applies entries in order and syncs the store once for all of
+// them
+func (sm *StateMachine) ApplyBatch(entries []*raftpb.LogEntry) []interface{} {
+	results := make([]interface{}, len(entries))
+	for i, e := range entries {
+		results[i] = sm.applyEntry(e)
+	}
+	if err := sm.store.Sync(); err != nil {
+		log.Fatalf("[meta] failed to sync up to index %d: %v", entries[len(entries)-1].Index, err)
+	}
+	return results
+}
+
+func (sm *StateMachine) applyEntry(entry *raftpb.LogEntry) interface{} {
+	var muts []storage.Mutation
+	var next *metapb.Metadata
+	var result error
+	if entry.Type == raftpb.EntryType_ENTRY_NORMAL {
+		var cmd metapb.Command
+		if err := proto.Unmarshal(entry.Data, &cmd); err != nil {
+			log.Fatalf("[meta] corrupt command at index %d: %v", entry.Index, err)
+		}
+
+		md := proto.Clone(sm.md).(*metapb.Metadata)
+		changed, err := apply(md, &cmd)
+		result = err
+		if changed && err == nil {
+			md.Version = sm.md.Version + 1
+			data, err := proto.Marshal(md)
+			if err != nil {
+				log.Fatalf("[meta] failed to encode metadata: %v", err)
+			}
+			muts = append(muts, storage.Mutation{Key: metadataKey, Value: data})
+			next = md
+		}
+	}
+
+	// rejected commands still move the applied index
+	if _, err := sm.store.Apply(muts, entry.Index, uint64(entry.Term)); err != nil {
+		log.Fatalf("[meta] failed to apply index %d: %v", entry.Index, err)
+	}
+	if next != nil {
+		sm.md = next
+		sm.view.set(next)
+		// only the latest metadata is ever read, the store's older versions
+		// of it are dropped now and then
+		if next.Version%compactEvery == 0 {
+			if err := sm.store.Compact(sm.store.Revision(), entry.Index, uint64(entry.Term)); err != nil {
+				log.Fatalf("[meta] failed to compact at index %d: %v", entry.Index, err)
+			}
+		}
+	}
+	return result
+}
+
+// apply makes the change cmd describes to md, reporting whether there was
+// anything to change
+func apply(md *metapb.Metadata, cmd *metapb.Command) (bool, error) {
+	if cmd.Op != metapb.CommandOp_OP_BOOTSTRAP && md.Version == 0 {
+		return false, status.Error(codes.Unavailable, "the cluster isn't bootstrapped yet")
+	}
+
+	switch cmd.Op {
+	case metapb.CommandOp_OP_BOOTSTRAP:
+		// every meta node proposes its own, the first one wins
+		if md.Version > 0 || cmd.Bootstrap == nil {
+			return false, nil
+		}
+		proto.Reset(md)
+		proto.Merge(md, cmd.Bootstrap)
+		return true, nil
+
+	case metapb.CommandOp_OP_REGISTER_NODE:
+		if cmd.Node == nil || cmd.Node.Addr == "" {
+			return false, status.Error(codes.InvalidArgument, "node address is required")
+		}
+		i, found := slices.BinarySearchFunc(md.Nodes, cmd.Node.Addr, func(n *metapb.Node, addr string) int {
+			return strings.Compare(n.Addr, addr)
+		})
+		if found {
+			if proto.Equal(md.Nodes[i], cmd.Node) {
+				return false, nil
+			}
+			md.Nodes[i] = cmd.Node
+			return true, nil
+		}
+		md.Nodes = slices.Insert(md.Nodes, i, cmd.Node)
+		return true, rebuildRing(md)
+
+	case metapb.CommandOp_OP_REMOVE_NODE:
+		i := slices.IndexFunc(md.Nodes, func(n *metapb.Node) bool { return n.Addr == cmd.Addr })
+		switch {
+		case i < 0:
+			return false, status.Errorf(codes.NotFound, "%s is not registered", cmd.Addr)
+		case IsMetaNode(md, cmd.Addr):
+			return false, status.Errorf(codes.FailedPrecondition, "%s hosts the meta group", cmd.Addr)
+		case len(md.Nodes) == 1:
+			return false, status.Errorf(codes.FailedPrecondition, "%s is the last node", cmd.Addr)
+		}
+		// in range mode ranges are moved off by hand first
+		if !Hashed(md) {
+			for _, r := range md.Ranges {
+				if slices.Contains(r.Replicas, cmd.Addr) {
+					return false, status.Errorf(codes.FailedPrecondition, "%s is still a replica of range %d", cmd.Addr, r.Id)
+				}
+			}
+		}
+		md.Nodes = slices.Delete(md.Nodes, i, i+1)
+		return true, rebuildRing(md)
+
+	case metapb.CommandOp_OP_SET_CONFIG:
+		s := cmd.Setting
+		if s == nil || s.Key == "" {
+			return false, status.Error(codes.InvalidArgument, "setting key is required")
+		}
+		if err := checkSetting(md, s); err != nil {
+			return false, err
+		}
+		i, found := slices.BinarySearchFunc(md.Config, s.Key, func(c *metapb.Setting, key string) int {
+			return strings.Compare(c.Key, key)
+		})
+		switch {
+		case found && s.Value == "":
+			md.Config = slices.Delete(md.Config, i, i+1)
+		case found && md.Config[i].Value == s.Value:
+			return false, nil
+		case found:
+			md.Config[i] = s
+		case s.Value == "":
+			return false, nil
+		default:
+			md.Config = slices.Insert(md.Config, i, s)
+		}
+		if s.Key == SettingVnodes || s.Key == SettingReplication {
+			return true, rebuildRing(md)
+		}
+		return true, nil
+
+	case metapb.CommandOp_OP_SET_REPLICAS:
+		if Hashed(md) {
+			return false, status.Error(codes.FailedPrecondition, "in hash mode the ring places replicas")
+		}
+		if len(cmd.Replicas) == 0 {
+			return false, status.Error(codes.InvalidArgument, "a range needs at least one replica")
+		}
+		i := slices.IndexFunc(md.Ranges, func(r *metapb.RangeDescriptor) bool { return r.Id == cmd.RangeId })
+		if i < 0 {
+			return false, status.Errorf(codes.NotFound, "no range %d", cmd.RangeId)
+		}
+		if slices.Equal(md.Ranges[i].Replicas, cmd.Replicas) {
+			return false, nil
+		}
+		md.Ranges[i].Replicas = cmd.Replicas
+		return true, nil
+	}
+	return false, status.Errorf(codes.InvalidArgument, "unknown command %v", cmd.Op)
+}
+
+// checkSetting rejects settings the routing table can't follow
+func checkSetting(md *metapb.Metadata, s *metapb.Setting) error {
+	switch s.Key {
+	case SettingPartitioning, SettingPartitions:
+		return status.Errorf(codes.FailedPrecondition, "%s can't change once the cluster is bootstrapped", s.Key)
+	case SettingVnodes, SettingReplication:
+		if !Hashed(md) {
+			return status.Errorf(codes.FailedPrecondition, "%s only applies in hash mode", s.Key)
+		}
+		if n, err := strconv.Atoi(s.Value); err != nil || n < 1 {
+			return status.Errorf(codes.InvalidArgument, "%s must be a number above zero", s.Key)
+		}
+	}
+	return nil
+}
+
+// rebuildRing places the hash partitions again after the nodes or the
+// ring's settings changed, in range mode there is nothing to do
+func rebuildRing(md *metapb.Metadata) error {
+	if !Hashed(md) {
+		return nil
+	}
+	rs, err := ring(md)
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	md.Ranges = rs
+	return nil
+}
+
+func (sm *StateMachine) Applied() (uint64, int32, error) {
+	index, term, err := sm.store.Applied()
+	return index, int32(term), err
+}
+
+func (sm *StateMachine) Snapshot(w io.Writer) (uint64, int32, error) {
+	index, term, err := sm.store.Snapshot(w)
+	return index, int32(term), err
+}
+
+func (sm *StateMachine) Restore(r io.Reader) error {
+	if err := sm.store.Restore(r); err != nil {
+		return err
+	}
+	md, err := sm.load()
+	if err != nil {
+		return err
+	}
+	sm.md = md
+	sm.view.reset(md)
+	return nil
+}
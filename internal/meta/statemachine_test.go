@@ -0,0 +1,199 @@
+package meta
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jerkeyray/mimori/internal/meta/metapb"
+	"github.com/jerkeyray/mimori/internal/raft/raftpb"
+	"github.com/jerkeyray/mimori/internal/storage"
+)
+
+func openStateMachine(t *testing.T, dir string) (*StateMachine, *View, *storage.PebbleKV) {
+	t.Helper()
+	store, err := storage.Open(filepath.Join(dir, "meta"))
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	view := NewView()
+	sm, err := NewStateMachine(store, view)
+	if err != nil {
+		t.Fatalf("new state machine failed: %v", err)
+	}
+	return sm, view, store
+}
+
+// applyCommand runs cmd through sm as the next log entry
+func applyCommand(t *testing.T, sm *StateMachine, cmd *metapb.Command) error {
+	t.Helper()
+	data, err := proto.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	index, _, _ := sm.Applied()
+	res := sm.Apply(&raftpb.LogEntry{Index: index + 1, Term: 1, Type: raftpb.EntryType_ENTRY_NORMAL, Data: data})
+	if res == nil {
+		return nil
+	}
+	return res.(error)
+}
+
+func hashBootstrap(nodes ...string) *metapb.Command {
+	md := &metapb.Metadata{
+		MetaNodes: nodes[:1],
+		Config: []*metapb.Setting{
+			{Key: SettingPartitioning, Value: "hash"},
+			{Key: SettingPartitions, Value: "8"},
+			{Key: SettingReplication, Value: "2"},
+			{Key: SettingVnodes, Value: "16"},
+		},
+	}
+	for _, n := range nodes {
+		md.Nodes = append(md.Nodes, &metapb.Node{Addr: n})
+	}
+	rs, _ := ring(md)
+	md.Ranges = rs
+	return &metapb.Command{Op: metapb.CommandOp_OP_BOOTSTRAP, Bootstrap: md}
+}
+
+func TestBootstrapAndVersions(t *testing.T) {
+	dir := t.TempDir()
+	sm, view, store := openStateMachine(t, dir)
+
+	err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_REGISTER_NODE, Node: &metapb.Node{Addr: "a:1"}})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected registering before bootstrap to fail, got %v", err)
+	}
+	if err := applyCommand(t, sm, hashBootstrap("a:1", "b:1")); err != nil {
+		t.Fatalf("bootstrap failed: %v", err)
+	}
+	// a second bootstrap, from another meta node, changes nothing
+	if err := applyCommand(t, sm, hashBootstrap("x:1")); err != nil {
+		t.Fatalf("second bootstrap failed: %v", err)
+	}
+	md, changed := view.Get()
+	if md.Version != 1 || len(md.Nodes) != 2 {
+		t.Fatalf("expected version 1 with two nodes, got %v", md)
+	}
+
+	// registering again with the same details is not a change
+	if err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_REGISTER_NODE, Node: &metapb.Node{Addr: "b:1"}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	select {
+	case <-changed:
+		t.Fatalf("expected no new version")
+	default:
+	}
+	if err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_REGISTER_NODE, Node: &metapb.Node{Addr: "b:1", Locality: "zone=2"}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	<-changed
+	if md, _ := view.Get(); md.Version != 2 || md.Nodes[1].Locality != "zone=2" {
+		t.Fatalf("expected b:1 in zone=2 at version 2, got %v", md)
+	}
+
+	// the metadata survives a restart
+	store.Close()
+	_, view, store = openStateMachine(t, dir)
+	defer store.Close()
+	if md, _ := view.Get(); md.Version != 2 || len(md.Ranges) != 8 {
+		t.Fatalf("expected version 2 with 8 ranges after reopening, got %v", md)
+	}
+}
+
+func TestHashRegistryMovesRanges(t *testing.T) {
+	sm, view, store := openStateMachine(t, t.TempDir())
+	defer store.Close()
+	if err := applyCommand(t, sm, hashBootstrap("a:1", "b:1")); err != nil {
+		t.Fatalf("bootstrap failed: %v", err)
+	}
+
+	// a new node gets a share of the partitions
+	if err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_REGISTER_NODE, Node: &metapb.Node{Addr: "c:1"}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	md, _ := view.Get()
+	layout, err := Layout(md)
+	if err != nil {
+		t.Fatalf("bad layout: %v", err)
+	}
+	if len(layout.Hosted("c:1")) == 0 {
+		t.Fatalf("expected c:1 to host partitions, got %v", md.Ranges)
+	}
+
+	for _, tc := range []struct {
+		cmd  *metapb.Command
+		code codes.Code
+	}{
+		{&metapb.Command{Op: metapb.CommandOp_OP_REMOVE_NODE, Addr: "a:1"}, codes.FailedPrecondition},
+		{&metapb.Command{Op: metapb.CommandOp_OP_REMOVE_NODE, Addr: "z:1"}, codes.NotFound},
+		{&metapb.Command{Op: metapb.CommandOp_OP_SET_REPLICAS, RangeId: 1, Replicas: []string{"a:1"}}, codes.FailedPrecondition},
+		{&metapb.Command{Op: metapb.CommandOp_OP_SET_CONFIG, Setting: &metapb.Setting{Key: SettingPartitions, Value: "4"}}, codes.FailedPrecondition},
+		{&metapb.Command{Op: metapb.CommandOp_OP_SET_CONFIG, Setting: &metapb.Setting{Key: SettingReplication, Value: "none"}}, codes.InvalidArgument},
+	} {
+		if err := applyCommand(t, sm, tc.cmd); status.Code(err) != tc.code {
+			t.Fatalf("%v: expected %v, got %v", tc.cmd, tc.code, err)
+		}
+	}
+	if v := view.Version(); v != 2 {
+		t.Fatalf("expected rejected commands to leave version 2, got %d", v)
+	}
+
+	// and once it leaves nothing is placed on it
+	if err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_REMOVE_NODE, Addr: "c:1"}); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	md, _ = view.Get()
+	for _, r := range md.Ranges {
+		if slices.Contains(r.Replicas, "c:1") || len(r.Replicas) != 2 {
+			t.Fatalf("unexpected replicas %v after c:1 left", r.Replicas)
+		}
+	}
+}
+
+func TestRangeReplicas(t *testing.T) {
+	sm, view, store := openStateMachine(t, t.TempDir())
+	defer store.Close()
+	bootstrap := &metapb.Metadata{
+		Nodes:     []*metapb.Node{{Addr: "a:1"}, {Addr: "b:1"}, {Addr: "c:1"}},
+		MetaNodes: []string{"a:1"},
+		Config:    []*metapb.Setting{{Key: SettingPartitioning, Value: "range"}},
+		Ranges: []*metapb.RangeDescriptor{
+			{Id: 1, EndKey: []byte("m"), Replicas: []string{"a:1", "b:1"}},
+			{Id: 2, StartKey: []byte("m"), Replicas: []string{"a:1"}},
+		},
+	}
+	if err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_BOOTSTRAP, Bootstrap: bootstrap}); err != nil {
+		t.Fatalf("bootstrap failed: %v", err)
+	}
+
+	// a replica can't be removed from the registry while it hosts a range
+	err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_REMOVE_NODE, Addr: "b:1"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected removing a replica to fail, got %v", err)
+	}
+	if err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_SET_REPLICAS, RangeId: 1, Replicas: []string{"a:1", "c:1"}}); err != nil {
+		t.Fatalf("set replicas failed: %v", err)
+	}
+	if err := applyCommand(t, sm, &metapb.Command{Op: metapb.CommandOp_OP_REMOVE_NODE, Addr: "b:1"}); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	md, _ := view.Get()
+	layout, err := Layout(md)
+	if err != nil {
+		t.Fatalf("bad layout: %v", err)
+	}
+	if d := layout.Lookup([]byte("b")); d.ID != 1 || !slices.Equal(d.Replicas, []string{"a:1", "c:1"}) {
+		t.Fatalf("unexpected range for b: %v", d)
+	}
+	if md.Version != 3 {
+		t.Fatalf("expected version 3, got %d", md.Version)
+	}
+}
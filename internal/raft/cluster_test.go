@@ -0,0 +1,594 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// testCluster runs n nodes connected through a MemNetwork
+type testCluster struct {
+	t     *testing.T
+	net   *MemNetwork
+	ids   []NodeID
+	nodes map[NodeID]*Raft
+	sms   map[NodeID]*memSM
+	wrap  func(NodeID, Transport) Transport // if set, what each node sends through
+}
+
+func newTestCluster(t *testing.T, n int, cfg Config) *testCluster {
+	return newWrappedTestCluster(t, n, cfg, nil)
+}
+
+// newWrappedTestCluster is newTestCluster with every node's transport
+// passed through wrap, to step in on what the nodes send
+func newWrappedTestCluster(t *testing.T, n int, cfg Config, wrap func(NodeID, Transport) Transport) *testCluster {
+	t.Helper()
+	c := &testCluster{
+		t:     t,
+		net:   NewMemNetwork(1),
+		nodes: make(map[NodeID]*Raft),
+		sms:   make(map[NodeID]*memSM),
+		wrap:  wrap,
+	}
+	for i := 0; i < n; i++ {
+		c.ids = append(c.ids, NodeID(fmt.Sprintf("n%d", i+1)))
+	}
+	for _, id := range c.ids {
+		cfg.ID, cfg.Peers = id, c.ids
+		c.newNode(cfg)
+	}
+	for _, id := range c.ids {
+		r := c.nodes[id]
+		r.Start(context.Background())
+		c.t.Cleanup(r.Stop)
+	}
+	return c
+}
+
+func (c *testCluster) newNode(cfg Config) *Raft {
+	c.t.Helper()
+	cfg.StateMachine, cfg.Storage, cfg.Transport = &memSM{}, NewMemoryStorage(), c.net.Transport(cfg.ID)
+	if c.wrap != nil {
+		cfg.Transport = c.wrap(cfg.ID, cfg.Transport)
+	}
+	r, err := New(cfg)
+	if err != nil {
+		c.t.Fatalf("new raft failed: %v", err)
+	}
+	c.nodes[cfg.ID], c.sms[cfg.ID] = r, cfg.StateMachine.(*memSM)
+	c.net.Add(cfg.ID, r)
+	return r
+}
+
+// join starts a node that waits to be added to the cluster
+func (c *testCluster) join(id NodeID, cfg Config) {
+	c.t.Helper()
+	cfg.ID, cfg.Peers, cfg.Join = id, nil, true
+	r := c.newNode(cfg)
+	r.Start(context.Background())
+	c.t.Cleanup(r.Stop)
+	c.ids = append(c.ids, id)
+}
+
+// changeConfig retries a membership change against the leader until it
+// goes through
+func (c *testCluster) changeConfig(change func(*Raft) error) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		err := change(c.nodes[c.waitLeader()])
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrConfigChangePending) && !errors.Is(err, ErrProposalDropped) {
+			c.t.Fatalf("membership change failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("membership change did not go through")
+}
+
+// waitVoters waits until every given node sees exactly want as voters
+func (c *testCluster) waitVoters(want []NodeID, nodes ...NodeID) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range nodes {
+		for !slices.Equal(c.nodes[id].Voters(), want) {
+			if time.Now().After(deadline) {
+				c.t.Fatalf("node %s has voters %v, expected %v", id, c.nodes[id].Voters(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// waitLeader waits for exactly one of the given nodes to consider itself leader
+func (c *testCluster) waitLeader(among ...NodeID) NodeID {
+	c.t.Helper()
+	if len(among) == 0 {
+		among = c.ids
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []NodeID
+		for _, id := range among {
+			if c.nodes[id].IsLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("no single leader elected among %v", among)
+	return ""
+}
+
+// propose keeps retrying data against whoever leads among the given nodes
+// until it is applied
+func (c *testCluster) propose(data string, among ...NodeID) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := c.waitLeader(among...)
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		_, err := c.nodes[leader].Propose(ctx, []byte(data))
+		cancel()
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrProposalDropped) && !errors.Is(err, context.DeadlineExceeded) {
+			c.t.Fatalf("propose failed: %v", err)
+		}
+	}
+	c.t.Fatalf("could not get %q applied", data)
+}
+
+// waitApplied waits until every given node has applied exactly want, in order
+func (c *testCluster) waitApplied(want []string, nodes ...NodeID) {
+	c.t.Helper()
+	if len(nodes) == 0 {
+		nodes = c.ids
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var bad NodeID
+		var got []string
+		for _, id := range nodes {
+			got = c.sms[id].data()
+			if !equalStrings(got, want) {
+				bad = id
+				break
+			}
+		}
+		if bad == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("node %s applied %v, expected %v", bad, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// data returns the payloads of the normal entries applied so far
+func (m *memSM) data() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for _, e := range m.applied {
+		if e.Type == raftpb.EntryType_ENTRY_NORMAL {
+			out = append(out, string(e.Data))
+		}
+	}
+	return out
+}
+
+func (r *Raft) currentTerm() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.term
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func others(ids []NodeID, except NodeID) []NodeID {
+	var out []NodeID
+	for _, id := range ids {
+		if id != except {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func TestClusterReplicates(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprintf("v%d", i))
+		c.propose(want[i])
+	}
+	c.waitApplied(want)
+}
+
+func TestPartitionedLeaderIsReplaced(t *testing.T) {
+	c := newTestCluster(t, 5, Config{})
+	c.propose("before")
+
+	// cut the leader off, the majority carries on without it
+	old := c.waitLeader()
+	rest := others(c.ids, old)
+	c.net.Partition([]NodeID{old})
+
+	c.propose("during", rest...)
+	c.waitApplied([]string{"before", "during"}, rest...)
+
+	// writes on the isolated leader can never commit
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := c.nodes[old].Propose(ctx, []byte("lost")); err == nil {
+		t.Fatalf("proposal on a partitioned leader should not succeed")
+	}
+
+	// once healed the old leader drops its entry and catches up
+	c.net.Heal()
+	c.propose("after")
+	c.waitApplied([]string{"before", "during", "after"})
+}
+
+func TestUnreliableNetwork(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	c.net.SetDropRate(0.1)
+	c.net.SetDuplicateRate(0.1)
+	c.net.SetDelay(0, 5*time.Millisecond)
+
+	var want []string
+	for i := 0; i < 30; i++ {
+		want = append(want, fmt.Sprintf("v%d", i))
+		c.propose(want[i])
+	}
+	// a retried proposal may have been applied twice, only the order
+	// across nodes has to agree
+	want = c.sms[c.waitLeader()].data()
+	c.waitApplied(want)
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	c := newTestCluster(t, 3, Config{CompactThreshold: 20, CompactTrailing: 5})
+	leader := c.waitLeader()
+
+	// a follower misses enough writes that the log it needs is compacted
+	lagging := others(c.ids, leader)[0]
+	c.net.Partition([]NodeID{lagging})
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		want = append(want, fmt.Sprintf("v%d", i))
+		c.propose(want[i], others(c.ids, lagging)...)
+	}
+
+	c.net.Heal()
+	c.propose("after")
+	c.waitApplied(append(want, "after"))
+
+	r := c.nodes[lagging]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.snapIndex() == 0 {
+		t.Fatalf("expected %s to catch up from a snapshot", lagging)
+	}
+}
+
+func TestStopLeader(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	c.propose("before")
+
+	old := c.waitLeader()
+	c.net.Remove(old)
+	c.nodes[old].Stop()
+
+	if _, err := c.nodes[old].Propose(context.Background(), []byte("x")); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped from a stopped node, got %v", err)
+	}
+	if c.nodes[old].IsLeader() {
+		t.Fatalf("a stopped node should not claim to lead")
+	}
+
+	rest := others(c.ids, old)
+	c.propose("after", rest...)
+	c.waitApplied([]string{"before", "after"}, rest...)
+}
+
+func TestPartitionedFollowerDoesNotDisrupt(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	c.propose("before")
+	leader := c.waitLeader()
+	term := c.nodes[leader].currentTerm()
+
+	// the isolated follower keeps timing out, but its pre-votes never
+	// get answered so its term stays put
+	follower := others(c.ids, leader)[0]
+	c.net.Partition([]NodeID{follower})
+	time.Sleep(time.Second)
+	if got := c.nodes[follower].currentTerm(); got != term {
+		t.Fatalf("partitioned follower moved from term %d to %d", term, got)
+	}
+
+	// rejoining does not dethrone the leader
+	c.net.Heal()
+	c.propose("after")
+	c.waitApplied([]string{"before", "after"})
+	if !c.nodes[leader].IsLeader() || c.nodes[leader].currentTerm() != term {
+		t.Fatalf("expected %s to stay leader for term %d", leader, term)
+	}
+}
+
+func TestCheckQuorumStepsDown(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	leader := c.waitLeader()
+
+	c.net.Partition([]NodeID{leader})
+	deadline := time.Now().Add(2 * time.Second)
+	for c.nodes[leader].IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatalf("leader cut off from the majority did not step down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := c.nodes[leader].Leader(); got != "" {
+		t.Fatalf("expected no known leader after stepping down, got %s", got)
+	}
+}
+
+func TestTransferLeadership(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	c.propose("before")
+
+	old := c.waitLeader()
+	target := others(c.ids, old)[1]
+	if err := c.nodes[old].TransferLeadership(context.Background(), target); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	if got := c.waitLeader(); got != target {
+		t.Fatalf("expected %s to lead after the transfer, got %s", target, got)
+	}
+
+	c.propose("after")
+	c.waitApplied([]string{"before", "after"})
+}
+
+// timeoutNowTransport hands TimeoutNow to a hook instead of sending it
+type timeoutNowTransport struct {
+	Transport
+	hook func(ctx context.Context, to NodeID, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error)
+}
+
+func (t *timeoutNowTransport) TimeoutNow(ctx context.Context, to NodeID, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error) {
+	return t.hook(ctx, to, req)
+}
+
+func TestNoLeaseReadsAfterHandingOff(t *testing.T) {
+	// the old leader is cut off the moment TimeoutNow goes out and never
+	// hears back, so it still has most of its lease when the target takes
+	// over and commits
+	var c *testCluster
+	c = newWrappedTestCluster(t, 3, Config{}, func(id NodeID, tr Transport) Transport {
+		return &timeoutNowTransport{Transport: tr, hook: func(ctx context.Context, to NodeID, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error) {
+			c.net.Partition([]NodeID{id})
+			if _, err := c.nodes[to].TimeoutNow(ctx, req); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("response lost")
+		}}
+	})
+	c.propose("before")
+	old := c.waitLeader()
+	target := others(c.ids, old)[0]
+
+	if err := c.nodes[old].TransferLeadership(context.Background(), target); err == nil {
+		t.Fatalf("transfer should fail without a TimeoutNow response")
+	}
+	c.propose("after", others(c.ids, old)...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if index, err := c.nodes[old].LeaseReadIndex(ctx); err == nil {
+		t.Fatalf("old leader served a lease read at index %d after handing off", index)
+	}
+}
+
+func TestLeaseReadDuringTransferConfirmsLeadership(t *testing.T) {
+	// TimeoutNow never arrives, the leader is stuck mid transfer
+	release := make(chan struct{})
+	c := newWrappedTestCluster(t, 3, Config{}, func(id NodeID, tr Transport) Transport {
+		return &timeoutNowTransport{Transport: tr, hook: func(ctx context.Context, to NodeID, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error) {
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return nil, errors.New("not delivered")
+		}}
+	})
+	c.propose("before")
+	leader := c.waitLeader()
+	r := c.nodes[leader]
+	go r.TransferLeadership(context.Background(), others(c.ids, leader)[0])
+	defer close(release)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.mu.Lock()
+		handedOff := r.handedOff
+		r.mu.Unlock()
+		if handedOff {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transfer never got to TimeoutNow")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// with the majority cut off, only the lease could answer, and it mustn't
+	c.net.Partition([]NodeID{leader})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if index, err := r.LeaseReadIndex(ctx); err == nil {
+		t.Fatalf("lease read served at index %d during a transfer", index)
+	}
+}
+
+func TestTransferToUnreachableNodeGivesUp(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	leader := c.waitLeader()
+	target := others(c.ids, leader)[0]
+	c.net.Partition([]NodeID{target})
+
+	err := c.nodes[leader].TransferLeadership(context.Background(), target)
+	if err == nil {
+		t.Fatalf("transfer to a partitioned node should fail")
+	}
+
+	// the leader takes writes again once the attempt is abandoned
+	if _, err := c.nodes[leader].Propose(context.Background(), []byte("x")); err != nil {
+		t.Fatalf("propose after a failed transfer: %v", err)
+	}
+}
+
+func TestAddVoter(t *testing.T) {
+	c := newTestCluster(t, 3, Config{CompactThreshold: 20, CompactTrailing: 5})
+
+	// enough writes that the bootstrap configuration is compacted away, the
+	// new node learns it from the snapshot
+	var want []string
+	for i := 0; i < 30; i++ {
+		want = append(want, fmt.Sprintf("v%d", i))
+		c.propose(want[i])
+	}
+
+	c.join("n4", Config{CompactThreshold: 20, CompactTrailing: 5})
+	if c.nodes["n4"].IsLeader() || len(c.nodes["n4"].Voters()) != 0 {
+		t.Fatalf("a joining node should start without a configuration")
+	}
+	c.changeConfig(func(r *Raft) error { return r.AddVoter(context.Background(), "n4") })
+	c.propose("after")
+	c.waitApplied(append(want, "after"))
+	c.waitVoters([]NodeID{"n1", "n2", "n3", "n4"}, c.ids...)
+
+	// with four voters a write needs three of them
+	leader := c.waitLeader()
+	c.net.Partition([]NodeID{leader, others(c.ids, leader)[0]})
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := c.nodes[leader].Propose(ctx, []byte("minority")); err == nil {
+		t.Fatalf("two of four voters should not commit a write")
+	}
+}
+
+func TestRemoveFollower(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	c.propose("before")
+
+	leader := c.waitLeader()
+	removed := others(c.ids, leader)[0]
+	rest := others(c.ids, removed)
+	c.changeConfig(func(r *Raft) error { return r.RemoveNode(context.Background(), removed) })
+	c.waitVoters(rest, rest...)
+
+	// the removed node hears nothing more and must not disturb the rest
+	c.propose("after", rest...)
+	c.waitApplied([]string{"before", "after"}, rest...)
+	time.Sleep(500 * time.Millisecond)
+	if !c.nodes[leader].IsLeader() {
+		t.Fatalf("removing a follower should leave %s leading", leader)
+	}
+	if got := c.sms[removed].data(); slices.Contains(got, "after") {
+		t.Fatalf("removed node applied %v", got)
+	}
+}
+
+func TestRemoveLeader(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	c.propose("before")
+
+	old := c.waitLeader()
+	rest := others(c.ids, old)
+	if err := c.nodes[old].RemoveNode(context.Background(), old); err != nil {
+		t.Fatalf("remove leader failed: %v", err)
+	}
+	if c.nodes[old].IsLeader() {
+		t.Fatalf("leader should step down once its removal committed")
+	}
+
+	c.propose("after", rest...)
+	c.waitApplied([]string{"before", "after"}, rest...)
+	c.waitVoters(rest, rest...)
+	if err := c.nodes[c.waitLeader(rest...)].RemoveNode(context.Background(), old); !errors.Is(err, ErrUnknownNode) {
+		t.Fatalf("expected ErrUnknownNode removing a node twice, got %v", err)
+	}
+}
+
+func TestLearner(t *testing.T) {
+	c := newTestCluster(t, 3, Config{})
+	c.propose("before")
+
+	c.join("n4", Config{})
+	c.changeConfig(func(r *Raft) error { return r.AddLearner(context.Background(), "n4") })
+	c.waitApplied([]string{"before"})
+	c.waitVoters([]NodeID{"n1", "n2", "n3"}, c.ids...)
+	if got := c.nodes["n4"].Learners(); !slices.Equal(got, []NodeID{"n4"}) {
+		t.Fatalf("expected n4 to know it is a learner, got %v", got)
+	}
+
+	// the learner does not count, a leader with only the learner on its
+	// side cannot commit and the two other voters elect a new leader
+	leader := c.waitLeader()
+	rest := others(c.ids[:3], leader)
+	c.net.Partition([]NodeID{leader, "n4"})
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := c.nodes[leader].Propose(ctx, []byte("lost")); err == nil {
+		t.Fatalf("a leader with just a learner should not commit")
+	}
+	c.propose("during", rest...)
+	c.waitApplied([]string{"before", "during"}, rest...)
+
+	// a learner never campaigns, however long it is cut off
+	c.net.Partition([]NodeID{"n4"})
+	time.Sleep(500 * time.Millisecond)
+	c.nodes["n4"].mu.Lock()
+	state := c.nodes["n4"].state
+	c.nodes["n4"].mu.Unlock()
+	if state != Learner {
+		t.Fatalf("expected n4 to stay a learner, got state %d", state)
+	}
+
+	// promoting it waits for it to catch up, then it counts
+	c.net.Heal()
+	c.changeConfig(func(r *Raft) error { return r.AddVoter(context.Background(), "n4") })
+	c.waitVoters([]NodeID{"n1", "n2", "n3", "n4"}, c.ids...)
+	c.propose("after")
+	c.waitApplied([]string{"before", "during", "after"})
+	if got := c.nodes["n4"].Learners(); len(got) != 0 {
+		t.Fatalf("expected no learners after promotion, got %v", got)
+	}
+}
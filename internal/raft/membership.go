@@ -0,0 +1,279 @@
+package raft
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	"google.golang.org/protobuf/proto"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// Membership changes go through the log one node at a time. Any majority of
+// the old voters overlaps any majority of the new ones when they differ by a
+// single node, so there is no window in which two leaders can be elected.
+// A configuration takes effect as soon as it is appended, on the leader and
+// on followers alike, and the leader only starts another change once the
+// last one has committed.
+//
+// Learners get the log like everyone else but never vote and never count
+// towards a majority, so they can be added, fall behind or go away without
+// touching availability. New nodes start out as learners to pick up the
+// data before being promoted.
+
+// configFrom builds a configuration out of voters and learners, dropping
+// duplicates and empty addresses. A node listed as both is a voter.
+func configFrom(voters, learners []NodeID) *raftpb.Configuration {
+	cfg := &raftpb.Configuration{}
+	for _, v := range voters {
+		if v != "" && !slices.Contains(cfg.Voters, string(v)) {
+			cfg.Voters = append(cfg.Voters, string(v))
+		}
+	}
+	for _, l := range learners {
+		if l != "" && !slices.Contains(cfg.Voters, string(l)) && !slices.Contains(cfg.Learners, string(l)) {
+			cfg.Learners = append(cfg.Learners, string(l))
+		}
+	}
+	slices.Sort(cfg.Voters)
+	slices.Sort(cfg.Learners)
+	return cfg
+}
+
+func nodeIDs(ids []string) []NodeID {
+	out := make([]NodeID, len(ids))
+	for i, id := range ids {
+		out[i] = NodeID(id)
+	}
+	return out
+}
+
+func decodeConfig(e *raftpb.LogEntry) *raftpb.Configuration {
+	cfg := &raftpb.Configuration{}
+	if err := proto.Unmarshal(e.Data, cfg); err != nil {
+		// the entry was written by a leader, a bad one means a corrupt log
+		log.Fatalf("[raft] bad configuration at index %d: %v", e.Index, err)
+	}
+	return cfg
+}
+
+// configAtLocked returns the configuration in effect at index, and the index
+// of the entry it came from. index must not be below the snapshot point.
+func (r *Raft) configAtLocked(index uint64) (*raftpb.Configuration, uint64) {
+	for i := index; i > r.snapIndex(); i-- {
+		if e := r.entry(i); e.Type == raftpb.EntryType_ENTRY_CONFIG {
+			return decodeConfig(e), i
+		}
+	}
+	return r.snapConfig, r.snapIndex()
+}
+
+// reloadConfigLocked switches to the latest configuration in the log, it is
+// called whenever entries are appended or dropped
+func (r *Raft) reloadConfigLocked() {
+	cfg, index := r.configAtLocked(r.lastIndex())
+	if cfg == nil {
+		// nothing in the log or snapshot yet, stick with the bootstrap list
+		r.configIndex = 0
+		return
+	}
+
+	r.configIndex = index
+	voters, learners := nodeIDs(cfg.Voters), nodeIDs(cfg.Learners)
+	if !slices.Equal(voters, r.voters) || !slices.Equal(learners, r.learners) {
+		log.Printf("[raft] %s configuration at index %d: voters %v, learners %v", r.name, index, voters, learners)
+	}
+	r.setConfigLocked(voters, learners)
+}
+
+// setConfigLocked installs a new set of voters and learners. A leader starts
+// replicating to nodes that joined and forgets the ones that left, anyone
+// else becomes a learner or follower depending on its new role.
+func (r *Raft) setConfigLocked(voters, learners []NodeID) {
+	r.voters, r.learners = voters, learners
+	r.peers = filterSelf(r.id, append(slices.Clone(voters), learners...))
+
+	if r.state != Leader {
+		if r.state == Follower || r.state == Learner {
+			r.state = r.followerStateLocked()
+		}
+		return
+	}
+	for _, p := range r.peers {
+		if _, ok := r.nextIndex[p]; !ok {
+			r.nextIndex[p] = r.lastIndex() + 1
+			r.matchIndex[p] = 0
+		}
+	}
+	for p := range r.nextIndex {
+		if !slices.Contains(r.peers, p) {
+			delete(r.nextIndex, p)
+			delete(r.matchIndex, p)
+			delete(r.peerAck, p)
+		}
+	}
+}
+
+// maybeStepDownLocked hands over once the configuration removing us as
+// leader has committed, until then we keep replicating it
+func (r *Raft) maybeStepDownLocked() {
+	if r.state != Leader || r.isVoterLocked(r.id) || r.configIndex > r.commitIndex {
+		return
+	}
+	log.Printf("[raft] %s removed from the cluster, stepping down", r.name)
+	r.becomeFollowerLocked(r.term)
+	r.leaderID = ""
+}
+
+func (r *Raft) isVoterLocked(id NodeID) bool {
+	return slices.Contains(r.voters, id)
+}
+
+// followerStateLocked is the state we fall back to when not leading
+func (r *Raft) followerStateLocked() RaftState {
+	if slices.Contains(r.learners, r.id) {
+		return Learner
+	}
+	return Follower
+}
+
+// otherVotersLocked are the nodes asked for votes
+func (r *Raft) otherVotersLocked() []NodeID {
+	return filterSelf(r.id, r.voters)
+}
+
+// countVotersLocked counts the voters for which ok holds, we always count
+// ourselves when we are one
+func (r *Raft) countVotersLocked(ok func(NodeID) bool) int {
+	n := 0
+	for _, v := range r.voters {
+		if v == r.id || ok(v) {
+			n++
+		}
+	}
+	return n
+}
+
+// Voters returns the voting members in the latest configuration this node
+// knows of, which may not have committed yet
+func (r *Raft) Voters() []NodeID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.voters)
+}
+
+// Learners returns the learners in the latest configuration this node knows of
+func (r *Raft) Learners() []NodeID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.learners)
+}
+
+// AddVoter adds a node to the cluster as a voter and returns once the change
+// has committed. A learner is promoted, but only after it has caught up
+// with the log as of the call, so it does not hold up commits once it
+// counts. Adding an existing voter does nothing.
+func (r *Raft) AddVoter(ctx context.Context, id NodeID) error {
+	r.mu.Lock()
+	learner := r.state == Leader && slices.Contains(r.learners, id)
+	target := r.commitIndex
+	r.mu.Unlock()
+
+	if learner {
+		r.triggerReplication()
+		err := r.wait(ctx, func() (bool, error) {
+			if r.state != Leader {
+				return false, ErrNotLeader
+			}
+			if !slices.Contains(r.learners, id) {
+				// removed or promoted by someone else meanwhile, let
+				// the change below sort it out
+				return true, nil
+			}
+			return r.matchIndex[id] >= target, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.changeConfig(ctx, func(voters, learners []NodeID) ([]NodeID, []NodeID, error) {
+		if slices.Contains(voters, id) {
+			return nil, nil, nil
+		}
+		return append(voters, id), without(learners, id), nil
+	})
+}
+
+// AddLearner adds a node that receives the log but does not vote, and
+// returns once the change has committed. Adding an existing member does
+// nothing, voters are not demoted.
+func (r *Raft) AddLearner(ctx context.Context, id NodeID) error {
+	return r.changeConfig(ctx, func(voters, learners []NodeID) ([]NodeID, []NodeID, error) {
+		if slices.Contains(voters, id) || slices.Contains(learners, id) {
+			return nil, nil, nil
+		}
+		return voters, append(learners, id), nil
+	})
+}
+
+// RemoveNode takes a voter or learner out of the cluster and returns once
+// the change has committed. A leader removing itself steps down at that point.
+func (r *Raft) RemoveNode(ctx context.Context, id NodeID) error {
+	return r.changeConfig(ctx, func(voters, learners []NodeID) ([]NodeID, []NodeID, error) {
+		if !slices.Contains(voters, id) && !slices.Contains(learners, id) {
+			return nil, nil, ErrUnknownNode
+		}
+		if len(voters) == 1 && voters[0] == id {
+			return nil, nil, ErrLastVoter
+		}
+		return without(voters, id), without(learners, id), nil
+	})
+}
+
+func without(ids []NodeID, id NodeID) []NodeID {
+	return slices.DeleteFunc(slices.Clone(ids), func(v NodeID) bool { return v == id })
+}
+
+// changeConfig appends the configuration computed by change from the current
+// one and waits for it to commit. change gets copies it may modify, and
+// returns nil voters when there is nothing to do.
+func (r *Raft) changeConfig(ctx context.Context, change func(voters, learners []NodeID) ([]NodeID, []NodeID, error)) error {
+	r.mu.Lock()
+	switch {
+	case r.stopped:
+		r.mu.Unlock()
+		return ErrStopped
+	case r.state != Leader:
+		r.mu.Unlock()
+		return ErrNotLeader
+	case r.transferee != "":
+		r.mu.Unlock()
+		return ErrTransferInProgress
+	case r.configIndex > r.commitIndex || r.commitIndex < r.termStart:
+		// one change at a time, and not before an entry of our own term has
+		// committed, or a change left over from the last leader could
+		// still be overwritten
+		r.mu.Unlock()
+		return ErrConfigChangePending
+	}
+
+	voters, learners, err := change(slices.Clone(r.voters), slices.Clone(r.learners))
+	if err != nil || voters == nil {
+		r.mu.Unlock()
+		return err
+	}
+	data, err := proto.Marshal(configFrom(voters, learners))
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	entry := r.appendLocked(raftpb.EntryType_ENTRY_CONFIG, data)
+	p := r.trackLocked(entry)
+	r.mu.Unlock()
+
+	r.triggerReplication()
+	_, err = r.await(ctx, entry.Index, p)
+	return err
+}
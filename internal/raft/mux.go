@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// Mux serves the Raft gRPC service for every group hosted on a node, handing
+// each message to the group named by its group id. Groups share the one
+// server and, through SharedTransport, one set of connections to peers.
+type Mux struct {
+	raftpb.UnimplementedRaftServer
+	mu     sync.RWMutex
+	groups map[uint64]*Raft
+}
+
+var _ raftpb.RaftServer = (*Mux)(nil)
+
+func NewMux() *Mux {
+	return &Mux{groups: make(map[uint64]*Raft)}
+}
+
+// Add starts routing messages for group to r
+func (m *Mux) Add(group uint64, r *Raft) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.groups[group] = r
+}
+
+// Remove stops routing messages for group, peers get NOT_FOUND from then on
+func (m *Mux) Remove(group uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.groups, group)
+}
+
+func (m *Mux) group(id uint64) (*Raft, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.groups[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "raft group %d is not hosted here", id)
+	}
+	return r, nil
+}
+
+func (m *Mux) RequestVote(ctx context.Context, req *raftpb.RequestVoteRequest) (*raftpb.RequestVoteResponse, error) {
+	r, err := m.group(req.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	return r.RequestVote(ctx, req)
+}
+
+func (m *Mux) AppendEntries(ctx context.Context, req *raftpb.AppendEntriesRequest) (*raftpb.AppendEntriesResponse, error) {
+	r, err := m.group(req.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	return r.AppendEntries(ctx, req)
+}
+
+func (m *Mux) TimeoutNow(ctx context.Context, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error) {
+	r, err := m.group(req.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	return r.TimeoutNow(ctx, req)
+}
+
+// InstallSnapshot reads the first chunk to find the group, then lets the
+// group read the stream from the start
+func (m *Mux) InstallSnapshot(stream raftpb.Raft_InstallSnapshotServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	r, err := m.group(first.GroupId)
+	if err != nil {
+		return err
+	}
+	return r.InstallSnapshot(&peekedStream{Raft_InstallSnapshotServer: stream, first: first})
+}
+
+// peekedStream hands out a chunk already read off the stream before the rest
+type peekedStream struct {
+	raftpb.Raft_InstallSnapshotServer
+	first *raftpb.InstallSnapshotRequest
+}
+
+func (s *peekedStream) Recv() (*raftpb.InstallSnapshotRequest, error) {
+	if first := s.first; first != nil {
+		s.first = nil
+		return first, nil
+	}
+	return s.Raft_InstallSnapshotServer.Recv()
+}
+
+// SharedTransport lets several groups send through one transport. Stopping a
+// group leaves it open, whoever created t closes it once all groups stopped.
+func SharedTransport(t Transport) Transport {
+	return sharedTransport{t}
+}
+
+type sharedTransport struct {
+	Transport
+}
+
+func (sharedTransport) Close() error {
+	return nil
+}
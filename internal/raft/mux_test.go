@@ -0,0 +1,122 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// two groups on the same three nodes over real gRPC, one node starts late and
+// catches up from a snapshot streamed through the mux, learning the
+// configuration from it
+func TestMuxGroups(t *testing.T) {
+	var ids []NodeID
+	var lis []net.Listener
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		lis = append(lis, l)
+		ids = append(ids, NodeID(l.Addr().String()))
+	}
+
+	groups := []uint64{1, 2}
+	nodes := make(map[uint64]map[NodeID]*Raft)
+	sms := make(map[uint64]map[NodeID]*memSM)
+	muxes := make(map[NodeID]*Mux)
+	for _, g := range groups {
+		nodes[g], sms[g] = make(map[NodeID]*Raft), make(map[NodeID]*memSM)
+	}
+	late := ids[2]
+	for i, id := range ids {
+		transport := NewGRPCTransport()
+		t.Cleanup(func() { transport.Close() })
+		muxes[id] = NewMux()
+		for _, g := range groups {
+			sm := &memSM{}
+			r, err := New(Config{
+				ID: id, Peers: ids, GroupID: g, Join: id == late,
+				StateMachine: sm, Storage: NewMemoryStorage(), Transport: SharedTransport(transport),
+				CompactThreshold: 20, CompactTrailing: 5,
+			})
+			if err != nil {
+				t.Fatalf("new raft failed: %v", err)
+			}
+			nodes[g][id], sms[g][id] = r, sm
+			muxes[id].Add(g, r)
+		}
+		srv := grpc.NewServer()
+		raftpb.RegisterRaftServer(srv, muxes[id])
+		go srv.Serve(lis[i])
+		t.Cleanup(srv.Stop)
+	}
+
+	start := func(id NodeID) {
+		for _, g := range groups {
+			nodes[g][id].Start(context.Background())
+			t.Cleanup(nodes[g][id].Stop)
+		}
+	}
+	start(ids[0])
+	start(ids[1])
+
+	propose := func(g uint64, data string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, r := range nodes[g] {
+				if r.IsLeader() {
+					ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+					_, err := r.Propose(ctx, []byte(data))
+					cancel()
+					if err == nil {
+						return
+					}
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("could not get %q applied in group %d", data, g)
+	}
+
+	// each group gets its own writes and nothing of the other's
+	want := make(map[uint64][]string)
+	for i := 0; i < 30; i++ {
+		for _, g := range groups {
+			v := fmt.Sprintf("g%d-v%d", g, i)
+			want[g] = append(want[g], v)
+			propose(g, v)
+		}
+	}
+
+	start(late)
+	for _, g := range groups {
+		deadline := time.Now().Add(5 * time.Second)
+		for _, id := range ids {
+			for !equalStrings(sms[g][id].data(), want[g]) {
+				if time.Now().After(deadline) {
+					t.Fatalf("group %d on %s applied %v, expected %v", g, id, sms[g][id].data(), want[g])
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		r := nodes[g][late]
+		r.mu.Lock()
+		snap := r.snapIndex()
+		voters := len(r.voters)
+		r.mu.Unlock()
+		if snap == 0 {
+			t.Fatalf("expected group %d on %s to catch up from a snapshot", g, late)
+		}
+		if voters != 3 {
+			t.Fatalf("expected the snapshot to carry 3 voters to group %d on %s, got %d", g, late, voters)
+		}
+	}
+}
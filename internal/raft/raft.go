@@ -1,11 +1,16 @@
 package raft
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"sync"
 	"time"
 
+	"google.golang.org/protobuf/proto"
+
 	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
 )
 
@@ -13,47 +18,312 @@ import (
 type RaftState int
 
 const (
-	Follower RaftState  = iota
+	Follower RaftState = iota
 	Candidate
 	Leader
+	// PreCandidate polls the cluster before a real election, see startPreVoteLocked
+	PreCandidate
+	// Learner follows the leader's log without voting, see membership.go
+	Learner
 )
 
 // node address
 type NodeID string
 
+var (
+	// ErrNotLeader is returned when a proposal is made on a node that is not the leader
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrProposalDropped means the entry was overwritten by another leader before it committed
+	ErrProposalDropped = errors.New("raft: proposal dropped by a new leader")
+	// ErrStopped is returned by calls made after the node was stopped, or cut short by it
+	ErrStopped = errors.New("raft: stopped")
+	// ErrTransferInProgress is returned for proposals while the leader hands over to another node
+	ErrTransferInProgress = errors.New("raft: leadership transfer in progress")
+	// ErrUnknownNode means the node named is not part of the cluster
+	ErrUnknownNode = errors.New("raft: unknown node")
+	// ErrConfigChangePending is returned while an earlier membership change has not committed yet
+	ErrConfigChangePending = errors.New("raft: membership change in progress")
+	// ErrLastVoter is returned when removing the only voter, which would leave nobody to lead
+	ErrLastVoter = errors.New("raft: cannot remove the last voter")
+)
+
+// max number of entries shipped in a single AppendEntries call
+const maxEntriesPerAppend = 512
+
+// the log is compacted once this many applied entries have piled up since
+// the last snapshot, keeping the newest few so slightly lagging followers
+// can still catch up from the log instead of a full snapshot
+const (
+	defaultCompactThreshold = 8192
+	defaultCompactTrailing  = 1024
+)
+
 // Raft holds the consensus state for a mimori node
 type Raft struct {
-	raftpb.UnimplementedRaftServer  // REQUIRED for gRPC server interface
-	mu sync.Mutex
-
-	id NodeID // our address, e.g. ":4000"
-	peers []NodeID // other nodes
-	state RaftState // follower, candidate, leader
-	term int // current term
-	votes int
+	raftpb.UnimplementedRaftServer // REQUIRED for gRPC server interface
+	mu                             sync.Mutex
+
+	id       NodeID    // our address, e.g. ":4000"
+	group    uint64    // raft group we belong to, stamped on every message
+	name     string    // id and group, for logs
+	peers    []NodeID  // other voters and learners, the nodes we replicate to as leader
+	state    RaftState // follower, candidate, leader, ...
+	term     int       // current term
+	votes    int
 	votedFor NodeID // who we voted for
+	leaderID NodeID // current leader as far as we know, "" if unknown
+
+	// replicated log, log[0] is a sentinel holding the index and term of the
+	// last entry compacted into a snapshot (0 and 0 before the first one)
+	log         []*raftpb.LogEntry
+	commitIndex uint64 // highest index known to be committed
+	lastApplied uint64 // highest index handed to apply
+
+	// membership, from the latest configuration entry in the log, see membership.go
+	voters      []NodeID              // every voter, may include ourselves
+	learners    []NodeID              // nodes that get the log but do not vote
+	configIndex uint64                // index of the entry voters came from, 0 for the bootstrap list
+	snapConfig  *raftpb.Configuration // configuration as of the snapshot point, nil if unknown
+
+	// leader only, reset on every election win
+	nextIndex  map[NodeID]uint64    // next index to send to each peer
+	matchIndex map[NodeID]uint64    // highest index known replicated on each peer
+	peerAck    map[NodeID]time.Time // send time of the latest heartbeat each peer answered
+	termStart  uint64               // index of the no-op that opened our term
+	leaderAt   time.Time            // when we won the current term
+	transferee NodeID               // node we are handing leadership to, if any
+	handedOff  bool                 // sent TimeoutNow this term, the lease can't be trusted any more
+
+	snapshotting map[NodeID]bool // leader only, peers a snapshot is on its way to
+
+	sm          StateMachine
+	storage     Storage
+	transport   Transport
+	savedTerm   int // term and vote last written to storage
+	savedVote   NodeID
+	applyCond   *sync.Cond           // signalled when commitIndex moves
+	waiters     map[uint64]*proposal // proposals waiting to be applied, by log index
+	replicateCh chan struct{}        // pokes the leader loop to replicate right away
+	notifyCh    chan struct{}        // closed whenever commit, apply or leadership changes
+
+	// held while entries or a snapshot from the leader go into sm, so the
+	// two never interleave
+	applyMu    sync.Mutex
+	installing bool // restoring a snapshot, hold off elections until done
+
+	compactThreshold uint64
+	compactTrailing  uint64
+	snapshotDir      string // where snapshot files are staged, see Config
+
+	// lifecycle, ctx is cancelled on Stop and wg tracks every goroutine we start
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stopped bool
 
 	// timers
 	electionReset time.Time
 }
 
-// create a new Raft instance and start election timer in the background
-func New(id NodeID, peers []NodeID) *Raft {
-	r := &Raft {
-		id: id, 
-		peers: peers,
-		state: Follower,
-		term: 0,
-		votedFor: "",
+// proposal tracks a client waiting for its entry to be applied
+type proposal struct {
+	term int32
+	done chan proposalResult
+}
+
+type proposalResult struct {
+	value interface{}
+	err   error
+}
+
+// Config describes a node and what it is wired up to
+type Config struct {
+	ID    NodeID   // our address, e.g. ":4000"
+	Peers []NodeID // every node in the cluster, may include ourselves
+
+	// GroupID tells apart the raft groups hosted by the same nodes, messages
+	// carry it so a Mux can hand them to the right one. Zero is fine when
+	// there is only one group.
+	GroupID uint64
+
+	// Peers only bootstraps a brand new cluster, once a configuration is in
+	// the log it takes over. Join starts a node with no configuration at
+	// all, so it stays quiet until the leader adds it and reaches out.
+	Join bool
+
+	StateMachine StateMachine
+	Storage      Storage
+	Transport    Transport
+
+	// the log is compacted once CompactThreshold applied entries have piled
+	// up, keeping the last CompactTrailing of them, which must be fewer.
+	// Zero means the default.
+	CompactThreshold uint64
+	CompactTrailing  uint64
+
+	// SnapshotDir holds snapshots while they are sent or received, best
+	// next to the data since they are as large. Files a crash left behind
+	// are removed by New. Empty means the system temp dir.
+	SnapshotDir string
+}
+
+// New creates a Raft instance from the hard state and log saved in storage,
+// so a restarted node carries on where it left off. Nothing runs until Start.
+func New(cfg Config) (*Raft, error) {
+	threshold, trailing := uint64(defaultCompactThreshold), uint64(defaultCompactTrailing)
+	if cfg.CompactThreshold > 0 {
+		threshold = cfg.CompactThreshold
+	}
+	if cfg.CompactTrailing > 0 {
+		trailing = cfg.CompactTrailing
+	}
+	// a compaction keeps the trailing entries out of those that piled up
+	if trailing >= threshold {
+		return nil, fmt.Errorf("raft: CompactTrailing %d must be below CompactThreshold %d", trailing, threshold)
+	}
+
+	storage, sm := cfg.Storage, cfg.StateMachine
+	hs, meta, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	// entries up to this point are already reflected in the state machine
+	applied, appliedTerm, err := sm.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	// a crash between restoring a snapshot and resetting the log leaves the
+	// state machine ahead of a log that does not lead up to it
+	if applied > meta.Index {
+		i := applied - meta.Index - 1
+		if i >= uint64(len(entries)) || entries[i].Term != appliedTerm {
+			meta = &raftpb.SnapshotMeta{Index: applied, Term: appliedTerm}
+			if err := storage.Reset(meta); err != nil {
+				return nil, err
+			}
+			entries = nil
+		}
+	}
+
+	r := &Raft{
+		id:            cfg.ID,
+		group:         cfg.GroupID,
+		name:          string(cfg.ID),
+		state:         Follower,
+		term:          int(hs.Term),
+		votedFor:      NodeID(hs.VotedFor),
+		log:           append([]*raftpb.LogEntry{{Index: meta.Index, Term: meta.Term}}, entries...),
+		commitIndex:   applied,
+		lastApplied:   applied,
+		sm:            sm,
+		storage:       storage,
+		transport:     cfg.Transport,
+		savedTerm:     int(hs.Term),
+		savedVote:     NodeID(hs.VotedFor),
+		waiters:       make(map[uint64]*proposal),
+		replicateCh:   make(chan struct{}, 1),
+		notifyCh:      make(chan struct{}),
 		electionReset: time.Now(),
+
+		compactThreshold: threshold,
+		compactTrailing:  trailing,
+	}
+	if cfg.GroupID != 0 {
+		r.name = fmt.Sprintf("%s/%d", cfg.ID, cfg.GroupID)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.applyCond = sync.NewCond(&r.mu)
+	if r.snapshotDir = cfg.SnapshotDir; r.snapshotDir != "" {
+		if err := cleanSnapshotDir(r.snapshotDir); err != nil {
+			return nil, err
+		}
+	}
+
+	r.snapConfig = meta.Config
+	if !cfg.Join {
+		r.setConfigLocked(nodeIDs(configFrom(append([]NodeID{cfg.ID}, cfg.Peers...), nil).Voters), nil)
+	}
+	r.reloadConfigLocked()
+	return r, nil
+}
+
+// Start runs the election timer and the applier in the background until ctx
+// is cancelled or Stop is called
+func (r *Raft) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	r.electionReset = time.Now()
+	r.spawn(r.runElectionTimer)
+	r.spawn(r.runApplier)
+
+	// whichever comes first, Stop or the caller's ctx, winds everything down
+	r.spawn(func() {
+		<-r.ctx.Done()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.stopped = true
+		r.state = Follower
+		r.leaderID = ""
+		for i, p := range r.waiters {
+			delete(r.waiters, i)
+			p.done <- proposalResult{err: ErrStopped}
+		}
+		r.applyCond.Broadcast()
+		r.notifyLocked()
+	})
+}
+
+// Stop shuts the node down and waits for everything it started to return,
+// then closes the transport. Storage and the state machine are left for the
+// caller to close. Stop may be called more than once.
+func (r *Raft) Stop() {
+	r.mu.Lock()
+	cancel := r.cancel
+	r.mu.Unlock()
+
+	cancel()
+	r.wg.Wait()
+	if err := r.transport.Close(); err != nil {
+		log.Printf("[raft] %s failed to close transport: %v", r.name, err)
+	}
+}
+
+// spawn runs f in a goroutine Stop waits for. It must be called from Start
+// or from a goroutine started this way, so it cannot race with Stop.
+func (r *Raft) spawn(f func()) {
+	if r.ctx.Err() != nil {
+		return
 	}
-	go r.runElectionTimer()
-	return r
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+}
+
+// peers may include our own address when every node shares the same list
+func filterSelf(id NodeID, peers []NodeID) []NodeID {
+	out := make([]NodeID, 0, len(peers))
+	for _, p := range peers {
+		if p != "" && p != id {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// number of votes or acks from voters needed for a majority
+func (r *Raft) quorum() int {
+	return len(r.voters)/2 + 1
 }
 
 func (r *Raft) randomElectionTimeout() time.Duration {
 	// between 150ms and 300ms
-	return time.Duration(150+rand.Intn(150)) * time.Millisecond
+	return electionTimeoutMin + time.Duration(rand.Int63n(int64(electionTimeoutMin)))
 }
 
 func (r *Raft) runElectionTimer() {
@@ -62,85 +332,448 @@ func (r *Raft) runElectionTimer() {
 	// if no heartbeat heard in a while, start new election
 	timeout := r.randomElectionTimeout()
 	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
 
 	for {
-		<- ticker.C
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
 
 		r.mu.Lock()
-		if r.state == Leader {
-			// leaders don't time out 
+		if r.state == Leader || r.installing || !r.isVoterLocked(r.id) {
+			// leaders don't time out, and neither does a node busy
+			// restoring the snapshot the leader just sent it. Nodes
+			// outside the configuration have no say in elections.
 			r.mu.Unlock()
 			continue
 		}
 
 		// time since last heartbeat or vote
 		if time.Since(r.electionReset) >= timeout {
-			// become candidate 
-			r.startElectionLocked()
+			// find out whether we could win before disturbing anyone
+			r.startPreVoteLocked()
 			timeout = r.randomElectionTimeout()
 		}
 		r.mu.Unlock()
 	}
 }
 
+// startPreVoteLocked asks the other nodes whether they would vote for us in
+// the next term, without bumping our term. A node that cannot win, e.g.
+// because it is cut off from the others, then never raises the term, and
+// does not force a healthy leader to step down when it comes back.
+func (r *Raft) startPreVoteLocked() {
+	r.state = PreCandidate
+	r.leaderID = ""
+	r.electionReset = time.Now()
+	r.votes = 1
+
+	if r.votes >= r.quorum() {
+		r.startElectionLocked()
+		return
+	}
+
+	req := r.voteRequestLocked()
+	req.Term++
+	req.PreVote = true
+	peers := r.otherVotersLocked()
+	r.spawn(func() { r.broadcastRequestVote(req, peers) })
+}
+
+func (r *Raft) handlePreVoteResponse(term int, resp *raftpb.RequestVoteResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// someone is ahead of us, there is nothing to win
+	if int(resp.Term) > r.term {
+		r.becomeFollowerLocked(int(resp.Term))
+		return
+	}
+
+	// pre-votes are asked for our term + 1, ignore ones from a poll
+	// we have given up on
+	if r.state != PreCandidate || r.term+1 != term {
+		return
+	}
+
+	if resp.VoteGranted {
+		r.votes++
+		if r.votes >= r.quorum() {
+			r.startElectionLocked()
+		}
+	}
+}
+
 // node becomes a candidate and vote for yourself
 func (r *Raft) startElectionLocked() {
 	r.state = Candidate
 	r.term++
 	r.votedFor = r.id
+	r.leaderID = ""
 	r.electionReset = time.Now()
 	r.votes = 1 // we vote for ourselves
+	r.persistHardStateLocked()
+
+	log.Printf("[raft] %s starting election for term %d", r.name, r.term)
+
+	// a single node cluster elects itself
+	if r.votes >= r.quorum() {
+		r.becomeLeaderLocked()
+		return
+	}
+
+	req := r.voteRequestLocked()
+	peers := r.otherVotersLocked()
+	r.spawn(func() { r.broadcastRequestVote(req, peers) })
+}
+
+func (r *Raft) voteRequestLocked() *raftpb.RequestVoteRequest {
+	return &raftpb.RequestVoteRequest{
+		CandidateId:  string(r.id),
+		Term:         int32(r.term),
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.lastTerm(),
+		GroupId:      r.group,
+	}
+}
+
+// step down to follower for the given term
+func (r *Raft) becomeFollowerLocked(term int) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.leaderID = ""
+		r.persistHardStateLocked()
+	}
+	r.state = r.followerStateLocked()
+	r.notifyLocked()
+}
 
-	go r.broadcastRequestVote(r.term)
+// write term and votedFor to storage if they changed since the last write.
+// Losing them could let us vote twice in one term, so failing is fatal.
+func (r *Raft) persistHardStateLocked() {
+	if r.savedTerm == r.term && r.savedVote == r.votedFor {
+		return
+	}
+	hs := &raftpb.HardState{Term: int32(r.term), VotedFor: string(r.votedFor)}
+	if err := r.storage.SetHardState(hs); err != nil {
+		log.Fatalf("[raft] %s failed to persist hard state: %v", r.name, err)
+	}
+	r.savedTerm, r.savedVote = r.term, r.votedFor
+}
 
-	
-	log.Printf("[raft] %s starting election for term %d", r.id, r.term)
+// write entries to storage, replacing anything saved at or after the first one
+func (r *Raft) persistEntriesLocked(entries []*raftpb.LogEntry) {
+	if err := r.storage.Append(entries); err != nil {
+		log.Fatalf("[raft] %s failed to persist log: %v", r.name, err)
+	}
 }
 
-func (r *Raft) handleVoteResponse(resp *raftpb.RequestVoteResponse) {
-    r.mu.Lock()
-    defer r.mu.Unlock()
+func (r *Raft) handleVoteResponse(term int, resp *raftpb.RequestVoteResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-		// if someone else has a higher term, revert to follower
-    if int(resp.Term) > r.term {
-        r.term = int(resp.Term)
-        r.state = Follower
-        r.votedFor = ""
-        return
-    }
+	// if someone else has a higher term, revert to follower
+	if int(resp.Term) > r.term {
+		r.becomeFollowerLocked(int(resp.Term))
+		return
+	}
 
-    if r.state != Candidate {
-        return
-    }
+	// ignore votes from an election we are no longer running
+	if r.state != Candidate || r.term != term {
+		return
+	}
 
-		// if majority votes received, become leader
-    if resp.VoteGranted {
-        r.votes++
-        if r.votes > len(r.peers)/2 {
-            r.becomeLeaderLocked()
-        }
-    }
+	// if majority votes received, become leader
+	if resp.VoteGranted {
+		r.votes++
+		if r.votes >= r.quorum() {
+			r.becomeLeaderLocked()
+		}
+	}
 }
 
 func (r *Raft) becomeLeaderLocked() {
-    r.state = Leader
-    log.Printf("[raft] %s became leader for term %d", r.id, r.term)
-
-		// become leader and start pulsing heartbeats every 75 ms
-    go func() {
-        ticker := time.NewTicker(75 * time.Millisecond)
-        defer ticker.Stop()
-
-        for {
-            r.mu.Lock()
-            if r.state != Leader {
-                r.mu.Unlock()
-                return
-            }
-            r.mu.Unlock()
-
-            r.sendHeartbeats()
-            <-ticker.C
-        }
-    }()
+	r.state = Leader
+	r.leaderID = r.id
+	r.leaderAt = time.Now()
+	r.transferee, r.handedOff = "", false
+	log.Printf("[raft] %s became leader for term %d", r.name, r.term)
+
+	// assume every follower is up to date until told otherwise
+	r.nextIndex = make(map[NodeID]uint64, len(r.peers))
+	r.matchIndex = make(map[NodeID]uint64, len(r.peers))
+	r.peerAck = make(map[NodeID]time.Time, len(r.peers))
+	r.snapshotting = make(map[NodeID]bool)
+	for _, p := range r.peers {
+		r.nextIndex[p] = r.lastIndex() + 1
+		r.matchIndex[p] = 0
+	}
+
+	// a no-op entry from the new term lets us commit whatever
+	// earlier leaders left behind. The first leader of a new cluster writes
+	// the bootstrap configuration instead, from then on it lives in the log.
+	if r.configIndex == 0 {
+		data, err := proto.Marshal(configFrom(r.voters, r.learners))
+		if err != nil {
+			log.Fatalf("[raft] %s failed to encode configuration: %v", r.name, err)
+		}
+		r.termStart = r.appendLocked(raftpb.EntryType_ENTRY_CONFIG, data).Index
+	} else {
+		r.termStart = r.appendLocked(raftpb.EntryType_ENTRY_NOOP, nil).Index
+	}
+
+	// become leader and replicate every 75 ms, or sooner when poked
+	term := r.term
+	r.spawn(func() {
+		ticker := time.NewTicker(75 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			r.mu.Lock()
+			if r.state != Leader || r.term != term {
+				r.mu.Unlock()
+				return
+			}
+			if !r.checkQuorumLocked() {
+				log.Printf("[raft] %s lost contact with a majority, stepping down", r.name)
+				r.becomeFollowerLocked(r.term)
+				r.leaderID = ""
+				r.electionReset = time.Now()
+				r.mu.Unlock()
+				return
+			}
+			r.mu.Unlock()
+
+			r.sendHeartbeats()
+			select {
+			case <-ticker.C:
+			case <-r.replicateCh:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// checkQuorumLocked reports whether a majority answered us within the last
+// checkQuorumTimeout. If not, they have likely moved on to a new leader, and
+// clients are better off looking for it than waiting on us.
+func (r *Raft) checkQuorumLocked() bool {
+	if time.Since(r.leaderAt) < checkQuorumTimeout {
+		return true
+	}
+	return r.acksSinceLocked(time.Now().Add(-checkQuorumTimeout)) >= r.quorum()
+}
+
+// wake the leader loop so new entries go out without waiting for the ticker
+func (r *Raft) triggerReplication() {
+	select {
+	case r.replicateCh <- struct{}{}:
+	default:
+	}
+}
+
+// Propose appends data to the log and blocks until it has been committed
+// and applied locally, returning whatever the state machine's Apply returned.
+// Only the leader accepts proposals.
+func (r *Raft) Propose(ctx context.Context, data []byte) (interface{}, error) {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if r.state != Leader {
+		r.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	// new entries would keep the transferee from ever catching up
+	if r.transferee != "" {
+		r.mu.Unlock()
+		return nil, ErrTransferInProgress
+	}
+	entry := r.appendLocked(raftpb.EntryType_ENTRY_NORMAL, data)
+	p := r.trackLocked(entry)
+	r.mu.Unlock()
+
+	r.triggerReplication()
+	return r.await(ctx, entry.Index, p)
+}
+
+// trackLocked registers a proposal for an entry we just appended
+func (r *Raft) trackLocked(entry *raftpb.LogEntry) *proposal {
+	p := &proposal{term: entry.Term, done: make(chan proposalResult, 1)}
+	r.waiters[entry.Index] = p
+	return p
+}
+
+// await blocks until the proposal at index is applied or dropped, or ctx ends
+func (r *Raft) await(ctx context.Context, index uint64, p *proposal) (interface{}, error) {
+	select {
+	case res := <-p.done:
+		return res.value, res.err
+	case <-ctx.Done():
+		r.mu.Lock()
+		if r.waiters[index] == p {
+			delete(r.waiters, index)
+		}
+		r.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// IsLeader reports whether this node currently believes it is the leader
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state == Leader
+}
+
+// Leader returns the address of the current leader, or "" if none is known
+func (r *Raft) Leader() NodeID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leaderID
+}
+
+// appends a new entry from the current term to the leader's log
+func (r *Raft) appendLocked(typ raftpb.EntryType, data []byte) *raftpb.LogEntry {
+	entry := &raftpb.LogEntry{
+		Term:  int32(r.term),
+		Index: r.lastIndex() + 1,
+		Type:  typ,
+		Data:  data,
+	}
+	r.persistEntriesLocked([]*raftpb.LogEntry{entry})
+	r.log = append(r.log, entry)
+	if typ == raftpb.EntryType_ENTRY_CONFIG {
+		r.reloadConfigLocked()
+	}
+	r.advanceCommitLocked()
+	return entry
+}
+
+// leader moves commitIndex to the highest entry of its own term
+// that is stored on a majority of nodes
+func (r *Raft) advanceCommitLocked() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		// entries from older terms are only committed indirectly
+		if r.entry(n).Term != int32(r.term) {
+			return
+		}
+		count := r.countVotersLocked(func(p NodeID) bool { return r.matchIndex[p] >= n })
+		if count >= r.quorum() {
+			r.commitIndex = n
+			r.applyCond.Broadcast()
+			r.notifyLocked()
+			r.maybeStepDownLocked()
+			return
+		}
+	}
+}
+
+// runApplier hands committed entries to the state machine in order
+func (r *Raft) runApplier() {
+	for {
+		r.mu.Lock()
+		for r.lastApplied >= r.commitIndex && !r.stopped {
+			r.applyCond.Wait()
+		}
+		stopped := r.stopped
+		r.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		r.applyMu.Lock()
+		r.applyCommitted()
+		r.applyMu.Unlock()
+	}
+}
+
+// applyCommitted applies everything committed but not yet applied, the
+// caller holds applyMu
+func (r *Raft) applyCommitted() {
+	r.mu.Lock()
+	// a snapshot may have covered these while we waited for applyMu
+	if r.lastApplied >= r.commitIndex {
+		r.mu.Unlock()
+		return
+	}
+	entries := make([]*raftpb.LogEntry, 0, r.commitIndex-r.lastApplied)
+	for i := r.lastApplied + 1; i <= r.commitIndex; i++ {
+		entries = append(entries, r.entry(i))
+	}
+	r.mu.Unlock()
+
+	var results []interface{}
+	if bsm, ok := r.sm.(BatchStateMachine); ok {
+		results = bsm.ApplyBatch(entries)
+	} else {
+		results = make([]interface{}, len(entries))
+		for i, e := range entries {
+			results[i] = r.sm.Apply(e)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, e := range entries {
+		r.lastApplied = e.Index
+		if p, ok := r.waiters[e.Index]; ok {
+			delete(r.waiters, e.Index)
+			if p.term == e.Term {
+				p.done <- proposalResult{value: results[i]}
+			} else {
+				p.done <- proposalResult{err: ErrProposalDropped}
+			}
+		}
+	}
+	r.notifyLocked()
+	r.maybeCompactLocked()
+}
+
+// log helpers, all require r.mu
+
+// index of the last entry compacted into a snapshot
+func (r *Raft) snapIndex() uint64 {
+	return r.log[0].Index
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *Raft) lastTerm() int32 {
+	return r.log[len(r.log)-1].Term
+}
+
+// a candidate's log is at least as up to date as ours if its last entry has a
+// higher term, or the same term and an index at least as high
+func (r *Raft) logUpToDateLocked(lastIndex uint64, lastTerm int32) bool {
+	if lastTerm != r.lastTerm() {
+		return lastTerm > r.lastTerm()
+	}
+	return lastIndex >= r.lastIndex()
+}
+
+func (r *Raft) entry(index uint64) *raftpb.LogEntry {
+	return r.log[index-r.snapIndex()]
+}
+
+// drop every entry from index onwards, failing anyone waiting on them.
+// Only the in-memory log is touched, storage drops them on the next append.
+func (r *Raft) truncateLocked(index uint64) {
+	for i := index; i <= r.lastIndex(); i++ {
+		if p, ok := r.waiters[i]; ok {
+			delete(r.waiters, i)
+			p.done <- proposalResult{err: ErrProposalDropped}
+		}
+	}
+	r.log = r.log[:index-r.snapIndex()]
+	if index <= r.configIndex {
+		r.reloadConfigLocked()
+	}
 }
@@ -0,0 +1,690 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// memSM is a StateMachine that records applied entries in memory
+type memSM struct {
+	mu      sync.Mutex
+	applied []*raftpb.LogEntry
+}
+
+func (m *memSM) Apply(e *raftpb.LogEntry) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied = append(m.applied, e)
+	return nil
+}
+
+func (m *memSM) Applied() (uint64, int32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.applied) == 0 {
+		return 0, 0, nil
+	}
+	last := m.applied[len(m.applied)-1]
+	return last.Index, last.Term, nil
+}
+
+func (m *memSM) Snapshot(w io.Writer) (uint64, int32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := json.NewEncoder(w).Encode(m.applied); err != nil {
+		return 0, 0, err
+	}
+	if len(m.applied) == 0 {
+		return 0, 0, nil
+	}
+	last := m.applied[len(m.applied)-1]
+	return last.Index, last.Term, nil
+}
+
+func (m *memSM) Restore(r io.Reader) error {
+	var applied []*raftpb.LogEntry
+	if err := json.NewDecoder(r).Decode(&applied); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied = applied
+	return nil
+}
+
+// newTestNode builds a node whose log holds one entry per term in terms,
+// without starting it, so tests drive it by hand
+func newTestNode(t *testing.T, id NodeID, peers []NodeID, terms ...int32) *Raft {
+	t.Helper()
+	store := NewMemoryStorage()
+	entries := make([]*raftpb.LogEntry, len(terms))
+	for i, term := range terms {
+		entries[i] = &raftpb.LogEntry{Index: uint64(i + 1), Term: term}
+	}
+	if err := store.Append(entries); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	if len(terms) > 0 {
+		if err := store.SetHardState(&raftpb.HardState{Term: terms[len(terms)-1]}); err != nil {
+			t.Fatalf("set hard state failed: %v", err)
+		}
+	}
+	// messages the node sends on its own go nowhere
+	r, err := New(Config{
+		ID:           id,
+		Peers:        peers,
+		StateMachine: &memSM{},
+		Storage:      store,
+		Transport:    NewMemNetwork(1).Transport(id),
+	})
+	if err != nil {
+		t.Fatalf("new raft failed: %v", err)
+	}
+	return r
+}
+
+// campaign makes candidate start an election and delivers its vote
+// requests to voters in process, in order
+func campaign(t *testing.T, candidate *Raft, voters ...*Raft) {
+	t.Helper()
+	candidate.mu.Lock()
+	candidate.startElectionLocked()
+	req := candidate.voteRequestLocked()
+	candidate.mu.Unlock()
+
+	for _, v := range voters {
+		resp, err := v.RequestVote(context.Background(), req)
+		if err != nil {
+			t.Fatalf("request vote failed: %v", err)
+		}
+		candidate.handleVoteResponse(int(req.Term), resp)
+	}
+}
+
+// wait returns once entries holding want have been applied, in that order
+func (m *memSM) wait(t *testing.T, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := m.data()
+		if slices.Equal(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v applied, got %v", want, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// newTestNodes builds one node per id, none of them reachable over the
+// network, so tests deliver their messages in process
+func newTestNodes(t *testing.T, ids ...NodeID) ([]*Raft, []*memSM) {
+	t.Helper()
+	net := NewMemNetwork(1)
+	nodes := make([]*Raft, len(ids))
+	sms := make([]*memSM, len(ids))
+	for i, id := range ids {
+		sms[i] = &memSM{}
+		r, err := New(Config{ID: id, Peers: ids, StateMachine: sms[i], Storage: NewMemoryStorage(), Transport: net.Transport(id)})
+		if err != nil {
+			t.Fatalf("new raft failed: %v", err)
+		}
+		r.Start(context.Background())
+		t.Cleanup(r.Stop)
+		nodes[i] = r
+	}
+	return nodes, sms
+}
+
+// elect makes r leader of a new term without asking anyone
+func elect(r *Raft) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.term++
+	r.becomeLeaderLocked()
+}
+
+// replicate sends each follower the entries the leader thinks it lacks and
+// hands its answer back to the leader
+func replicate(t *testing.T, leader *Raft, followers ...*Raft) {
+	t.Helper()
+	for _, f := range followers {
+		sent := time.Now()
+		leader.mu.Lock()
+		req := leader.appendRequestLocked(f.id)
+		leader.mu.Unlock()
+		resp, err := f.AppendEntries(context.Background(), req)
+		if err != nil {
+			t.Fatalf("append entries to %s failed: %v", f.id, err)
+		}
+		leader.handleAppendResponse(f.id, req, resp, sent)
+	}
+}
+
+// propose proposes data on r in the background, the result comes on the
+// returned channel
+func propose(r *Raft, data string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := r.Propose(ctx, []byte(data))
+		done <- err
+	}()
+	return done
+}
+
+// commit proposes data on leader and replicates it to followers until it
+// has been applied there
+func commit(t *testing.T, leader *Raft, data string, followers ...*Raft) {
+	t.Helper()
+	done := propose(leader, data)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("propose %s failed: %v", data, err)
+			}
+			return
+		case <-time.After(time.Millisecond):
+			replicate(t, leader, followers...)
+		}
+	}
+}
+
+func (r *Raft) last() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastIndex()
+}
+
+func (r *Raft) committed() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commitIndex
+}
+
+func TestRequestVoteRejectsStaleLog(t *testing.T) {
+	voter := newTestNode(t, "a", []NodeID{"b", "c"}, 1, 1, 2)
+
+	cases := []struct {
+		name      string
+		lastIndex uint64
+		lastTerm  int32
+		granted   bool
+	}{
+		{"older last term", 5, 1, false},
+		{"same term shorter log", 2, 2, false},
+		{"same term same length", 3, 2, true},
+		{"newer last term", 1, 3, true},
+	}
+
+	for i, tc := range cases {
+		// a fresh term every time, so the previous vote does not count
+		resp, err := voter.RequestVote(context.Background(), &raftpb.RequestVoteRequest{
+			CandidateId:  "b",
+			Term:         int32(10 + i),
+			LastLogIndex: tc.lastIndex,
+			LastLogTerm:  tc.lastTerm,
+		})
+		if err != nil {
+			t.Fatalf("%s: request vote failed: %v", tc.name, err)
+		}
+		if resp.VoteGranted != tc.granted {
+			t.Fatalf("%s: expected granted=%v, got %v", tc.name, tc.granted, resp.VoteGranted)
+		}
+	}
+}
+
+func TestStaleNodeLosesElection(t *testing.T) {
+	peers := []NodeID{"a", "b", "c"}
+
+	a := newTestNode(t, "a", peers, 1, 2, 2)
+	b := newTestNode(t, "b", peers, 1, 2, 2)
+	// c missed everything from term 2 but has been timing out a lot
+	c := newTestNode(t, "c", peers, 1)
+	c.term = 5
+
+	campaign(t, c, a, b)
+	if c.IsLeader() {
+		t.Fatalf("stale node c should not win an election")
+	}
+
+	// a is up to date and wins despite c having pushed the term up
+	campaign(t, a, b, c)
+	if !a.IsLeader() {
+		t.Fatalf("up to date node a should win the election")
+	}
+	if a.term <= 5 {
+		t.Fatalf("expected a to campaign above term 5, got %d", a.term)
+	}
+}
+
+func TestCommitNeedsMajority(t *testing.T) {
+	nodes, sms := newTestNodes(t, "a", "b", "c", "d", "e")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	elect(a)
+	done := propose(a, "x")
+	// wait for the entry to be in the leader's log
+	for a.last() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the leader and b hold the entry, two out of five isn't enough
+	replicate(t, a, b)
+	if got := a.committed(); got != 0 {
+		t.Fatalf("expected nothing committed with two copies, got index %d", got)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("proposal returned before it committed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// c makes three
+	replicate(t, a, c)
+	if got := a.committed(); got != 2 {
+		t.Fatalf("expected index 2 committed with three copies, got %d", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("propose failed: %v", err)
+	}
+	sms[0].wait(t, "x")
+
+	// followers only apply what they have been told is committed
+	if got := b.committed(); got != 0 {
+		t.Fatalf("expected b to know of no commits yet, got %d", got)
+	}
+	sms[1].wait(t)
+	replicate(t, a, b)
+	sms[1].wait(t, "x")
+}
+
+func TestFollowersApplyInLogOrder(t *testing.T) {
+	nodes, sms := newTestNodes(t, "a", "b", "c")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	elect(a)
+
+	// b keeps up while c misses every round until the last
+	var want []string
+	for _, data := range []string{"1", "2", "3", "4", "5"} {
+		commit(t, a, data, b)
+		want = append(want, data)
+	}
+	sms[0].wait(t, want...)
+	replicate(t, a, b)
+	sms[1].wait(t, want...)
+	sms[2].wait(t)
+
+	// c gets everything at once, and still applies it in order
+	replicate(t, a, c)
+	replicate(t, a, c)
+	sms[2].wait(t, want...)
+}
+
+func TestReadIndexNeedsQuorum(t *testing.T) {
+	nodes, _ := newTestNodes(t, "a", "b", "c")
+	a, b := nodes[0], nodes[1]
+	elect(a)
+	commit(t, a, "before", b)
+
+	// nobody answers, so a can't tell it still leads
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if index, err := a.ReadIndex(ctx); err == nil {
+		t.Fatalf("read index %d confirmed without a majority", index)
+	}
+
+	// b answering a heartbeat sent after the call makes a majority
+	type result struct {
+		index uint64
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		index, err := a.ReadIndex(ctx)
+		done <- result{index, err}
+	}()
+	for {
+		select {
+		case res := <-done:
+			if res.err != nil || res.index != a.committed() {
+				t.Fatalf("expected read index %d, got %d (%v)", a.committed(), res.index, res.err)
+			}
+			return
+		case <-time.After(time.Millisecond):
+			replicate(t, a, b)
+		}
+	}
+}
+
+func TestLeaseReadAfterLeaseExpires(t *testing.T) {
+	nodes, _ := newTestNodes(t, "a", "b", "c")
+	a, b := nodes[0], nodes[1]
+	elect(a)
+	commit(t, a, "before", b)
+
+	// b just answered, which is a lease without another round
+	replicate(t, a, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.LeaseReadIndex(ctx); err != nil {
+		t.Fatalf("lease read on a leader holding a lease failed: %v", err)
+	}
+
+	// no majority has answered for longer than a lease
+	time.Sleep(leaseDuration + 20*time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if index, err := a.LeaseReadIndex(ctx); err == nil {
+		t.Fatalf("lease read served at index %d with the lease expired", index)
+	}
+}
+
+func TestWaitAppliedOnLaggingFollower(t *testing.T) {
+	nodes, sms := newTestNodes(t, "a", "b", "c")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	elect(a)
+	commit(t, a, "before", b, c)
+
+	// c misses a write the leader's commit index covers
+	commit(t, a, "during", b)
+	index := a.committed()
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if err := c.WaitApplied(short, index); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected c to still be waiting for index %d, got %v", index, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- c.WaitApplied(ctx, index)
+	}()
+	replicate(t, a, c)
+	replicate(t, a, c)
+	if err := <-done; err != nil {
+		t.Fatalf("c never applied index %d: %v", index, err)
+	}
+	sms[2].wait(t, "before", "during")
+}
+
+func TestCompactLog(t *testing.T) {
+	r := newTestNode(t, "a", []NodeID{"b", "c"}, 1, 1, 1, 1, 1, 1, 2, 2, 2, 2)
+	r.compactThreshold, r.compactTrailing = 8, 3
+
+	r.mu.Lock()
+	r.commitIndex = 10
+	r.mu.Unlock()
+	r.applyCommitted()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.snapIndex() != 7 || r.log[0].Term != 2 {
+		t.Fatalf("expected the log to start after index 7 term 2, got %v", r.log[0])
+	}
+	if r.lastIndex() != 10 || r.entry(8).Index != 8 {
+		t.Fatalf("expected entries 8 to 10 to survive, got last index %d", r.lastIndex())
+	}
+
+	_, meta, entries, _ := r.storage.Load()
+	if meta.Index != 7 || len(entries) != 3 {
+		t.Fatalf("storage not compacted, meta %v with %d entries", meta, len(entries))
+	}
+}
+
+func TestCompactConfig(t *testing.T) {
+	for _, tc := range []struct {
+		threshold, trailing uint64
+		ok                  bool
+	}{
+		{0, 0, true},
+		{20, 5, true},
+		{20, 20, false},
+		{5, 20, false},
+		{512, 0, false}, // below the default trailing
+		{0, 8192, false},
+	} {
+		_, err := New(Config{
+			ID:               "a",
+			StateMachine:     &memSM{},
+			Storage:          NewMemoryStorage(),
+			Transport:        NewMemNetwork(1).Transport("a"),
+			CompactThreshold: tc.threshold,
+			CompactTrailing:  tc.trailing,
+		})
+		if (err == nil) != tc.ok {
+			t.Fatalf("threshold %d trailing %d: expected ok %v, got %v", tc.threshold, tc.trailing, tc.ok, err)
+		}
+	}
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	// the leader has compacted everything up to index 6
+	leader := newTestNode(t, "a", []NodeID{"b"}, 1, 1, 2, 2, 2, 3)
+	leader.compactThreshold, leader.compactTrailing = 6, 0
+	leader.mu.Lock()
+	leader.commitIndex = 6
+	leader.mu.Unlock()
+	leader.applyCommitted()
+
+	var snap bytes.Buffer
+	index, term, err := leader.sm.Snapshot(&snap)
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	// the follower has a diverging entry from term 1 that must go
+	follower := newTestNode(t, "b", []NodeID{"a"}, 1, 1, 1)
+	resp, err := follower.installSnapshot(&raftpb.InstallSnapshotRequest{
+		Term:              3,
+		LeaderId:          "a",
+		LastIncludedIndex: 6,
+		LastIncludedTerm:  3,
+	}, &snap)
+	if err != nil {
+		t.Fatalf("install snapshot failed: %v", err)
+	}
+	if resp.Term != 3 || index != 6 || term != 3 {
+		t.Fatalf("unexpected response term %d for snapshot at %d/%d", resp.Term, index, term)
+	}
+
+	if applied, _, _ := follower.sm.Applied(); applied != 6 {
+		t.Fatalf("expected state machine restored to index 6, got %d", applied)
+	}
+	if follower.lastIndex() != 6 || follower.lastApplied != 6 || follower.commitIndex != 6 {
+		t.Fatalf("unexpected log after install: last %d applied %d commit %d",
+			follower.lastIndex(), follower.lastApplied, follower.commitIndex)
+	}
+
+	// replication resumes from the log, even if the leader starts a little
+	// before the snapshot
+	ae, err := follower.AppendEntries(context.Background(), &raftpb.AppendEntriesRequest{
+		Term:         3,
+		LeaderId:     "a",
+		PrevLogIndex: 5,
+		PrevLogTerm:  2,
+		Entries:      []*raftpb.LogEntry{{Index: 6, Term: 3}, {Index: 7, Term: 3}},
+		LeaderCommit: 7,
+	})
+	if err != nil {
+		t.Fatalf("append entries failed: %v", err)
+	}
+	if !ae.Success || ae.MatchIndex != 7 || follower.lastIndex() != 7 {
+		t.Fatalf("expected entries after the snapshot to be accepted, got %v", ae)
+	}
+}
+
+func TestPreVoteChangesNothing(t *testing.T) {
+	voter := newTestNode(t, "a", []NodeID{"b", "c"}, 1, 2)
+
+	resp, err := voter.RequestVote(context.Background(), &raftpb.RequestVoteRequest{
+		CandidateId:  "b",
+		Term:         5,
+		LastLogIndex: 2,
+		LastLogTerm:  2,
+		PreVote:      true,
+	})
+	if err != nil {
+		t.Fatalf("request vote failed: %v", err)
+	}
+	if !resp.VoteGranted {
+		t.Fatalf("expected the pre-vote to be granted")
+	}
+	if voter.term != 2 || voter.votedFor != "" {
+		t.Fatalf("pre-vote changed term to %d and vote to %q", voter.term, voter.votedFor)
+	}
+
+	// a node still hearing from its leader turns pre-votes down
+	voter.leaderID = "c"
+	voter.electionReset = time.Now()
+	resp, _ = voter.RequestVote(context.Background(), &raftpb.RequestVoteRequest{
+		CandidateId:  "b",
+		Term:         5,
+		LastLogIndex: 2,
+		LastLogTerm:  2,
+		PreVote:      true,
+	})
+	if resp.VoteGranted {
+		t.Fatalf("pre-vote should be refused while the leader is alive")
+	}
+}
+
+func TestSnapshotDirCleanedOnStart(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	// a transfer cut short by a crash, and a file that isn't ours
+	for _, name := range []string{"mimori-snapshot-123", "keep"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	r, err := New(Config{
+		ID:           "a",
+		StateMachine: &memSM{},
+		Storage:      NewMemoryStorage(),
+		Transport:    NewMemNetwork(1).Transport("a"),
+		SnapshotDir:  dir,
+	})
+	if err != nil {
+		t.Fatalf("new raft failed: %v", err)
+	}
+	left, _ := os.ReadDir(dir)
+	if len(left) != 1 || left[0].Name() != "keep" {
+		t.Fatalf("expected only keep to be left, got %v", left)
+	}
+
+	f, err := r.createSnapshotFile()
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	if filepath.Dir(f.Name()) != dir {
+		t.Fatalf("snapshot file %s created outside %s", f.Name(), dir)
+	}
+}
+
+// batchSM is a memSM that takes committed entries in batches, holding up
+// every batch until release is closed
+type batchSM struct {
+	memSM
+	release chan struct{}
+	batches chan int
+}
+
+func (m *batchSM) ApplyBatch(entries []*raftpb.LogEntry) []interface{} {
+	<-m.release
+	m.batches <- len(entries)
+	results := make([]interface{}, len(entries))
+	for i, e := range entries {
+		results[i] = m.Apply(e)
+	}
+	return results
+}
+
+func TestConcurrentProposalsApplyTogether(t *testing.T) {
+	sm := &batchSM{release: make(chan struct{}), batches: make(chan int, 100)}
+	r, err := New(Config{
+		ID:           "a",
+		StateMachine: sm,
+		Storage:      NewMemoryStorage(),
+		Transport:    NewMemNetwork(1).Transport("a"),
+	})
+	if err != nil {
+		t.Fatalf("new raft failed: %v", err)
+	}
+	r.Start(context.Background())
+	defer r.Stop()
+	var once sync.Once
+	release := func() { once.Do(func() { close(sm.release) }) }
+	defer release()
+	for !r.IsLeader() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the applier is held up on the leader's no-op while the writers commit
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := r.Propose(ctx, []byte("x"))
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		committed := r.commitIndex
+		r.mu.Unlock()
+		if committed >= writers+1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d entries committed", committed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("propose failed: %v", err)
+		}
+	}
+
+	// whatever the held up batch didn't take is applied in the next one
+	var batches []int
+	total := 0
+	for len(sm.batches) > 0 {
+		batches = append(batches, <-sm.batches)
+		total += batches[len(batches)-1]
+	}
+	if total != writers+1 || len(batches) > 2 {
+		t.Fatalf("expected the %d writes to be applied in one batch after the held up one, got batches of %v", writers, batches)
+	}
+}
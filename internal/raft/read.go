@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// a follower will not start an election before hearing nothing from the
+// leader for at least this long, so a leader holding acks from a majority
+// knows no other leader can exist for roughly this long after them
+const electionTimeoutMin = 150 * time.Millisecond
+
+// leases end a little early to leave room for clock drift between nodes
+const leaseDuration = electionTimeoutMin * 9 / 10
+
+// a leader steps down when no majority answered it for a full election
+// timeout, by then followers will have started electing someone else
+const checkQuorumTimeout = 2 * electionTimeoutMin
+
+// ReadIndex implements the read half of linearizability. It returns the
+// commit index as of the call, after confirming with a round of heartbeats
+// that we were still the leader at that point. Once the local state machine
+// has applied the returned index (see WaitApplied), a local read observes
+// every write acknowledged before ReadIndex was called.
+func (r *Raft) ReadIndex(ctx context.Context) (uint64, error) {
+	var index uint64
+	var term int
+
+	// commitIndex is only known to be current once an entry from our own
+	// term (the no-op appended on election) has committed
+	err := r.wait(ctx, func() (bool, error) {
+		if r.state != Leader {
+			return false, ErrNotLeader
+		}
+		if r.commitIndex < r.termStart {
+			return false, nil
+		}
+		index, term = r.commitIndex, r.term
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// any heartbeat sent from now on that a majority answers proves
+	// nobody replaced us before index was read
+	start := time.Now()
+	r.triggerReplication()
+
+	err = r.wait(ctx, func() (bool, error) {
+		if r.state != Leader || r.term != term {
+			return false, ErrNotLeader
+		}
+		return r.acksSinceLocked(start) >= r.quorum(), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// LeaseReadIndex skips the heartbeat round of ReadIndex while the leader
+// holds a lease, i.e. a majority acknowledged it within the last
+// leaseDuration. It trades a dependency on bounded clock drift for latency
+// and falls back to ReadIndex when the lease has run out. A transfer voids
+// the lease, the target skips the election timeout that the lease relies on.
+func (r *Raft) LeaseReadIndex(ctx context.Context) (uint64, error) {
+	r.mu.Lock()
+	if r.state == Leader && r.transferee == "" && !r.handedOff &&
+		r.commitIndex >= r.termStart && time.Now().Before(r.leaseExpiryLocked()) {
+		index := r.commitIndex
+		r.mu.Unlock()
+		return index, nil
+	}
+	r.mu.Unlock()
+
+	return r.ReadIndex(ctx)
+}
+
+// WaitApplied blocks until the state machine has applied index
+func (r *Raft) WaitApplied(ctx context.Context, index uint64) error {
+	return r.wait(ctx, func() (bool, error) {
+		return r.lastApplied >= index, nil
+	})
+}
+
+// number of voters, counting ourselves, that answered a heartbeat sent at or after t
+func (r *Raft) acksSinceLocked(t time.Time) int {
+	return r.countVotersLocked(func(p NodeID) bool { return !r.peerAck[p].Before(t) })
+}
+
+// the lease runs from the send time of the latest heartbeat a majority has
+// answered, we count as having answered just now
+func (r *Raft) leaseExpiryLocked() time.Time {
+	acks := make([]time.Time, 0, len(r.voters))
+	for _, v := range r.voters {
+		if v == r.id {
+			acks = append(acks, time.Now())
+		} else {
+			acks = append(acks, r.peerAck[v])
+		}
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i].After(acks[j]) })
+	return acks[r.quorum()-1].Add(leaseDuration)
+}
+
+// wait calls cond under r.mu every time the node makes progress until it
+// reports done or an error, or ctx ends
+func (r *Raft) wait(ctx context.Context, cond func() (bool, error)) error {
+	r.mu.Lock()
+	for {
+		if r.stopped {
+			r.mu.Unlock()
+			return ErrStopped
+		}
+		done, err := cond()
+		if done || err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		ch := r.notifyCh
+		r.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		r.mu.Lock()
+	}
+}
+
+// wake everyone blocked in wait
+func (r *Raft) notifyLocked() {
+	close(r.notifyCh)
+	r.notifyCh = make(chan struct{})
+}
@@ -1,63 +1,214 @@
 package raft
 
 import (
-    "context"
-    "time"
+	"context"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"time"
 
-    raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
 )
 
 func (r *Raft) RequestVote(ctx context.Context, req *raftpb.RequestVoteRequest) (*raftpb.RequestVoteResponse, error) {
-    r.mu.Lock()
-    defer r.mu.Unlock()
-
-    resp := &raftpb.RequestVoteResponse{Term: int32(r.term)}
-
-		// if incoming term is less than local term, deny vote, return current term
-    if int(req.Term) < r.term {
-        resp.VoteGranted = false
-        return resp, nil
-    }
-
-		// if incoming term is more than local term
-		// update term, clear voted for, become follower
-    if int(req.Term) > r.term {
-        r.term = int(req.Term)
-        r.votedFor = ""
-        r.state = Follower
-    }
-
-		// if haven't voted already
-		// grant vote and reset election timeout
-    if r.votedFor == "" || r.votedFor == NodeID(req.CandidateId) {
-        r.votedFor = NodeID(req.CandidateId)
-        resp.VoteGranted = true
-        r.electionReset = time.Now()
-        return resp, nil
-    }
-
-    resp.VoteGranted = false
-    return resp, nil
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.PreVote {
+		return r.preVoteLocked(req), nil
+	}
+
+	// if incoming term is less than local term, deny vote, return current term
+	if int(req.Term) < r.term {
+		return &raftpb.RequestVoteResponse{Term: int32(r.term), VoteGranted: false}, nil
+	}
+
+	// if incoming term is more than local term
+	// update term, clear voted for, become follower
+	if int(req.Term) > r.term {
+		r.becomeFollowerLocked(int(req.Term))
+	}
+
+	resp := &raftpb.RequestVoteResponse{Term: int32(r.term)}
+
+	// never vote for a candidate missing entries we have, it could
+	// overwrite committed data once elected
+	if !r.logUpToDateLocked(req.LastLogIndex, req.LastLogTerm) {
+		resp.VoteGranted = false
+		return resp, nil
+	}
+
+	// if haven't voted already
+	// grant vote and reset election timeout
+	if r.votedFor == "" || r.votedFor == NodeID(req.CandidateId) {
+		r.votedFor = NodeID(req.CandidateId)
+		r.persistHardStateLocked()
+		resp.VoteGranted = true
+		r.electionReset = time.Now()
+		return resp, nil
+	}
+
+	resp.VoteGranted = false
+	return resp, nil
+}
+
+// preVoteLocked answers a pre-vote: whether we would vote for the candidate
+// in req.Term. Nothing changes on our side, not even the election timer.
+func (r *Raft) preVoteLocked(req *raftpb.RequestVoteRequest) *raftpb.RequestVoteResponse {
+	resp := &raftpb.RequestVoteResponse{Term: int32(r.term)}
+
+	// we still hear from a live leader, so there is no reason for an
+	// election. This is what keeps a node with a flaky link from taking
+	// over, the rest of the cluster never agrees to replace the leader.
+	if r.state == Leader || (r.leaderID != "" && time.Since(r.electionReset) < electionTimeoutMin) {
+		return resp
+	}
+
+	resp.VoteGranted = int(req.Term) > r.term && r.logUpToDateLocked(req.LastLogIndex, req.LastLogTerm)
+	return resp
 }
 
 func (r *Raft) AppendEntries(ctx context.Context, req *raftpb.AppendEntriesRequest) (*raftpb.AppendEntriesResponse, error) {
-    r.mu.Lock()
-    defer r.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// if incoming term is less than local term, resp.Success = false
+	if int(req.Term) < r.term {
+		return &raftpb.AppendEntriesResponse{Term: int32(r.term), Success: false}, nil
+	}
+
+	// else become follower
+	r.becomeFollowerLocked(int(req.Term))
+	r.leaderID = NodeID(req.LeaderId)
+	r.electionReset = time.Now()
+
+	resp := &raftpb.AppendEntriesResponse{Term: int32(r.term)}
+
+	// the start of what the leader sent is already compacted into our
+	// snapshot, those entries are committed so they match, skip past them
+	if req.PrevLogIndex < r.snapIndex() {
+		entries := req.Entries
+		for len(entries) > 0 && entries[0].Index <= r.snapIndex() {
+			entries = entries[1:]
+		}
+		req = &raftpb.AppendEntriesRequest{
+			Term:         req.Term,
+			LeaderId:     req.LeaderId,
+			PrevLogIndex: r.snapIndex(),
+			PrevLogTerm:  r.log[0].Term,
+			Entries:      entries,
+			LeaderCommit: req.LeaderCommit,
+			GroupId:      req.GroupId,
+		}
+	}
+
+	// we are missing entries before the ones being sent
+	if req.PrevLogIndex > r.lastIndex() {
+		resp.ConflictIndex = r.lastIndex() + 1
+		return resp, nil
+	}
+
+	// our entry at prevLogIndex disagrees with the leader,
+	// point the leader at the first index of the conflicting term
+	if prev := r.entry(req.PrevLogIndex); prev.Term != req.PrevLogTerm {
+		idx := req.PrevLogIndex
+		for idx > r.commitIndex+1 && r.entry(idx-1).Term == prev.Term {
+			idx--
+		}
+		resp.ConflictIndex = idx
+		return resp, nil
+	}
+
+	// append new entries, dropping anything that conflicts with them
+	for i, e := range req.Entries {
+		if e.Index <= r.lastIndex() {
+			if r.entry(e.Index).Term == e.Term {
+				continue
+			}
+			r.truncateLocked(e.Index)
+		}
+		// entries must be on disk before we acknowledge them
+		r.persistEntriesLocked(req.Entries[i:])
+		r.log = append(r.log, req.Entries[i:]...)
+		// a new configuration counts from the moment it is in our log
+		if slices.ContainsFunc(req.Entries[i:], func(e *raftpb.LogEntry) bool {
+			return e.Type == raftpb.EntryType_ENTRY_CONFIG
+		}) {
+			r.reloadConfigLocked()
+		}
+		break
+	}
+
+	match := req.PrevLogIndex + uint64(len(req.Entries))
+	if commit := min(req.LeaderCommit, match); commit > r.commitIndex {
+		r.commitIndex = commit
+		r.applyCond.Broadcast()
+		r.notifyLocked()
+	}
+
+	resp.Success = true
+	resp.MatchIndex = match
+	return resp, nil
+}
+
+// InstallSnapshot receives a snapshot from the leader chunk by chunk into a
+// temp file, checking every chunk, and installs it once the last one is in
+func (r *Raft) InstallSnapshot(stream raftpb.Raft_InstallSnapshotServer) error {
+	f, err := r.createSnapshotFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var first *raftpb.InstallSnapshotRequest
+	var offset uint64
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "snapshot stream ended before the last chunk")
+		}
+		if err != nil {
+			return err
+		}
 
-    resp := &raftpb.AppendEntriesResponse{Term: int32(r.term)}
+		if first == nil {
+			// turn a stale leader away before it sends everything
+			r.mu.Lock()
+			term := r.term
+			r.mu.Unlock()
+			if int(req.Term) < term {
+				return stream.SendAndClose(&raftpb.InstallSnapshotResponse{Term: int32(term)})
+			}
+			first = req
+		}
 
-		// if incoming term is less than local term, resp.Success = false
-    if int(req.Term) < r.term {
-        resp.Success = false
-        return resp, nil
-    }
+		if req.Offset != offset {
+			return status.Errorf(codes.InvalidArgument, "snapshot chunk at offset %d, expected %d", req.Offset, offset)
+		}
+		if crc32.Checksum(req.Data, crcTable) != req.Checksum {
+			return status.Errorf(codes.DataLoss, "snapshot chunk at offset %d failed its checksum", req.Offset)
+		}
+		if _, err := f.Write(req.Data); err != nil {
+			return err
+		}
+		offset += uint64(len(req.Data))
 
-		// else become follower 
-    r.state = Follower
-    r.term = int(req.Term)
-    r.votedFor = NodeID(req.LeaderId)
-    r.electionReset = time.Now()
+		if req.Done {
+			break
+		}
+	}
 
-    resp.Success = true
-    return resp, nil
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := r.installSnapshot(first, f)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
 }
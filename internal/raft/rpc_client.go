@@ -1,78 +1,224 @@
 package raft
 
 import (
-    "context"
-    "time"
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
 
-    raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
-    "google.golang.org/grpc"
-    "google.golang.org/grpc/credentials/insecure"
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
 )
 
-// called when node becomes a candidate
-func (r *Raft) broadcastRequestVote(term int) {
-    for _, peer := range r.peers {
-        peerID := peer
-
-        if peerID == "" {
-            continue
-        }
-
-        go func() {
-            // give 300ms to create TCP connection and complete gRPC handshake
-            ctxDial, cancelDial := context.WithTimeout(context.Background(), 300*time.Millisecond)
-            conn, err := grpc.DialContext(ctxDial, string(peerID), grpc.WithTransportCredentials(insecure.NewCredentials()))
-            cancelDial()
-            if err != nil {
-                return
-            }
-            defer conn.Close()
-
-            client := raftpb.NewRaftClient(conn)
-
-						// give 400ms for the RPC to run
-            ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
-            defer cancel()
-
-            resp, err := client.RequestVote(ctx, &raftpb.RequestVoteRequest{
-                CandidateId: string(r.id),
-                Term:        int32(term),
-            })
-            if err != nil {
-                return
-            }
-
-            // safe state update
-            r.handleVoteResponse(resp)
-        }()
-    }
+// called when node becomes a candidate or pre-candidate, peers are the other
+// voters at that point
+func (r *Raft) broadcastRequestVote(req *raftpb.RequestVoteRequest, peers []NodeID) {
+	for _, peer := range peers {
+		peerID := peer
+
+		if peerID == "" {
+			continue
+		}
+
+		r.spawn(func() {
+			// give 400ms for the RPC to run
+			ctx, cancel := context.WithTimeout(r.ctx, 400*time.Millisecond)
+			defer cancel()
+
+			resp, err := r.transport.RequestVote(ctx, peerID, req)
+			if err != nil {
+				return
+			}
+
+			// safe state update
+			if req.PreVote {
+				r.handlePreVoteResponse(int(req.Term), resp)
+			} else {
+				r.handleVoteResponse(int(req.Term), resp)
+			}
+		})
+	}
 }
 
+// sendHeartbeats sends every peer the entries it is missing, or an
+// empty AppendEntries when it is caught up
 func (r *Raft) sendHeartbeats() {
-    for _, peer := range r.peers {
-        peerID := peer
-        go func() {
-            if peerID == "" {
-                return
-            }
-
-            ctxDial, cancelDial := context.WithTimeout(context.Background(), 300*time.Millisecond)
-            conn, err := grpc.DialContext(ctxDial, string(peerID), grpc.WithTransportCredentials(insecure.NewCredentials()))
-            cancelDial()
-            if err != nil {
-                return
-            }
-            defer conn.Close()
-
-            client := raftpb.NewRaftClient(conn)
-
-            ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
-            defer cancel()
-
-            client.AppendEntries(ctx, &raftpb.AppendEntriesRequest{
-                Term:     int32(r.term),
-                LeaderId: string(r.id),
-            })
-        }()
-    }
+	r.mu.Lock()
+	if r.state != Leader {
+		r.mu.Unlock()
+		return
+	}
+	reqs := make(map[NodeID]*raftpb.AppendEntriesRequest, len(r.peers))
+	for _, peer := range r.peers {
+		// the entries this peer needs next are gone from our log, send it a
+		// snapshot once it has shown it is up by answering a probe
+		if r.nextIndex[peer] <= r.snapIndex() && !r.snapshotting[peer] &&
+			time.Since(r.peerAck[peer]) < electionTimeoutMin {
+			r.snapshotting[peer] = true
+			peerID, term := peer, r.term
+			r.spawn(func() { r.sendSnapshot(peerID, term) })
+		}
+		reqs[peer] = r.appendRequestLocked(peer)
+	}
+	r.mu.Unlock()
+	sent := time.Now()
+
+	for peer, req := range reqs {
+		peerID, req := peer, req
+		r.spawn(func() {
+			ctx, cancel := context.WithTimeout(r.ctx, 200*time.Millisecond)
+			defer cancel()
+
+			resp, err := r.transport.AppendEntries(ctx, peerID, req)
+			if err != nil {
+				return
+			}
+			r.handleAppendResponse(peerID, req, resp, sent)
+		})
+	}
+}
+
+// build the AppendEntries request for a peer starting at its nextIndex
+func (r *Raft) appendRequestLocked(peer NodeID) *raftpb.AppendEntriesRequest {
+	next := r.nextIndex[peer]
+
+	// the peer needs entries we compacted away, probe it at the snapshot
+	// point instead. That keeps it following us while a snapshot is on its
+	// way, and catches peers that turn out to have the entries after all.
+	probe := next <= r.snapIndex()
+	if probe {
+		next = r.snapIndex() + 1
+	}
+	prev := r.entry(next - 1)
+
+	var entries []*raftpb.LogEntry
+	if last := r.lastIndex(); !probe && next <= last {
+		end := min(last, next+maxEntriesPerAppend-1)
+		entries = make([]*raftpb.LogEntry, 0, end-next+1)
+		for i := next; i <= end; i++ {
+			entries = append(entries, r.entry(i))
+		}
+	}
+
+	return &raftpb.AppendEntriesRequest{
+		Term:         int32(r.term),
+		LeaderId:     string(r.id),
+		PrevLogIndex: prev.Index,
+		PrevLogTerm:  prev.Term,
+		Entries:      entries,
+		LeaderCommit: r.commitIndex,
+		GroupId:      r.group,
+	}
+}
+
+func (r *Raft) handleAppendResponse(peer NodeID, req *raftpb.AppendEntriesRequest, resp *raftpb.AppendEntriesResponse, sent time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// a newer term exists, we are no longer leader
+	if int(resp.Term) > r.term {
+		r.becomeFollowerLocked(int(resp.Term))
+		return
+	}
+
+	// stale response from an earlier term
+	if r.state != Leader || int(req.Term) != r.term {
+		return
+	}
+
+	// success or not, the peer still accepts us as leader as of sent
+	if sent.After(r.peerAck[peer]) {
+		r.peerAck[peer] = sent
+		r.notifyLocked()
+	}
+
+	if resp.Success {
+		if resp.MatchIndex > r.matchIndex[peer] {
+			r.matchIndex[peer] = resp.MatchIndex
+			r.advanceCommitLocked()
+		}
+		r.nextIndex[peer] = r.matchIndex[peer] + 1
+		// keep going if the follower is still behind
+		if r.nextIndex[peer] <= r.lastIndex() {
+			r.triggerReplication()
+		}
+		return
+	}
+
+	// back off to the follower's hint and try again straight away
+	next := max(resp.ConflictIndex, r.matchIndex[peer]+1, 1)
+	if next < r.nextIndex[peer] {
+		r.nextIndex[peer] = next
+		r.triggerReplication()
+	}
+}
+
+// sendSnapshot streams a fresh snapshot of the state machine to a peer that
+// is too far behind to catch up from the log
+func (r *Raft) sendSnapshot(peer NodeID, term int) {
+	ok := false
+	defer func() {
+		// don't hammer a peer that is down or failing to install
+		if !ok {
+			select {
+			case <-time.After(snapshotRetryDelay):
+			case <-r.ctx.Done():
+			}
+		}
+		r.mu.Lock()
+		if r.term == term {
+			delete(r.snapshotting, peer)
+		}
+		r.mu.Unlock()
+	}()
+
+	f, err := r.createSnapshotFile()
+	if err != nil {
+		log.Printf("[raft] %s failed to create snapshot file: %v", r.name, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	index, snapTerm, err := r.sm.Snapshot(f)
+	if err != nil {
+		log.Printf("[raft] %s failed to snapshot: %v", r.name, err)
+		return
+	}
+
+	// the peer needs the configuration as of the snapshot too, which we
+	// can only tell while the log still reaches back that far
+	r.mu.Lock()
+	if index < r.snapIndex() {
+		r.mu.Unlock()
+		log.Printf("[raft] %s snapshot at index %d fell behind the log, retrying", r.name, index)
+		return
+	}
+	config, _ := r.configAtLocked(index)
+	r.mu.Unlock()
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("[raft] %s failed to rewind snapshot: %v", r.name, err)
+		return
+	}
+	log.Printf("[raft] %s sending snapshot at index %d to %s", r.name, index, peer)
+
+	ctx, cancel := context.WithTimeout(r.ctx, snapshotTimeout)
+	defer cancel()
+
+	req := &raftpb.InstallSnapshotRequest{
+		Term:              int32(term),
+		LeaderId:          string(r.id),
+		LastIncludedIndex: index,
+		LastIncludedTerm:  snapTerm,
+		Config:            config,
+		GroupId:           r.group,
+	}
+	resp, err := r.transport.InstallSnapshot(ctx, peer, req, f)
+	if err != nil {
+		log.Printf("[raft] %s failed to send snapshot to %s: %v", r.name, peer, err)
+		return
+	}
+	ok = true
+	r.handleSnapshotResponse(peer, term, index, resp)
 }
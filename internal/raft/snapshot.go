@@ -0,0 +1,147 @@
+package raft
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// snapshots travel in chunks of this size
+const snapshotChunkSize = 1 << 20
+
+// an InstallSnapshot stream may run this long, snapshots can be large
+const snapshotTimeout = 10 * time.Minute
+
+// wait this long before trying a peer again after a failed transfer
+const snapshotRetryDelay = time.Second
+
+// snapshots are staged in files named like this while sent or received
+const snapshotPattern = "mimori-snapshot-*"
+
+// createSnapshotFile creates a file to stage a snapshot in, the caller
+// removes it once done
+func (r *Raft) createSnapshotFile() (*os.File, error) {
+	return os.CreateTemp(r.snapshotDir, snapshotPattern)
+}
+
+// cleanSnapshotDir creates dir if needed and removes the snapshot files
+// transfers cut short by a crash left in it
+func cleanSnapshotDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	leftovers, err := filepath.Glob(filepath.Join(dir, snapshotPattern))
+	if err != nil {
+		return err
+	}
+	for _, f := range leftovers {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maybeCompactLocked drops applied entries from the log once enough have
+// piled up. The state machine already holds them durably, a follower that
+// still needs them gets a snapshot instead.
+func (r *Raft) maybeCompactLocked() {
+	if r.lastApplied-r.snapIndex() < r.compactThreshold {
+		return
+	}
+	index := r.lastApplied - r.compactTrailing
+	config, _ := r.configAtLocked(index)
+	meta := &raftpb.SnapshotMeta{Index: index, Term: r.entry(index).Term, Config: config}
+	if err := r.storage.Compact(meta); err != nil {
+		log.Fatalf("[raft] %s failed to compact log: %v", r.name, err)
+	}
+	r.snapConfig = config
+	r.log = append([]*raftpb.LogEntry{{Index: meta.Index, Term: meta.Term}}, r.log[index-r.snapIndex()+1:]...)
+}
+
+// installSnapshot replaces the state machine with a snapshot sent by the
+// leader in req and rebuilds the log around it
+func (r *Raft) installSnapshot(req *raftpb.InstallSnapshotRequest, data io.Reader) (*raftpb.InstallSnapshotResponse, error) {
+	// keep the applier out until the log matches the new state
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.Lock()
+	if int(req.Term) < r.term {
+		defer r.mu.Unlock()
+		return &raftpb.InstallSnapshotResponse{Term: int32(r.term)}, nil
+	}
+	r.becomeFollowerLocked(int(req.Term))
+	r.leaderID = NodeID(req.LeaderId)
+	r.electionReset = time.Now()
+
+	// we got this far on our own in the meantime
+	if req.LastIncludedIndex <= r.lastApplied {
+		defer r.mu.Unlock()
+		return &raftpb.InstallSnapshotResponse{Term: int32(r.term)}, nil
+	}
+	r.installing = true
+	r.mu.Unlock()
+
+	log.Printf("[raft] %s installing snapshot at index %d from %s", r.name, req.LastIncludedIndex, req.LeaderId)
+	err := r.sm.Restore(data)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.installing = false
+	r.electionReset = time.Now()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &raftpb.SnapshotMeta{Index: req.LastIncludedIndex, Term: req.LastIncludedTerm, Config: req.Config}
+	if meta.Index <= r.lastIndex() && r.entry(meta.Index).Term == meta.Term {
+		// our log agrees with the snapshot, keep whatever follows it
+		if err := r.storage.Compact(meta); err != nil {
+			log.Fatalf("[raft] %s failed to compact log: %v", r.name, err)
+		}
+		r.log = append([]*raftpb.LogEntry{{Index: meta.Index, Term: meta.Term}}, r.log[meta.Index-r.snapIndex()+1:]...)
+	} else {
+		// anything we have past the snapshot is from a different history
+		if meta.Index < r.lastIndex() {
+			r.truncateLocked(meta.Index + 1)
+		}
+		if err := r.storage.Reset(meta); err != nil {
+			log.Fatalf("[raft] %s failed to reset log: %v", r.name, err)
+		}
+		r.log = []*raftpb.LogEntry{{Index: meta.Index, Term: meta.Term}}
+	}
+	r.snapConfig = meta.Config
+	r.reloadConfigLocked()
+
+	r.lastApplied = meta.Index
+	r.commitIndex = max(r.commitIndex, meta.Index)
+	r.applyCond.Broadcast()
+	r.notifyLocked()
+	return &raftpb.InstallSnapshotResponse{Term: int32(r.term)}, nil
+}
+
+func (r *Raft) handleSnapshotResponse(peer NodeID, term int, index uint64, resp *raftpb.InstallSnapshotResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if int(resp.Term) > r.term {
+		r.becomeFollowerLocked(int(resp.Term))
+		return
+	}
+	if r.state != Leader || r.term != term {
+		return
+	}
+
+	// the peer holds everything up to index now, carry on from the log
+	if index > r.matchIndex[peer] {
+		r.matchIndex[peer] = index
+		r.advanceCommitLocked()
+	}
+	r.nextIndex[peer] = r.matchIndex[peer] + 1
+	r.triggerReplication()
+}
@@ -0,0 +1,39 @@
+package raft
+
+import (
+	"io"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// StateMachine is the application that committed log entries are applied to.
+// Every node applies the same entries in the same order, so every node ends
+// up with the same state.
+type StateMachine interface {
+	// Apply applies a committed entry. The returned value is handed back to
+	// the caller of Propose on the node that proposed it. Entries that carry
+	// no command (e.g. no-ops) are passed too, so Applied keeps up with the log.
+	Apply(entry *raftpb.LogEntry) interface{}
+
+	// Applied returns the index and term of the last entry applied.
+	// It must be durable together with the state, so a restarted node
+	// does not apply the same entry twice.
+	Applied() (index uint64, term int32, err error)
+
+	// Snapshot writes a consistent image of the state to w and returns the
+	// index and term of the last entry it includes.
+	Snapshot(w io.Writer) (index uint64, term int32, err error)
+
+	// Restore replaces the state with a snapshot written by Snapshot,
+	// possibly on another node. It must be atomic: after a crash the state
+	// is either the old one or the new one.
+	Restore(r io.Reader) error
+}
+
+// BatchStateMachine is a StateMachine that takes every entry committed
+// together at once, so it can make them durable together too. ApplyBatch
+// returns what Apply would have for each entry, in order.
+type BatchStateMachine interface {
+	StateMachine
+	ApplyBatch(entries []*raftpb.LogEntry) []interface{}
+}
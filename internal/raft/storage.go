@@ -0,0 +1,237 @@
+package raft
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/protobuf/proto"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// Storage persists the hard state and log, so a restarted node remembers
+// who it voted for and every entry it acknowledged. Writes must be durable
+// before they return.
+type Storage interface {
+	// Load returns the saved hard state, the last snapshot the log was
+	// compacted to and the log entries after it in index order
+	Load() (*raftpb.HardState, *raftpb.SnapshotMeta, []*raftpb.LogEntry, error)
+
+	SetHardState(hs *raftpb.HardState) error
+
+	// Append saves entries, first dropping any saved entry at or after entries[0].Index
+	Append(entries []*raftpb.LogEntry) error
+
+	// Compact drops every entry up to and including meta.Index, which the
+	// state machine already holds, and records meta as the new log start
+	Compact(meta *raftpb.SnapshotMeta) error
+
+	// Reset drops the whole log after a snapshot from the leader replaced
+	// the state machine, the log restarts after meta
+	Reset(meta *raftpb.SnapshotMeta) error
+
+	Close() error
+}
+
+// pebble keys, log entries are ordered by big endian index
+var (
+	hardStateKey = []byte("h")
+	snapshotKey  = []byte("s")
+	logPrefix    = []byte("l")
+)
+
+// PebbleStorage keeps raft state in its own pebble db, separate from the
+// user data so the two can be managed independently
+type PebbleStorage struct {
+	db *pebble.DB
+}
+
+func OpenPebbleStorage(path string) (*PebbleStorage, error) {
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &PebbleStorage{db: db}, nil
+}
+
+func logKey(index uint64) []byte {
+	k := make([]byte, len(logPrefix)+8)
+	copy(k, logPrefix)
+	binary.BigEndian.PutUint64(k[len(logPrefix):], index)
+	return k
+}
+
+func (s *PebbleStorage) Load() (*raftpb.HardState, *raftpb.SnapshotMeta, []*raftpb.LogEntry, error) {
+	hs := &raftpb.HardState{}
+	if err := s.get(hardStateKey, hs); err != nil {
+		return nil, nil, nil, err
+	}
+	meta := &raftpb.SnapshotMeta{}
+	if err := s.get(snapshotKey, meta); err != nil {
+		return nil, nil, nil, err
+	}
+
+	iter, err := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: logKey(meta.Index + 1),
+		UpperBound: []byte{logPrefix[0] + 1},
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer iter.Close()
+
+	var entries []*raftpb.LogEntry
+	for iter.First(); iter.Valid(); iter.Next() {
+		e := &raftpb.LogEntry{}
+		if err := proto.Unmarshal(iter.Value(), e); err != nil {
+			return nil, nil, nil, err
+		}
+		entries = append(entries, e)
+	}
+	return hs, meta, entries, iter.Error()
+}
+
+// get unmarshals the value at key into m, leaving m empty if there is none
+func (s *PebbleStorage) get(key []byte, m proto.Message) error {
+	v, closer, err := s.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	return proto.Unmarshal(v, m)
+}
+
+func (s *PebbleStorage) SetHardState(hs *raftpb.HardState) error {
+	data, err := proto.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(hardStateKey, data, pebble.Sync)
+}
+
+func (s *PebbleStorage) Append(entries []*raftpb.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	b := s.db.NewBatch()
+	defer b.Close()
+
+	// anything from the first new index onwards is being replaced
+	if err := b.DeleteRange(logKey(entries[0].Index), []byte{logPrefix[0] + 1}, nil); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		data, err := proto.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := b.Set(logKey(e.Index), data, nil); err != nil {
+			return err
+		}
+	}
+	return b.Commit(pebble.Sync)
+}
+
+func (s *PebbleStorage) Compact(meta *raftpb.SnapshotMeta) error {
+	return s.truncate(meta, logKey(meta.Index+1))
+}
+
+func (s *PebbleStorage) Reset(meta *raftpb.SnapshotMeta) error {
+	return s.truncate(meta, []byte{logPrefix[0] + 1})
+}
+
+// record meta and delete log entries below end in one batch
+func (s *PebbleStorage) truncate(meta *raftpb.SnapshotMeta, end []byte) error {
+	data, err := proto.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	b := s.db.NewBatch()
+	defer b.Close()
+
+	if err := b.Set(snapshotKey, data, nil); err != nil {
+		return err
+	}
+	if err := b.DeleteRange(logKey(0), end, nil); err != nil {
+		return err
+	}
+	return b.Commit(pebble.Sync)
+}
+
+func (s *PebbleStorage) Close() error {
+	return s.db.Close()
+}
+
+// MemoryStorage keeps everything in memory, useful for tests
+type MemoryStorage struct {
+	mu      sync.Mutex
+	hs      *raftpb.HardState
+	meta    *raftpb.SnapshotMeta
+	entries []*raftpb.LogEntry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{hs: &raftpb.HardState{}, meta: &raftpb.SnapshotMeta{}}
+}
+
+func (s *MemoryStorage) Load() (*raftpb.HardState, *raftpb.SnapshotMeta, []*raftpb.LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hs := proto.Clone(s.hs).(*raftpb.HardState)
+	meta := proto.Clone(s.meta).(*raftpb.SnapshotMeta)
+	return hs, meta, append([]*raftpb.LogEntry(nil), s.entries...), nil
+}
+
+func (s *MemoryStorage) SetHardState(hs *raftpb.HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hs = proto.Clone(hs).(*raftpb.HardState)
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []*raftpb.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := entries[0].Index
+	keep := 0
+	for keep < len(s.entries) && s.entries[keep].Index < first {
+		keep++
+	}
+	s.entries = append(s.entries[:keep], entries...)
+	return nil
+}
+
+func (s *MemoryStorage) Compact(meta *raftpb.SnapshotMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drop := 0
+	for drop < len(s.entries) && s.entries[drop].Index <= meta.Index {
+		drop++
+	}
+	s.entries = append([]*raftpb.LogEntry(nil), s.entries[drop:]...)
+	s.meta = proto.Clone(meta).(*raftpb.SnapshotMeta)
+	return nil
+}
+
+func (s *MemoryStorage) Reset(meta *raftpb.SnapshotMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = nil
+	s.meta = proto.Clone(meta).(*raftpb.SnapshotMeta)
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"testing"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+func TestPebbleStorageReload(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenPebbleStorage(dir)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	if err := s.SetHardState(&raftpb.HardState{Term: 3, VotedFor: ":4001"}); err != nil {
+		t.Fatalf("set hard state failed: %v", err)
+	}
+	err = s.Append([]*raftpb.LogEntry{
+		{Index: 1, Term: 1, Data: []byte("a")},
+		{Index: 2, Term: 1, Data: []byte("b")},
+		{Index: 3, Term: 2, Data: []byte("c")},
+	})
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	// a conflicting entry at index 2 replaces everything after it
+	if err := s.Append([]*raftpb.LogEntry{{Index: 2, Term: 3, Data: []byte("x")}}); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	s, err = OpenPebbleStorage(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	hs, _, entries, err := s.Load()
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if hs.Term != 3 || hs.VotedFor != ":4001" {
+		t.Fatalf("unexpected hard state %v", hs)
+	}
+	if len(entries) != 2 || entries[1].Index != 2 || entries[1].Term != 3 || string(entries[1].Data) != "x" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
+
+func TestPebbleStorageCompact(t *testing.T) {
+	s, err := OpenPebbleStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer s.Close()
+
+	err = s.Append([]*raftpb.LogEntry{
+		{Index: 1, Term: 1},
+		{Index: 2, Term: 1},
+		{Index: 3, Term: 2},
+	})
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+
+	if err := s.Compact(&raftpb.SnapshotMeta{Index: 2, Term: 1}); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	_, meta, entries, err := s.Load()
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if meta.Index != 2 || meta.Term != 1 {
+		t.Fatalf("unexpected snapshot meta %v", meta)
+	}
+	if len(entries) != 1 || entries[0].Index != 3 {
+		t.Fatalf("expected only entry 3 to survive, got %v", entries)
+	}
+
+	// a snapshot from the leader replaces the whole log
+	if err := s.Reset(&raftpb.SnapshotMeta{Index: 10, Term: 4}); err != nil {
+		t.Fatalf("reset failed: %v", err)
+	}
+	_, meta, entries, err = s.Load()
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if meta.Index != 10 || len(entries) != 0 {
+		t.Fatalf("expected an empty log after 10, got meta %v entries %v", meta, entries)
+	}
+}
@@ -0,0 +1,108 @@
+package raft
+
+import (
+	"context"
+	"log"
+	"time"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// a transfer that has not completed by then is abandoned and the leader
+// takes proposals again, keeping the write outage short either way
+const transferTimeout = 4 * electionTimeoutMin
+
+// TransferLeadership hands leadership to target. The leader stops taking
+// proposals, brings target's log up to date and then tells it to start an
+// election right away, which it wins with an up to date log. Returns once
+// the new leader is known, or with an error if the transfer did not happen
+// in time, in which case we carry on as leader.
+func (r *Raft) TransferLeadership(ctx context.Context, target NodeID) error {
+	r.mu.Lock()
+	switch {
+	case r.stopped:
+		r.mu.Unlock()
+		return ErrStopped
+	case r.state != Leader:
+		r.mu.Unlock()
+		return ErrNotLeader
+	case target == r.id:
+		r.mu.Unlock()
+		return nil
+	case !r.isVoterLocked(target):
+		r.mu.Unlock()
+		return ErrUnknownNode
+	case r.transferee != "":
+		r.mu.Unlock()
+		return ErrTransferInProgress
+	}
+	r.transferee = target
+	term := r.term
+	r.mu.Unlock()
+
+	log.Printf("[raft] %s transferring leadership to %s", r.name, target)
+	defer func() {
+		r.mu.Lock()
+		if r.transferee == target && r.term == term {
+			r.transferee = ""
+		}
+		r.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, transferTimeout)
+	defer cancel()
+
+	// wait for target to hold every entry we have
+	r.triggerReplication()
+	err := r.wait(ctx, func() (bool, error) {
+		if r.state != Leader || r.term != term {
+			return false, ErrNotLeader
+		}
+		return r.matchIndex[target] == r.lastIndex(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// target may win an election from here on, even if we never hear back,
+	// while our lease still has a while to run
+	r.mu.Lock()
+	if r.state != Leader || r.term != term {
+		r.mu.Unlock()
+		return ErrNotLeader
+	}
+	r.handedOff = true
+	r.mu.Unlock()
+
+	resp, err := r.transport.TimeoutNow(ctx, target, &raftpb.TimeoutNowRequest{Term: int32(term), LeaderId: string(r.id), GroupId: r.group})
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if int(resp.Term) > r.term {
+		r.becomeFollowerLocked(int(resp.Term))
+	}
+	r.mu.Unlock()
+
+	// target's vote request moves us to its term, we are done once we hear
+	// from whoever won it
+	return r.wait(ctx, func() (bool, error) {
+		return r.term != term && r.leaderID != "", nil
+	})
+}
+
+// TimeoutNow starts an election straight away at the leader's request,
+// skipping the pre-vote since the leader is stepping aside for us
+func (r *Raft) TimeoutNow(ctx context.Context, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// only the leader of our current term may ask
+	if int(req.Term) != r.term || r.state == Leader || r.stopped || !r.isVoterLocked(r.id) {
+		return &raftpb.TimeoutNowResponse{Term: int32(r.term)}, nil
+	}
+	log.Printf("[raft] %s taking over leadership from %s", r.name, req.LeaderId)
+	r.electionReset = time.Now()
+	r.startElectionLocked()
+	return &raftpb.TimeoutNowResponse{Term: int32(r.term)}, nil
+}
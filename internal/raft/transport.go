@@ -0,0 +1,185 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/protobuf/proto"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// Transport carries raft messages to other nodes. Calls block until the
+// peer answered or ctx ends, an error means the message may or may not
+// have arrived.
+type Transport interface {
+	RequestVote(ctx context.Context, to NodeID, req *raftpb.RequestVoteRequest) (*raftpb.RequestVoteResponse, error)
+
+	AppendEntries(ctx context.Context, to NodeID, req *raftpb.AppendEntriesRequest) (*raftpb.AppendEntriesResponse, error)
+
+	// InstallSnapshot sends the snapshot read from data. Only the header
+	// fields of req (everything but offset, data, checksum and done) are
+	// set, the transport takes care of chunking.
+	InstallSnapshot(ctx context.Context, to NodeID, req *raftpb.InstallSnapshotRequest, data io.Reader) (*raftpb.InstallSnapshotResponse, error)
+
+	TimeoutNow(ctx context.Context, to NodeID, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error)
+
+	// Close releases any connections, nothing can be sent afterwards
+	Close() error
+}
+
+// checksums on snapshot chunks
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// GRPCTransport talks to peers through the Raft gRPC service, peers are
+// addressed by their NodeID. It keeps one long-lived connection per peer,
+// grpc reconnects it in the background with backoff when the peer goes away.
+type GRPCTransport struct {
+	mu     sync.Mutex
+	conns  map[NodeID]*grpc.ClientConn
+	closed bool
+}
+
+var _ Transport = (*GRPCTransport)(nil)
+
+var errTransportClosed = errors.New("raft: transport closed")
+
+// connections ping idle peers so a dead one is noticed before the next
+// election needs it, servers must allow pings this often (see api.ListenAndServe)
+const (
+	keepaliveTime    = 10 * time.Second
+	keepaliveTimeout = 3 * time.Second
+)
+
+// reconnect quickly, a peer coming back should rejoin within a few heartbeats
+var reconnectBackoff = backoff.Config{
+	BaseDelay:  100 * time.Millisecond,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+	MaxDelay:   2 * time.Second,
+}
+
+func NewGRPCTransport() *GRPCTransport {
+	return &GRPCTransport{conns: make(map[NodeID]*grpc.ClientConn)}
+}
+
+// client returns a client on the pooled connection to a peer, creating the
+// connection on first use
+func (t *GRPCTransport) client(to NodeID) (raftpb.RaftClient, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, errTransportClosed
+	}
+	if conn, ok := t.conns[to]; ok {
+		return raftpb.NewRaftClient(conn), nil
+	}
+
+	conn, err := grpc.NewClient(string(to),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepaliveTime,
+			Timeout:             keepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           reconnectBackoff,
+			MinConnectTimeout: time.Second,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// start connecting now rather than on the first call
+	conn.Connect()
+	t.conns[to] = conn
+	return raftpb.NewRaftClient(conn), nil
+}
+
+// Close shuts down every connection, later calls fail
+func (t *GRPCTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	var first error
+	for id, conn := range t.conns {
+		if err := conn.Close(); err != nil && first == nil {
+			first = err
+		}
+		delete(t.conns, id)
+	}
+	return first
+}
+
+func (t *GRPCTransport) RequestVote(ctx context.Context, to NodeID, req *raftpb.RequestVoteRequest) (*raftpb.RequestVoteResponse, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+	return client.RequestVote(ctx, req)
+}
+
+func (t *GRPCTransport) AppendEntries(ctx context.Context, to NodeID, req *raftpb.AppendEntriesRequest) (*raftpb.AppendEntriesResponse, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+	return client.AppendEntries(ctx, req)
+}
+
+func (t *GRPCTransport) TimeoutNow(ctx context.Context, to NodeID, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+	return client.TimeoutNow(ctx, req)
+}
+
+func (t *GRPCTransport) InstallSnapshot(ctx context.Context, to NodeID, req *raftpb.InstallSnapshotRequest, data io.Reader) (*raftpb.InstallSnapshotResponse, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := client.InstallSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset uint64
+	for {
+		// grpc may hold on to a sent message, so every chunk gets its own buffer
+		buf := make([]byte, snapshotChunkSize)
+		n, err := io.ReadFull(data, buf)
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			return nil, err
+		}
+
+		// every chunk repeats the header
+		chunk := proto.Clone(req).(*raftpb.InstallSnapshotRequest)
+		chunk.Offset = offset
+		chunk.Data = buf[:n]
+		chunk.Checksum = crc32.Checksum(buf[:n], crcTable)
+		chunk.Done = done
+		err = stream.Send(chunk)
+		if err != nil {
+			break // the real error comes out of CloseAndRecv
+		}
+		offset += uint64(n)
+		if done {
+			break
+		}
+	}
+	return stream.CloseAndRecv()
+}
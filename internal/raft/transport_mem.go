@@ -0,0 +1,224 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+var errUnreachable = errors.New("raft: node unreachable")
+
+// MemNetwork connects nodes running in one process, so clusters can be
+// tested inside go test. Faults are injected at random from a seeded
+// source: messages can be dropped, delayed (which also reorders them),
+// duplicated, or cut off by a partition.
+type MemNetwork struct {
+	mu    sync.Mutex
+	rand  *rand.Rand
+	nodes map[NodeID]*Raft
+	group map[NodeID]int // nodes only reach nodes in the same group
+
+	dropRate float64
+	dupRate  float64
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		rand:  rand.New(rand.NewSource(seed)),
+		nodes: make(map[NodeID]*Raft),
+		group: make(map[NodeID]int),
+	}
+}
+
+// Transport returns the transport node id sends through
+func (n *MemNetwork) Transport(id NodeID) Transport {
+	return &memTransport{net: n, from: id}
+}
+
+// Add connects a node so it receives messages sent to id
+func (n *MemNetwork) Add(id NodeID, r *Raft) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[id] = r
+}
+
+// Remove disconnects a node, as if it crashed
+func (n *MemNetwork) Remove(id NodeID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.nodes, id)
+}
+
+// Partition splits the network so nodes only reach others in the same
+// group. Nodes not named in any group form one more group together.
+func (n *MemNetwork) Partition(groups ...[]NodeID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.group = make(map[NodeID]int)
+	for i, g := range groups {
+		for _, id := range g {
+			n.group[id] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition
+func (n *MemNetwork) Heal() {
+	n.Partition()
+}
+
+// SetDropRate makes each request and each response get lost with probability p
+func (n *MemNetwork) SetDropRate(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate = p
+}
+
+// SetDuplicateRate makes each request get delivered a second time with probability p
+func (n *MemNetwork) SetDuplicateRate(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dupRate = p
+}
+
+// SetDelay holds every delivery back for a random time between min and max
+func (n *MemNetwork) SetDelay(min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.minDelay, n.maxDelay = min, max
+}
+
+func (n *MemNetwork) reachableLocked(from, to NodeID) bool {
+	_, ok := n.nodes[to]
+	return ok && n.group[from] == n.group[to]
+}
+
+func (n *MemNetwork) delayLocked() time.Duration {
+	if n.maxDelay <= n.minDelay {
+		return n.minDelay
+	}
+	return n.minDelay + time.Duration(n.rand.Int63n(int64(n.maxDelay-n.minDelay)))
+}
+
+type delivery struct {
+	resp proto.Message
+	err  error
+}
+
+// send hands a message to the node at to after the configured delay and
+// waits for its answer on a channel. handle is called once per delivery,
+// so a duplicated message is handled twice.
+func (n *MemNetwork) send(ctx context.Context, from, to NodeID, handle func(*Raft) (proto.Message, error)) (proto.Message, error) {
+	n.mu.Lock()
+	dst := n.nodes[to]
+	lost := !n.reachableLocked(from, to) || n.rand.Float64() < n.dropRate
+	lostResp := n.rand.Float64() < n.dropRate
+	dup := n.rand.Float64() < n.dupRate
+	delay, dupDelay := n.delayLocked(), n.delayLocked()
+	n.mu.Unlock()
+
+	if lost {
+		return nil, errUnreachable
+	}
+
+	deliver := func(d time.Duration) (proto.Message, error) {
+		time.Sleep(d)
+		// a partition may have come up while the message was in flight
+		n.mu.Lock()
+		ok := n.reachableLocked(from, to)
+		n.mu.Unlock()
+		if !ok {
+			return nil, errUnreachable
+		}
+		return handle(dst)
+	}
+
+	if dup {
+		go deliver(dupDelay)
+	}
+
+	ch := make(chan delivery, 1)
+	go func() {
+		resp, err := deliver(delay)
+		switch {
+		case err != nil:
+			ch <- delivery{err: err}
+		case lostResp:
+			ch <- delivery{err: errUnreachable}
+		default:
+			ch <- delivery{resp: proto.Clone(resp)}
+		}
+	}()
+
+	select {
+	case d := <-ch:
+		return d.resp, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// memTransport sends on behalf of one node, every delivery gets its own
+// copy of the request so nodes never share messages
+type memTransport struct {
+	net  *MemNetwork
+	from NodeID
+}
+
+func (t *memTransport) RequestVote(ctx context.Context, to NodeID, req *raftpb.RequestVoteRequest) (*raftpb.RequestVoteResponse, error) {
+	resp, err := t.net.send(ctx, t.from, to, func(r *Raft) (proto.Message, error) {
+		return r.RequestVote(ctx, proto.Clone(req).(*raftpb.RequestVoteRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*raftpb.RequestVoteResponse), nil
+}
+
+func (t *memTransport) AppendEntries(ctx context.Context, to NodeID, req *raftpb.AppendEntriesRequest) (*raftpb.AppendEntriesResponse, error) {
+	resp, err := t.net.send(ctx, t.from, to, func(r *Raft) (proto.Message, error) {
+		return r.AppendEntries(ctx, proto.Clone(req).(*raftpb.AppendEntriesRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*raftpb.AppendEntriesResponse), nil
+}
+
+func (t *memTransport) TimeoutNow(ctx context.Context, to NodeID, req *raftpb.TimeoutNowRequest) (*raftpb.TimeoutNowResponse, error) {
+	resp, err := t.net.send(ctx, t.from, to, func(r *Raft) (proto.Message, error) {
+		return r.TimeoutNow(ctx, proto.Clone(req).(*raftpb.TimeoutNowRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*raftpb.TimeoutNowResponse), nil
+}
+
+func (t *memTransport) InstallSnapshot(ctx context.Context, to NodeID, req *raftpb.InstallSnapshotRequest, data io.Reader) (*raftpb.InstallSnapshotResponse, error) {
+	snap, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.net.send(ctx, t.from, to, func(r *Raft) (proto.Message, error) {
+		return r.installSnapshot(proto.Clone(req).(*raftpb.InstallSnapshotRequest), bytes.NewReader(snap))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*raftpb.InstallSnapshotResponse), nil
+}
+
+func (t *memTransport) Close() error {
+	return nil
+}
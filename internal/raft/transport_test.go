@@ -0,0 +1,92 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	raftpb "github.com/jerkeyray/mimori/internal/raft/raftpb"
+)
+
+// a snapshot of several chunks sent over real gRPC arrives whole, with the
+// configuration the header carries, and leaves no staging file behind
+func TestGRPCInstallSnapshot(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	id := NodeID(l.Addr().String())
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	sm := &memSM{}
+	follower, err := New(Config{
+		ID:           id,
+		Join:         true,
+		StateMachine: sm,
+		Storage:      NewMemoryStorage(),
+		Transport:    NewMemNetwork(1).Transport(id),
+		SnapshotDir:  dir,
+	})
+	if err != nil {
+		t.Fatalf("new raft failed: %v", err)
+	}
+	srv := grpc.NewServer()
+	raftpb.RegisterRaftServer(srv, follower)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	// big enough to take a few chunks
+	leaderSM := &memSM{}
+	for i := 1; i <= 3; i++ {
+		leaderSM.Apply(&raftpb.LogEntry{Index: uint64(i), Term: 2, Data: bytes.Repeat([]byte{byte(i)}, snapshotChunkSize)})
+	}
+	var snap bytes.Buffer
+	if _, _, err := leaderSM.Snapshot(&snap); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if snap.Len() < 2*snapshotChunkSize {
+		t.Fatalf("snapshot of %d bytes fits in fewer than 3 chunks", snap.Len())
+	}
+
+	transport := NewGRPCTransport()
+	defer transport.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	voters := []NodeID{"a", "b", id}
+	resp, err := transport.InstallSnapshot(ctx, id, &raftpb.InstallSnapshotRequest{
+		Term:              2,
+		LeaderId:          "a",
+		LastIncludedIndex: 3,
+		LastIncludedTerm:  2,
+		Config:            configFrom(voters, []NodeID{"c"}),
+	}, &snap)
+	if err != nil {
+		t.Fatalf("install snapshot failed: %v", err)
+	}
+	if resp.Term != 2 {
+		t.Fatalf("unexpected response term %d", resp.Term)
+	}
+
+	if applied, _, _ := sm.Applied(); applied != 3 {
+		t.Fatalf("expected state machine restored to index 3, got %d", applied)
+	}
+	if data := sm.data(); len(data) != 3 || data[2] != string(bytes.Repeat([]byte{3}, snapshotChunkSize)) {
+		t.Fatalf("snapshot restored with %d entries, or the wrong data", len(data))
+	}
+	slices.Sort(voters)
+	if got := follower.Voters(); !slices.Equal(got, voters) {
+		t.Fatalf("expected voters %v from the snapshot, got %v", voters, got)
+	}
+	if got := follower.Learners(); !slices.Equal(got, []NodeID{"c"}) {
+		t.Fatalf("expected learner c from the snapshot, got %v", got)
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Fatalf("snapshot staging files left behind: %v", left)
+	}
+}
@@ -0,0 +1,225 @@
+// Package ranges splits the keyspace into contiguous ranges, each replicated
+// by its own raft group on a subset of the nodes.
+package ranges
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Layout is how the keyspace is split into ranges and where each range
+// lives, either a Table of key ranges or a Ring of hash partitions
+type Layout interface {
+	// Lookup returns the range holding key
+	Lookup(key []byte) *Descriptor
+	// Get returns the range with the given id, or nil
+	Get(id uint64) *Descriptor
+	// Ranges returns every range
+	Ranges() []*Descriptor
+	// Hosted returns the ranges addr is a replica of
+	Hosted(addr string) []*Descriptor
+	// Nodes returns every node in the layout, sorted
+	Nodes() []string
+	// Fingerprint identifies the layout, nodes agree on it when theirs match
+	Fingerprint() string
+}
+
+var (
+	_ Layout = (*Table)(nil)
+	_ Layout = (*Ring)(nil)
+)
+
+// Descriptor describes one range: the keys it holds and the nodes hosting it.
+// The range id doubles as the id of its raft group.
+type Descriptor struct {
+	ID       uint64
+	StartKey []byte   // first key in the range, inclusive
+	EndKey   []byte   // first key past the range, nil for the end of the keyspace
+	Replicas []string // raft addresses of the nodes hosting the range
+	// Hashed ranges hold the keys whose hash, as 8 big endian bytes, falls
+	// between StartKey and EndKey rather than the keys themselves
+	Hashed bool
+}
+
+// Contains reports whether key falls into the range
+func (d *Descriptor) Contains(key []byte) bool {
+	if d.Hashed {
+		key = hashKey(hash(key))
+	}
+	return bytes.Compare(key, d.StartKey) >= 0 && (d.EndKey == nil || bytes.Compare(key, d.EndKey) < 0)
+}
+
+// HostedBy reports whether addr is one of the range's replicas
+func (d *Descriptor) HostedBy(addr string) bool {
+	return slices.Contains(d.Replicas, addr)
+}
+
+func (d *Descriptor) String() string {
+	if d.Hashed {
+		end := "+inf"
+		if d.EndKey != nil {
+			end = fmt.Sprintf("#%x", d.EndKey)
+		}
+		return fmt.Sprintf("r%d[#%x, %s)", d.ID, d.StartKey, end)
+	}
+	end := "+inf"
+	if d.EndKey != nil {
+		end = strconv.Quote(string(d.EndKey))
+	}
+	return fmt.Sprintf("r%d[%q, %s)", d.ID, d.StartKey, end)
+}
+
+// Table is the full set of ranges, covering the keyspace without gaps or
+// overlaps. It is immutable once built.
+type Table struct {
+	ranges []*Descriptor // sorted by StartKey
+	hashed bool          // the ranges split the hash space, see Descriptor.Hashed
+}
+
+// NewTable checks that descs tile the keyspace and builds a table from them
+func NewTable(descs []*Descriptor) (*Table, error) {
+	ranges := slices.Clone(descs)
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].StartKey, ranges[j].StartKey) < 0 })
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("ranges: no ranges")
+	}
+	seen := make(map[uint64]bool, len(ranges))
+	for i, d := range ranges {
+		switch {
+		case d.ID == 0:
+			return nil, fmt.Errorf("ranges: %v needs an id above zero", d)
+		case seen[d.ID]:
+			return nil, fmt.Errorf("ranges: range id %d used twice", d.ID)
+		case len(d.Replicas) == 0:
+			return nil, fmt.Errorf("ranges: %v has no replicas", d)
+		case d.EndKey != nil && bytes.Compare(d.StartKey, d.EndKey) >= 0:
+			return nil, fmt.Errorf("ranges: %v is empty", d)
+		case i == 0 && len(d.StartKey) != 0:
+			return nil, fmt.Errorf("ranges: nothing covers keys before %q", d.StartKey)
+		case i > 0 && !bytes.Equal(ranges[i-1].EndKey, d.StartKey):
+			return nil, fmt.Errorf("ranges: %v does not start where %v ends", d, ranges[i-1])
+		case d.Hashed != ranges[0].Hashed:
+			return nil, fmt.Errorf("ranges: %v and %v split keys differently", d, ranges[0])
+		}
+		seen[d.ID] = true
+	}
+	if last := ranges[len(ranges)-1]; last.EndKey != nil {
+		return nil, fmt.Errorf("ranges: nothing covers keys from %q on", last.EndKey)
+	}
+	return &Table{ranges: ranges, hashed: ranges[0].Hashed}, nil
+}
+
+// Single is a table of one range holding every key, hosted by every replica
+func Single(replicas []string) *Table {
+	return &Table{ranges: []*Descriptor{{ID: 1, Replicas: replicas}}}
+}
+
+// Lookup returns the range holding key
+func (t *Table) Lookup(key []byte) *Descriptor {
+	if t.hashed {
+		key = hashKey(hash(key))
+	}
+	// the last range starting at or before key
+	i := sort.Search(len(t.ranges), func(i int) bool { return bytes.Compare(t.ranges[i].StartKey, key) > 0 })
+	return t.ranges[i-1]
+}
+
+// Get returns the range with the given id, or nil
+func (t *Table) Get(id uint64) *Descriptor {
+	for _, d := range t.ranges {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// Ranges returns every range in key order
+func (t *Table) Ranges() []*Descriptor {
+	return slices.Clone(t.ranges)
+}
+
+// Hosted returns the ranges addr is a replica of
+func (t *Table) Hosted(addr string) []*Descriptor {
+	var out []*Descriptor
+	for _, d := range t.ranges {
+		if d.HostedBy(addr) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Nodes returns every node hosting at least one range, sorted
+func (t *Table) Nodes() []string {
+	var out []string
+	for _, d := range t.ranges {
+		for _, r := range d.Replicas {
+			if !slices.Contains(out, r) {
+				out = append(out, r)
+			}
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func (t *Table) Fingerprint() string {
+	return fingerprint("table", t.ranges)
+}
+
+// fingerprint hashes what a layout is built from along with its ranges
+func fingerprint(kind string, descs []*Descriptor) string {
+	h := fnv.New64a()
+	fmt.Fprintln(h, kind)
+	for _, d := range descs {
+		fmt.Fprintf(h, "%d %x %x %t %s\n", d.ID, d.StartKey, d.EndKey, d.Hashed, strings.Join(d.Replicas, ","))
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Parse reads a table written as ranges separated by ";", each in the form
+//
+//	id=start..end@replica,replica,...
+//
+// where an empty start or end stands for the start or end of the keyspace.
+// For example, splitting at "m" over four nodes:
+//
+//	1=..m@a:4000,b:4000,c:4000;2=m..@b:4000,c:4000,d:4000
+func Parse(spec string) (*Table, error) {
+	var descs []*Descriptor
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idStr, rest, ok1 := strings.Cut(part, "=")
+		span, replicas, ok2 := strings.Cut(rest, "@")
+		start, end, ok3 := strings.Cut(span, "..")
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("ranges: %q is not id=start..end@replicas", part)
+		}
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ranges: bad range id in %q: %v", part, err)
+		}
+
+		d := &Descriptor{ID: id, StartKey: []byte(start)}
+		if end != "" {
+			d.EndKey = []byte(end)
+		}
+		for _, r := range strings.Split(replicas, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				d.Replicas = append(d.Replicas, r)
+			}
+		}
+		descs = append(descs, d)
+	}
+	return NewTable(descs)
+}
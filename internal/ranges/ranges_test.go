@@ -0,0 +1,49 @@
+package ranges
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseAndLookup(t *testing.T) {
+	table, err := Parse("2=m..t@b:1,c:1; 1=..m@a:1,b:1 ;3=t..@c:1,a:1")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	for key, want := range map[string]uint64{"": 1, "a": 1, "lzz": 1, "m": 2, "m0": 2, "t": 3, "zzz": 3} {
+		if got := table.Lookup([]byte(key)).ID; got != want {
+			t.Fatalf("key %q went to range %d, expected %d", key, got, want)
+		}
+	}
+
+	var hosted []uint64
+	for _, d := range table.Hosted("b:1") {
+		hosted = append(hosted, d.ID)
+	}
+	if !slices.Equal(hosted, []uint64{1, 2}) {
+		t.Fatalf("expected b:1 to host ranges 1 and 2, got %v", hosted)
+	}
+	if got := table.Nodes(); !slices.Equal(got, []string{"a:1", "b:1", "c:1"}) {
+		t.Fatalf("unexpected nodes %v", got)
+	}
+}
+
+func TestBadTables(t *testing.T) {
+	for _, spec := range []string{
+		"",                         // nothing
+		"1=a..@x",                  // gap at the start
+		"1=..m@x",                  // gap at the end
+		"1=..m@x;2=n..@x",          // gap in the middle
+		"1=..n@x;2=m..@x",          // overlap
+		"1=..m@x;1=m..@x",          // duplicate id
+		"0=..@x",                   // reserved id
+		"1=..@",                    // no replicas
+		"1=..m@x;2=m..m@x;3=m..@x", // empty range
+		"1..@x",                    // malformed
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package ranges
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Ring spreads keys over the nodes by hash. Keys fall into a fixed number of
+// partitions, each an equal slice of the hash space and a range with its own
+// raft group. A partition is replicated on the first distinct nodes found
+// walking clockwise from its start on a consistent hash ring, where every
+// node has a number of virtual nodes.
+//
+// A key never changes partition, so a node joining or leaving the ring only
+// changes the replicas of the partitions next to its virtual nodes, roughly
+// replicas/nodes of them, and only those get moved.
+type Ring struct {
+	nodes      []string
+	vnodes     int
+	replicas   int
+	tokens     []token // sorted by position
+	partitions []*Descriptor
+}
+
+// token is one virtual node
+type token struct {
+	pos  uint64
+	node string
+}
+
+// NewRing builds a ring over nodes with vnodes virtual nodes each, splitting
+// keys into the given number of partitions replicated on up to replicas
+// nodes
+func NewRing(nodes []string, vnodes, replicas, partitions int) (*Ring, error) {
+	switch {
+	case len(nodes) == 0:
+		return nil, fmt.Errorf("ranges: ring needs at least one node")
+	case vnodes < 1:
+		return nil, fmt.Errorf("ranges: ring needs at least one virtual node per node")
+	case replicas < 1:
+		return nil, fmt.Errorf("ranges: ring needs a replication factor of at least 1")
+	case partitions < 1:
+		return nil, fmt.Errorf("ranges: ring needs at least one partition")
+	}
+	r := &Ring{nodes: slices.Clone(nodes), vnodes: vnodes}
+	slices.Sort(r.nodes)
+	r.nodes = slices.Compact(r.nodes)
+	r.replicas = min(replicas, len(r.nodes))
+
+	for _, n := range r.nodes {
+		for i := 0; i < vnodes; i++ {
+			r.tokens = append(r.tokens, token{pos: hash([]byte(n + "#" + strconv.Itoa(i))), node: n})
+		}
+	}
+	sort.Slice(r.tokens, func(i, j int) bool { return r.tokens[i].pos < r.tokens[j].pos })
+
+	for i := 0; i < partitions; i++ {
+		start := partitionStart(i, partitions)
+		d := &Descriptor{ID: uint64(i + 1), Hashed: true, Replicas: r.owners(start)}
+		// the first partition starts where the keyspace does, like a table's
+		if i > 0 {
+			d.StartKey = hashKey(start)
+		}
+		if i+1 < partitions {
+			d.EndKey = hashKey(partitionStart(i+1, partitions))
+		}
+		r.partitions = append(r.partitions, d)
+	}
+	return r, nil
+}
+
+// owners returns the first distinct nodes at or after pos on the ring
+func (r *Ring) owners(pos uint64) []string {
+	i := sort.Search(len(r.tokens), func(i int) bool { return r.tokens[i].pos >= pos })
+	var out []string
+	for n := 0; n < len(r.tokens) && len(out) < r.replicas; n++ {
+		t := r.tokens[(i+n)%len(r.tokens)]
+		if !slices.Contains(out, t.node) {
+			out = append(out, t.node)
+		}
+	}
+	return out
+}
+
+func (r *Ring) Lookup(key []byte) *Descriptor {
+	// the high half of hash*partitions spreads hashes evenly over partitions
+	p, _ := bits.Mul64(hash(key), uint64(len(r.partitions)))
+	return r.partitions[p]
+}
+
+func (r *Ring) Get(id uint64) *Descriptor {
+	if id == 0 || id > uint64(len(r.partitions)) {
+		return nil
+	}
+	return r.partitions[id-1]
+}
+
+func (r *Ring) Ranges() []*Descriptor {
+	return slices.Clone(r.partitions)
+}
+
+func (r *Ring) Hosted(addr string) []*Descriptor {
+	var out []*Descriptor
+	for _, d := range r.partitions {
+		if d.HostedBy(addr) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+func (r *Ring) Fingerprint() string {
+	return fingerprint(fmt.Sprintf("ring %d %d %d", r.vnodes, r.replicas, len(r.partitions)), r.partitions)
+}
+
+// partitionStart returns the first hash falling into partition i of n,
+// ceil(i * 2^64 / n)
+func partitionStart(i, n int) uint64 {
+	if i == 0 {
+		return 0
+	}
+	q, rem := bits.Div64(uint64(i), 0, uint64(n))
+	if rem > 0 {
+		q++
+	}
+	return q
+}
+
+// hash places a key, or a virtual node, on the ring: 64-bit FNV-1a with a
+// final mix so nearby inputs land far apart
+func hash(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// hashKey encodes a hash so that byte order matches numeric order, which is
+// how hashed ranges store their bounds
+func hashKey(h uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, h)
+}
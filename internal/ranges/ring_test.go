@@ -0,0 +1,140 @@
+package ranges
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestRingLookup(t *testing.T) {
+	nodes := []string{"a:1", "b:1", "c:1", "d:1", "e:1"}
+	ring, err := NewRing(nodes, 64, 3, 64)
+	if err != nil {
+		t.Fatalf("new ring failed: %v", err)
+	}
+
+	// every key lands in a partition that contains it, and the partitions
+	// get an even share of keys
+	perPartition := make(map[uint64]int)
+	for i := 0; i < 64000; i++ {
+		key := []byte(fmt.Sprintf("user:%d", i))
+		d := ring.Lookup(key)
+		if !d.Contains(key) {
+			t.Fatalf("%q went to %v, which doesn't contain it", key, d)
+		}
+		perPartition[d.ID]++
+	}
+	for id, n := range perPartition {
+		if n < 700 || n > 1300 {
+			t.Fatalf("partition %d got %d of 64000 keys, expected about 1000", id, n)
+		}
+	}
+
+	// every partition has three distinct replicas, spread over all nodes
+	perNode := make(map[string]int)
+	for _, d := range ring.Ranges() {
+		r := slices.Clone(d.Replicas)
+		slices.Sort(r)
+		if len(slices.Compact(r)) != 3 {
+			t.Fatalf("%v has replicas %v, expected 3 distinct", d, d.Replicas)
+		}
+		for _, n := range d.Replicas {
+			perNode[n]++
+		}
+	}
+	for _, n := range nodes {
+		// 64 partitions * 3 replicas / 5 nodes is about 38
+		if perNode[n] < 20 || perNode[n] > 56 {
+			t.Fatalf("%s hosts %d partitions, expected about 38", n, perNode[n])
+		}
+		if len(ring.Hosted(n)) != perNode[n] {
+			t.Fatalf("%s hosts %d partitions but Hosted returned %d", n, perNode[n], len(ring.Hosted(n)))
+		}
+	}
+
+	if ring.Get(0) != nil || ring.Get(65) != nil || ring.Get(64).EndKey != nil {
+		t.Fatalf("unexpected partitions at the edges")
+	}
+
+	// a table of the partitions, as stored in the cluster metadata, routes
+	// keys the same way
+	table, err := NewTable(ring.Ranges())
+	if err != nil {
+		t.Fatalf("new table failed: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("user:%d", i))
+		if got, want := table.Lookup(key), ring.Lookup(key); got != want {
+			t.Fatalf("%q went to %v in the table but %v in the ring", key, got, want)
+		}
+	}
+}
+
+// a node joining takes over some replicas, and nothing else moves
+func TestRingMinimalMovement(t *testing.T) {
+	before, err := NewRing([]string{"a:1", "b:1", "c:1", "d:1"}, 64, 2, 128)
+	if err != nil {
+		t.Fatalf("new ring failed: %v", err)
+	}
+	after, err := NewRing([]string{"a:1", "b:1", "c:1", "d:1", "e:1"}, 64, 2, 128)
+	if err != nil {
+		t.Fatalf("new ring failed: %v", err)
+	}
+	if before.Fingerprint() == after.Fingerprint() {
+		t.Fatalf("expected different rings to have different fingerprints")
+	}
+
+	moved := 0
+	for _, d := range after.Ranges() {
+		old := before.Get(d.ID).Replicas
+		var added, removed []string
+		for _, n := range d.Replicas {
+			if !slices.Contains(old, n) {
+				added = append(added, n)
+			}
+		}
+		for _, n := range old {
+			if !slices.Contains(d.Replicas, n) {
+				removed = append(removed, n)
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+		if !slices.Equal(added, []string{"e:1"}) || len(removed) != 1 {
+			t.Fatalf("%v went from %v to %v, expected e:1 to replace one replica", d, old, d.Replicas)
+		}
+		moved++
+	}
+	// e:1 should end up with about 2/5 of the 128 partitions
+	if moved < 30 || moved > 75 {
+		t.Fatalf("%d of 128 partitions moved, expected about 51", moved)
+	}
+}
+
+func TestBadRings(t *testing.T) {
+	for _, tc := range []struct {
+		nodes                        []string
+		vnodes, replicas, partitions int
+	}{
+		{nil, 8, 3, 8},
+		{[]string{"a"}, 0, 3, 8},
+		{[]string{"a"}, 8, 0, 8},
+		{[]string{"a"}, 8, 3, 0},
+	} {
+		if _, err := NewRing(tc.nodes, tc.vnodes, tc.replicas, tc.partitions); err == nil {
+			t.Fatalf("expected %+v to be rejected", tc)
+		}
+	}
+
+	// a replication factor above the node count is capped
+	ring, err := NewRing([]string{"a", "b", "a"}, 8, 3, 4)
+	if err != nil {
+		t.Fatalf("new ring failed: %v", err)
+	}
+	for _, d := range ring.Ranges() {
+		if len(d.Replicas) != 2 {
+			t.Fatalf("expected 2 replicas, got %v", d.Replicas)
+		}
+	}
+}
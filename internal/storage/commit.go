@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ErrClosed is returned for writes made after Close
+var ErrClosed = errors.New("storage: closed")
+
+// while writers are on their way, a group keeps collecting them for this
+// long, or until this many bytes wait for the disk, then goes with a single
+// fsync
+const (
+	commitWindow   = 500 * time.Microsecond
+	commitMaxBytes = 4 << 20
+)
+
+// groupCommitter funnels every wait for durability through one goroutine.
+// Writes go into the db without a sync, so they are visible to readers and
+// to the next write right away, before they are durable, and the writers
+// then wait here. Whoever is queued up shares one fsync of the WAL, which
+// covers everything written before it, instead of going to the disk one
+// after the other, and each still only returns once its own writes are
+// durable. A crash can lose writes that were read but never synced, raft
+// applies them again from its log.
+type groupCommitter struct {
+	p        *PebbleKV
+	reqs     chan chan error
+	unsynced atomic.Int64 // bytes written since the last fsync
+	writers  atomic.Int64 // in WriteBatch, bound to sync once they have written
+	closing  chan struct{}
+	done     chan struct{}
+	last     error // of the fsync made on close, set before done is closed
+	once     sync.Once
+	groups   atomic.Uint64 // fsyncs so far, one per group
+}
+
+func newGroupCommitter(p *PebbleKV) *groupCommitter {
+	g := &groupCommitter{
+		p:       p,
+		reqs:    make(chan chan error),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go g.run()
+	return g
+}
+
+// wrote counts n bytes just written to the db towards the next group
+func (g *groupCommitter) wrote(n int) {
+	g.unsynced.Add(int64(n))
+}
+
+// sync returns once everything written to the db before the call is
+// durable, as part of the next group. A write that made it into the db is
+// never turned away with ErrClosed, close syncs it instead.
+func (g *groupCommitter) sync() error {
+	done := make(chan error, 1)
+	select {
+	case g.reqs <- done:
+		return <-done
+	case <-g.done:
+		return g.last
+	}
+}
+
+// closed reports whether close has been called
+func (g *groupCommitter) closed() bool {
+	select {
+	case <-g.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// close turns away later writes, then syncs once more for the ones that
+// already reached the db. The caller holds p.mu for writing, so no write is
+// halfway through.
+func (g *groupCommitter) close() {
+	g.once.Do(func() { close(g.closing) })
+}
+
+// wait returns once the committer has stopped
+func (g *groupCommitter) wait() {
+	<-g.done
+}
+
+func (g *groupCommitter) run() {
+	defer close(g.done)
+	for {
+		var first chan error
+		select {
+		case first = <-g.reqs:
+		case <-g.closing:
+			g.last = g.flush()
+			return
+		}
+
+		group := []chan error{first}
+		var timer *time.Timer
+	collect:
+		for g.unsynced.Load() < commitMaxBytes {
+			select {
+			case req := <-g.reqs:
+				group = append(group, req)
+				continue
+			default:
+			}
+			// go to disk as soon as nobody else is on the way, a lone
+			// writer never waits for the window
+			if int64(len(group)) >= g.writers.Load() {
+				break collect
+			}
+			if timer == nil {
+				timer = time.NewTimer(commitWindow)
+			}
+			select {
+			case req := <-g.reqs:
+				group = append(group, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		err := g.flush()
+		for _, done := range group {
+			done <- err
+		}
+	}
+}
+
+// flush makes everything written so far durable with one fsync of the WAL
+func (g *groupCommitter) flush() error {
+	g.unsynced.Store(0)
+	g.groups.Add(1)
+	g.p.mu.RLock()
+	defer g.p.mu.RUnlock()
+	return g.p.db.LogData(nil, pebble.Sync)
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Since format 2 every write to a key is kept as a version of its own, so
+// reads can go back to how the store was at an earlier revision. A version
+// is stored under the key, escaped so no key is a prefix of another, and the
+// revision of the write inverted so a key's newest version sorts first:
+//
+//	"v" <key, 0x00 escaped as 0x00 0xff> 0x00 0x01 <^revision>
+//
+// A delete writes a tombstone. "t" records when each revision was written,
+// so reads can go back to a time too, and Compact drops the versions no read
+// at or after a revision needs any more.
+
+var (
+	versionPrefix = []byte("v")
+	timePrefix    = []byte("t")
+	compactedKey  = []byte("mcompacted") // revision history was compacted up to
+	untimedKey    = []byte("muntimed")   // last revision written without a time
+)
+
+// a version holds its kind, then for a put the key's create revision and
+// version and the value
+const (
+	kindPut byte = iota
+	kindTombstone
+	versionHeader = 17
+)
+
+// ErrCompacted is returned for reads as of a revision or a time whose
+// versions have been compacted away
+var ErrCompacted = errors.New("storage: revision has been compacted")
+
+// encodeKey appends key to buf so that encoded keys sort like the keys
+// themselves and none is a prefix of another
+func encodeKey(buf, key []byte) []byte {
+	for _, c := range key {
+		if c == 0 {
+			buf = append(buf, 0, 0xff)
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, 0, 1)
+}
+
+// versionsStart returns the first key on disk of key's versions, which are
+// all below PrefixEnd of it
+func versionsStart(key []byte) []byte {
+	return encodeKey(append(make([]byte, 0, len(versionPrefix)+len(key)+10), versionPrefix...), key)
+}
+
+func versionKey(key []byte, rev uint64) []byte {
+	return binary.BigEndian.AppendUint64(versionsStart(key), ^rev)
+}
+
+// decodeVersionKey splits a version's key on disk into the user key and the
+// revision of the write
+func decodeVersionKey(k []byte) ([]byte, uint64, error) {
+	if len(k) < len(versionPrefix)+10 {
+		return nil, 0, fmt.Errorf("storage: version key %q too short", k)
+	}
+	enc := k[len(versionPrefix) : len(k)-8]
+	rev := ^binary.BigEndian.Uint64(k[len(k)-8:])
+	key := make([]byte, 0, len(enc))
+	for i := 0; i < len(enc); i++ {
+		if enc[i] != 0 {
+			key = append(key, enc[i])
+			continue
+		}
+		switch {
+		case i+1 < len(enc) && enc[i+1] == 0xff:
+			key = append(key, 0)
+			i++
+		case i+2 == len(enc) && enc[i+1] == 1:
+			return key, rev, nil
+		default:
+			return nil, 0, fmt.Errorf("storage: bad version key %q", k)
+		}
+	}
+	return nil, 0, fmt.Errorf("storage: bad version key %q", k)
+}
+
+func encodeVersion(m KeyMeta, value []byte) []byte {
+	buf := make([]byte, versionHeader+len(value))
+	buf[0] = kindPut
+	binary.BigEndian.PutUint64(buf[1:], m.CreateRevision)
+	binary.BigEndian.PutUint64(buf[9:], m.Version)
+	copy(buf[versionHeader:], value)
+	return buf
+}
+
+// decodeVersion reads a version written at rev, false for a tombstone. The
+// value still points into raw.
+func decodeVersion(raw []byte, rev uint64) ([]byte, KeyMeta, bool, error) {
+	switch {
+	case len(raw) == 1 && raw[0] == kindTombstone:
+		return nil, KeyMeta{}, false, nil
+	case len(raw) < versionHeader || raw[0] != kindPut:
+		return nil, KeyMeta{}, false, fmt.Errorf("storage: bad version of %d bytes", len(raw))
+	}
+	return raw[versionHeader:], KeyMeta{
+		CreateRevision: binary.BigEndian.Uint64(raw[1:]),
+		ModRevision:    rev,
+		Version:        binary.BigEndian.Uint64(raw[9:]),
+	}, true, nil
+}
+
+func timeKey(nanos int64, rev uint64) []byte {
+	buf := append(make([]byte, 0, len(timePrefix)+16), timePrefix...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(nanos))
+	return binary.BigEndian.AppendUint64(buf, rev)
+}
+
+// GetAt fetches key as it was at revision rev, 0 for the latest. Revisions
+// past the last write read the latest too.
+func (p *PebbleKV) GetAt(key []byte, rev uint64) ([]byte, KeyMeta, bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	v, meta, found, err := lookup(p.db, key, rev)
+	if err != nil {
+		return nil, KeyMeta{}, false, err
+	}
+	// checked after the read, Compact moves the mark before it deletes
+	if err := p.readable(rev); err != nil {
+		return nil, KeyMeta{}, false, err
+	}
+	return v, meta, found, nil
+}
+
+// lookup reads key as of rev, 0 for the latest, from r, a db or an indexed
+// batch, returning a copy of its value
+func lookup(r pebble.Reader, key []byte, rev uint64) ([]byte, KeyMeta, bool, error) {
+	start := versionsStart(key)
+	it, err := r.NewIter(&pebble.IterOptions{LowerBound: start, UpperBound: PrefixEnd(start)})
+	if err != nil {
+		return nil, KeyMeta{}, false, err
+	}
+	defer it.Close()
+
+	if rev == 0 {
+		rev = math.MaxUint64
+	}
+	if !it.SeekGE(versionKey(key, rev)) {
+		return nil, KeyMeta{}, false, it.Error()
+	}
+	_, modRev, err := decodeVersionKey(it.Key())
+	if err != nil {
+		return nil, KeyMeta{}, false, err
+	}
+	v, meta, live, err := decodeVersion(it.Value(), modRev)
+	if err != nil || !live {
+		return nil, KeyMeta{}, false, err
+	}
+	return bytes.Clone(v), meta, true, nil
+}
+
+// readable fails for reads as of revisions below the compacted one
+func (p *PebbleKV) readable(rev uint64) error {
+	if c := p.compacted.Load(); rev != 0 && rev < c {
+		return fmt.Errorf("%w: %d is below %d", ErrCompacted, rev, c)
+	}
+	return nil
+}
+
+// Compacted returns the revision history has been compacted up to, reads as
+// of revisions below it fail with ErrCompacted
+func (p *PebbleKV) Compacted() uint64 {
+	return p.compacted.Load()
+}
+
+// RevisionAt returns the last revision written at or before t, false if
+// nothing had been written by then. Times before a revision written without
+// one can't be told apart from it and fail like compacted ones.
+func (p *PebbleKV) RevisionAt(t time.Time) (uint64, bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	it, err := p.db.NewIter(&pebble.IterOptions{LowerBound: timePrefix, UpperBound: PrefixEnd(timePrefix)})
+	if err != nil {
+		return 0, false, err
+	}
+	defer it.Close()
+
+	if !it.SeekLT(timeKey(t.UnixNano()+1, 0)) {
+		if err := it.Error(); err != nil {
+			return 0, false, err
+		}
+		// the records from before the compacted revision are gone with it
+		if c := p.compacted.Load(); c > 0 || p.untimed.Load() > 0 {
+			return 0, false, fmt.Errorf("%w: %s is before the oldest revision kept", ErrCompacted, t.Format(time.RFC3339))
+		}
+		return 0, false, nil
+	}
+	k := it.Key()
+	if len(k) != len(timePrefix)+16 {
+		return 0, false, fmt.Errorf("storage: bad time record %q", k)
+	}
+	rev := binary.BigEndian.Uint64(k[len(timePrefix)+8:])
+	if u := p.untimed.Load(); rev < u {
+		return 0, false, fmt.Errorf("%w: %s is before revision %d, which was written without a time", ErrCompacted, t.Format(time.RFC3339), u)
+	}
+	return rev, true, nil
+}
+
+// Compact drops the versions no read as of rev or later needs: those of a
+// key older than its newest one at or before rev, and that one too if it is
+// a tombstone. Like Apply it records index/term as the last applied raft
+// entry, compacting at or below the compacted revision only records them,
+// and is durable once Sync returns.
+func (p *PebbleKV) Compact(rev, index, term uint64) error {
+	p.applyMu.Lock()
+	defer p.applyMu.Unlock()
+
+	prev := p.compacted.Load()
+	compact := rev > prev
+	if compact {
+		// reads check the mark after reading, so it moves before anything is
+		// deleted, and back if nothing was
+		p.compacted.Store(rev)
+	}
+	err := p.write(false, func(b *pebble.Batch) error {
+		if compact {
+			if err := p.fillCompaction(b, rev); err != nil {
+				return err
+			}
+		}
+		var applied [16]byte
+		binary.BigEndian.PutUint64(applied[:8], index)
+		binary.BigEndian.PutUint64(applied[8:], term)
+		return b.Set(appliedKey, applied[:], nil)
+	})
+	if err != nil && compact {
+		p.compacted.Store(prev)
+	}
+	return err
+}
+
+func (p *PebbleKV) fillCompaction(b *pebble.Batch, rev uint64) error {
+	it, err := p.db.NewIter(&pebble.IterOptions{LowerBound: versionPrefix, UpperBound: PrefixEnd(versionPrefix)})
+	if err != nil {
+		return err
+	}
+	// the last key whose newest version at or before rev has been seen
+	var kept []byte
+	seen := false
+	for it.First(); it.Valid(); it.Next() {
+		key, r, err := decodeVersionKey(it.Key())
+		if err != nil {
+			it.Close()
+			return err
+		}
+		if r > rev {
+			continue
+		}
+		drop := seen && bytes.Equal(key, kept)
+		if !drop {
+			kept, seen = key, true
+			drop = len(it.Value()) == 1 && it.Value()[0] == kindTombstone
+		}
+		if drop {
+			if err := b.Delete(it.Key(), nil); err != nil {
+				it.Close()
+				return err
+			}
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	// times of revisions that can't be read any more
+	it, err = p.db.NewIter(&pebble.IterOptions{LowerBound: timePrefix, UpperBound: PrefixEnd(timePrefix)})
+	if err != nil {
+		return err
+	}
+	for it.First(); it.Valid(); it.Next() {
+		k := it.Key()
+		if len(k) == len(timePrefix)+16 && binary.BigEndian.Uint64(k[len(timePrefix)+8:]) >= rev {
+			continue
+		}
+		if err := b.Delete(k, nil); err != nil {
+			it.Close()
+			return err
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], rev)
+	return b.Set(compactedKey, buf[:], nil)
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Every batch that writes gets a new revision of the store, higher than any
+// before it, and every key carries the revision that created it, the one
+// that last wrote it and how often it was written since it was created.
+// Batches applied from the raft log take the index of their entry as their
+// revision, so revisions are counted per range and every replica of a range
+// arrives at the same ones, whatever it applied before.
+
+var (
+	revisionKey = []byte("mrevision") // of the last write
+	formatKey   = []byte("mformat")   // how values are laid out on disk
+)
+
+const (
+	// values are kept as versions since format 2, see mvcc.go, before that
+	// there was one value per key under "d", behind its metadata since
+	// format 1 and bare before that
+	currentFormat = 2
+	metaSize      = 24
+)
+
+// KeyMeta is what the store tracks about a key besides its value. Keys last
+// written before revisions were kept have revisions of 0.
+type KeyMeta struct {
+	CreateRevision uint64 // the write that created the key
+	ModRevision    uint64 // the last write to the key
+	Version        uint64 // puts since the key was created, 1 for a new key
+}
+
+// decodeValue splits what format 1 stored under a key into its metadata and
+// the value, which still points into raw
+func decodeValue(raw []byte) (KeyMeta, []byte, error) {
+	if len(raw) < metaSize {
+		return KeyMeta{}, nil, fmt.Errorf("storage: value of %d bytes has no metadata", len(raw))
+	}
+	return KeyMeta{
+		CreateRevision: binary.BigEndian.Uint64(raw[0:]),
+		ModRevision:    binary.BigEndian.Uint64(raw[8:]),
+		Version:        binary.BigEndian.Uint64(raw[16:]),
+	}, raw[metaSize:], nil
+}
+
+// Revision returns the revision of the last write, 0 before the first one
+func (p *PebbleKV) Revision() uint64 {
+	return p.revision.Load()
+}
+
+// GetMeta fetches key's value along with its metadata
+func (p *PebbleKV) GetMeta(key []byte) ([]byte, KeyMeta, bool, error) {
+	return p.GetAt(key, 0)
+}
+
+// mutate writes muts in one batch at revision rev, or the next one if rev
+// is not above the last, together with whatever extra adds, and returns each
+// key's metadata after its mutation. The revision is recorded as written at
+// at, or as written without a time if at is zero. If a condition fails only extra is written and a
+// *ConditionFailedError returned. The caller holds applyMu.
+func (p *PebbleKV) mutate(muts []Mutation, rev uint64, at time.Time, extra func(b *pebble.Batch) error) ([]KeyMeta, error) {
+	rev = max(rev, p.revision.Load()+1)
+	var metas []KeyMeta
+	var failed *ConditionFailedError
+	err := p.write(true, func(b *pebble.Batch) error {
+		var err error
+		metas, err = fillMutations(b, muts, rev)
+		switch {
+		case errors.As(err, &failed):
+			// drop the mutations ahead of the failed one
+			b.Reset()
+			metas = nil
+		case err != nil:
+			return err
+		case len(muts) > 0:
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], rev)
+			if err := b.Set(revisionKey, buf[:], nil); err != nil {
+				return err
+			}
+			k, v := timeKey(at.UnixNano(), rev), []byte(nil)
+			if at.IsZero() {
+				k, v = untimedKey, buf[:]
+			}
+			if err := b.Set(k, v, nil); err != nil {
+				return err
+			}
+		}
+		if extra != nil {
+			return extra(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	if len(muts) > 0 {
+		p.revision.Store(rev)
+		if at.IsZero() {
+			p.untimed.Store(rev)
+		}
+	}
+	return metas, nil
+}
+
+// fillMutations adds muts to b, an indexed batch, as versions at rev, so each
+// one sees the ones ahead of it when checking its condition and updating its
+// key's metadata. Deleting a key that doesn't exist writes nothing.
+func fillMutations(b *pebble.Batch, muts []Mutation, rev uint64) ([]KeyMeta, error) {
+	metas := make([]KeyMeta, len(muts))
+	for i, m := range muts {
+		cur, meta, found, err := lookup(b, m.Key, 0)
+		if err != nil {
+			return nil, err
+		}
+		if m.If != nil && !m.If.holds(cur, meta, found) {
+			return nil, &ConditionFailedError{Key: m.Key, Value: cur, Meta: meta, Found: found}
+		}
+
+		switch {
+		case m.Delete && found:
+			err = b.Set(versionKey(m.Key, rev), []byte{kindTombstone}, nil)
+		case !m.Delete:
+			meta = KeyMeta{CreateRevision: meta.CreateRevision, ModRevision: rev, Version: meta.Version + 1}
+			if !found {
+				meta = KeyMeta{CreateRevision: rev, ModRevision: rev, Version: 1}
+			}
+			metas[i] = meta
+			err = b.Set(versionKey(m.Key, rev), encodeVersion(meta, m.Value), nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return metas, nil
+}
+
+func (c *Condition) holds(value []byte, meta KeyMeta, found bool) bool {
+	switch {
+	case c.Absent:
+		return !found
+	case c.ModRevision != 0:
+		return found && meta.ModRevision == c.ModRevision
+	default:
+		return found && bytes.Equal(value, c.Value)
+	}
+}
+
+// load brings a db written by an older version up to the current format and
+// reads the revision of the last write. It runs before the db is shared, so
+// it writes to it directly.
+func (p *PebbleKV) load() error {
+	format, err := readUint64(p.db, formatKey)
+	if err != nil {
+		return err
+	}
+	if format < currentFormat {
+		if err := p.upgrade(format); err != nil {
+			return err
+		}
+	}
+
+	rev, err := readUint64(p.db, revisionKey)
+	if err != nil {
+		return err
+	}
+	compacted, err := readUint64(p.db, compactedKey)
+	if err != nil {
+		return err
+	}
+	untimed, err := readUint64(p.db, untimedKey)
+	if err != nil {
+		return err
+	}
+	p.revision.Store(rev)
+	p.compacted.Store(compacted)
+	p.untimed.Store(untimed)
+	return nil
+}
+
+// upgrade turns the values of a db in an older format into versions, all in
+// one batch so a crash half way through can't leave a mix. Older formats kept
+// no history, so the store is marked compacted up to its last revision, as of
+// now, and keys written before revisions were kept get revisions of 0.
+func (p *PebbleKV) upgrade(format uint64) error {
+	b := p.db.NewBatch()
+	defer b.Close()
+	it, err := p.db.NewIter(&pebble.IterOptions{LowerBound: dataPrefix, UpperBound: PrefixEnd(dataPrefix)})
+	if err != nil {
+		return err
+	}
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		meta, v := KeyMeta{Version: 1}, it.Value()
+		if format >= 1 {
+			if meta, v, err = decodeValue(v); err != nil {
+				it.Close()
+				return err
+			}
+		}
+		key := it.Key()[len(dataPrefix):]
+		if err := b.Set(versionKey(key, meta.ModRevision), encodeVersion(meta, v), nil); err != nil {
+			it.Close()
+			return err
+		}
+		if err := b.Delete(it.Key(), nil); err != nil {
+			it.Close()
+			return err
+		}
+		n++
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	rev, err := readUint64(p.db, revisionKey)
+	if err != nil {
+		return err
+	}
+	if n > 0 || rev > 0 {
+		// the next write must come after the keys kept at 0
+		rev = max(rev, 1)
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], rev)
+		for _, k := range [][]byte{revisionKey, compactedKey} {
+			if err := b.Set(k, buf[:], nil); err != nil {
+				return err
+			}
+		}
+		if err := b.Set(timeKey(time.Now().UnixNano(), rev), nil, nil); err != nil {
+			return err
+		}
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], currentFormat)
+	if err := b.Set(formatKey, buf[:], nil); err != nil {
+		return err
+	}
+	return b.Commit(pebble.Sync)
+}
+
+// readUint64 reads an internal key holding a number, 0 if it isn't set
+func readUint64(db *pebble.DB, key []byte) (uint64, error) {
+	v, closer, err := db.Get(key)
+	if err == pebble.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	if len(v) != 8 {
+		return 0, fmt.Errorf("storage: bad %s record of %d bytes", key[1:], len(v))
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
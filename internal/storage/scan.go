@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// ScanOptions picks the keys a scan walks over. The bounds and the prefix
+// combine, a scan sees the keys matching all of them.
+type ScanOptions struct {
+	Start   []byte // first key, inclusive, nil for the start of the keyspace
+	End     []byte // first key past the scan, nil for the end of the keyspace
+	Prefix  []byte // only keys starting with it
+	Reverse bool   // from the largest key down
+	Limit   int    // stop after this many keys, 0 for no limit
+	// read the keys as they were at this revision, 0 for the latest
+	Revision uint64
+}
+
+// Iterator walks the pairs of a scan in key order. Key and Value are only
+// valid until the next call to Next. It must be closed.
+type Iterator interface {
+	// Next moves to the next pair, false once there are none left or on error
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Meta() KeyMeta
+	// Err returns the error that stopped the iterator, if any
+	Err() error
+	Close() error
+}
+
+// PrefixEnd returns the first key past every key starting with prefix, nil
+// if there is none
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Bounds narrows start and end down to the keys starting with prefix
+func (o ScanOptions) Bounds() (start, end []byte) {
+	start, end = o.Start, o.End
+	if len(o.Prefix) > 0 {
+		if bytes.Compare(o.Prefix, start) > 0 {
+			start = o.Prefix
+		}
+		if pe := PrefixEnd(o.Prefix); pe != nil && (end == nil || bytes.Compare(pe, end) < 0) {
+			end = pe
+		}
+	}
+	return start, end
+}
+
+// Scan iterates over the user keys matching opts. The iterator sees the db
+// as of the call and holds off Restore until it is closed, so it should not
+// be kept open for long.
+func (p *PebbleKV) Scan(opts ScanOptions) (Iterator, error) {
+	start, end := opts.Bounds()
+	iterOpts := &pebble.IterOptions{LowerBound: versionsStart(start), UpperBound: PrefixEnd(versionPrefix)}
+	if end != nil {
+		iterOpts.UpperBound = versionsStart(end)
+	}
+
+	p.mu.RLock()
+	it, err := p.db.NewIter(iterOpts)
+	if err != nil {
+		p.mu.RUnlock()
+		return nil, err
+	}
+	// checked once the iterator has its view of the db, see GetAt
+	if err := p.readable(opts.Revision); err != nil {
+		it.Close()
+		p.mu.RUnlock()
+		return nil, err
+	}
+	rev := opts.Revision
+	if rev == 0 {
+		rev = math.MaxUint64
+	}
+	return &pebbleIterator{p: p, it: it, rev: rev, reverse: opts.Reverse, limit: opts.Limit}, nil
+}
+
+// pebbleIterator visits a key's versions by seeking to the newest one at or
+// before the revision read at, then seeks past them to the next key
+type pebbleIterator struct {
+	p       *PebbleKV
+	it      *pebble.Iterator
+	rev     uint64
+	reverse bool
+	limit   int
+	seen    int
+	started bool
+	closed  bool
+	key     []byte
+	value   []byte
+	meta    KeyMeta
+	err     error // a version that failed to decode
+}
+
+func (i *pebbleIterator) Next() bool {
+	if i.err != nil || (i.limit > 0 && i.seen >= i.limit) {
+		return false
+	}
+	for {
+		var ok bool
+		switch {
+		case !i.started && i.reverse:
+			ok = i.it.Last()
+		case !i.started:
+			ok = i.it.First()
+		case i.reverse:
+			ok = i.it.SeekLT(versionsStart(i.key))
+		default:
+			ok = i.it.SeekGE(PrefixEnd(versionsStart(i.key)))
+		}
+		i.started = true
+		if !ok {
+			return false
+		}
+		if i.key, _, i.err = decodeVersionKey(i.it.Key()); i.err != nil {
+			return false
+		}
+
+		// a key with nothing at or before the revision didn't exist then,
+		// the seek lands on a later key or past the end
+		if !i.it.SeekGE(versionKey(i.key, i.rev)) {
+			if i.it.Error() != nil {
+				return false
+			}
+			continue
+		}
+		key, rev, err := decodeVersionKey(i.it.Key())
+		if err != nil {
+			i.err = err
+			return false
+		}
+		if !bytes.Equal(key, i.key) {
+			continue
+		}
+		var live bool
+		if i.value, i.meta, live, i.err = decodeVersion(i.it.Value(), rev); i.err != nil {
+			return false
+		}
+		if live {
+			i.seen++
+			return true
+		}
+	}
+}
+
+func (i *pebbleIterator) Key() []byte {
+	return i.key
+}
+
+func (i *pebbleIterator) Value() []byte {
+	return i.value
+}
+
+func (i *pebbleIterator) Meta() KeyMeta {
+	return i.meta
+}
+
+func (i *pebbleIterator) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.it.Error()
+}
+
+func (i *pebbleIterator) Close() error {
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+	defer i.p.mu.RUnlock()
+	return i.it.Close()
+}
@@ -1,6 +1,16 @@
 package storage
 
 import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/cockroachdb/pebble"
 )
 
@@ -8,13 +18,73 @@ import (
 type KV interface {
 	Put(key, value []byte) error
 	Get(key []byte) ([]byte, bool, error)
+	// GetMeta is Get along with the key's revisions
+	GetMeta(key []byte) ([]byte, KeyMeta, bool, error)
+	// GetAt is GetMeta as of an earlier revision, see mvcc.go
+	GetAt(key []byte, rev uint64) ([]byte, KeyMeta, bool, error)
 	Delete(key []byte) error
+	// WriteBatch applies muts all together or not at all
+	WriteBatch(muts []Mutation) error
+	Scan(opts ScanOptions) (Iterator, error)
+	// Revision returns the revision of the last write, see KeyMeta
+	Revision() uint64
+	// RevisionAt returns the last revision written by time t
+	RevisionAt(t time.Time) (uint64, bool, error)
+	// Compacted returns the oldest revision reads can go back to
+	Compacted() uint64
 	Close() error
 }
 
+// keys on disk are prefixed so user data never collides with our own
+// bookkeeping: "v" for versions of user keys, "t" for when they were
+// written, "m" for internal state and "d" for user keys before format 2
+var (
+	dataPrefix = []byte("d")
+	appliedKey = []byte("mapplied") // last raft entry applied
+)
+
+// Mutation is a single put or delete, applied as part of a batch
+type Mutation struct {
+	Delete bool
+	Key    []byte
+	Value  []byte
+	// If, when set, must hold for the key before the mutation, or nothing
+	// in the batch is written
+	If *Condition
+}
+
+// Condition is what a key must hold for a conditional mutation to go ahead
+type Condition struct {
+	Absent bool   // the key must not exist
+	Value  []byte // unless Absent, the key must exist and hold exactly this
+	// if not 0, the key must exist and have last been written at this
+	// revision, whatever it holds
+	ModRevision uint64
+}
+
+// ConditionFailedError is returned when a mutation's condition did not
+// hold. It carries what the key held instead.
+type ConditionFailedError struct {
+	Key   []byte
+	Value []byte
+	Meta  KeyMeta
+	Found bool
+}
+
+func (e *ConditionFailedError) Error() string {
+	return fmt.Sprintf("storage: condition on key %q failed", e.Key)
+}
+
 // PebbleKV is a wrapper aroung the actual Pebble db
 type PebbleKV struct {
-	db *pebble.DB
+	mu        sync.RWMutex // guards db, which Restore swaps out
+	applyMu   sync.Mutex   // fills one batch at a time, and none during Snapshot and Restore
+	db        *pebble.DB
+	path      string
+	commits   *groupCommitter // every write waits for the disk through here
+	revision  atomic.Uint64   // of the last write, only moved under applyMu
+	compacted atomic.Uint64   // history is kept from, only moved under applyMu
+	untimed   atomic.Uint64   // last revision written without a time, likewise
 }
 
 // open or create the pebble db at the given path
@@ -24,42 +94,302 @@ func Open(path string) (*PebbleKV, error) {
 		return nil, err
 	}
 
-	return &PebbleKV{db: db}, nil
+	p := &PebbleKV{db: db, path: path}
+	if err := p.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	p.commits = newGroupCommitter(p)
+	return p, nil
 }
 
-// put writes the kv pair to disk
-// pebble.Sync ensures the data actually gets saved to the disk, not memory buffers
-func (p *PebbleKV) Put (key, value []byte) error {
-	return p.db.Set(key, value, pebble.Sync)
+// put writes the kv pair to disk, returning once it is synced
+func (p *PebbleKV) Put(key, value []byte) error {
+	return p.WriteBatch([]Mutation{{Key: key, Value: value}})
 }
 
 // fetch the kv pair from the pebble db
 func (p *PebbleKV) Get(key []byte) ([]byte, bool, error) {
-	v, closer, err := p.db.Get(key)
+	v, _, found, err := p.GetMeta(key)
+	return v, found, err
+}
+
+// delete the kv pair from disk, returning once the deletion is synced
+func (p *PebbleKV) Delete(key []byte) error {
+	return p.WriteBatch([]Mutation{{Delete: true, Key: key}})
+}
+
+// WriteBatch writes muts in one batch, returning once it is synced. If a
+// condition fails nothing is written and a *ConditionFailedError returned.
+func (p *PebbleKV) WriteBatch(muts []Mutation) error {
+	// the group being collected waits for writers still queued on applyMu
+	p.commits.writers.Add(1)
+	defer p.commits.writers.Add(-1)
 
+	p.applyMu.Lock()
+	_, err := p.mutate(muts, 0, time.Now(), nil)
+	p.applyMu.Unlock()
+	if err != nil {
+		return err
+	}
+	// later writes can go ahead while this one waits for the disk
+	return p.Sync()
+}
+
+// Apply writes muts and records index/term as the last applied raft entry.
+// Both land in the same batch, so a crash can never leave one without the other.
+// The mutations get index as their revision, and Apply returns the metadata
+// of each key after its mutation. If a condition
+// fails the entry is still recorded as applied, but none of muts are
+// written and a *ConditionFailedError is returned. The write is visible
+// right away but only durable once Sync returns, so entries applied
+// together share one fsync.
+func (p *PebbleKV) Apply(muts []Mutation, index, term uint64) ([]KeyMeta, error) {
+	return p.ApplyAt(muts, index, term, time.Time{})
+}
+
+// ApplyAt is Apply recording at as the time of the write, so reads as of a
+// time can find it. Apply writes without a time.
+func (p *PebbleKV) ApplyAt(muts []Mutation, index, term uint64, at time.Time) ([]KeyMeta, error) {
+	p.applyMu.Lock()
+	defer p.applyMu.Unlock()
+
+	return p.mutate(muts, index, at, func(b *pebble.Batch) error {
+		var applied [16]byte
+		binary.BigEndian.PutUint64(applied[:8], index)
+		binary.BigEndian.PutUint64(applied[8:], term)
+		return b.Set(appliedKey, applied[:], nil)
+	})
+}
+
+// Sync returns once every write made before it is durable, sharing the
+// fsync with whoever else is waiting, see groupCommitter
+func (p *PebbleKV) Sync() error {
+	return p.commits.sync()
+}
+
+// write fills a batch and commits it to the db without waiting for the disk,
+// so the next write sees it at once. Callers wait for durability with Sync
+// once they let go of applyMu. An indexed batch can be read from while it
+// is being filled.
+func (p *PebbleKV) write(indexed bool, fill func(b *pebble.Batch) error) error {
+	// the db must not be closed or swapped while the batch is filled from
+	// it and committed to it
+	p.mu.RLock()
+	if p.commits.closed() {
+		p.mu.RUnlock()
+		return ErrClosed
+	}
+	var b *pebble.Batch
+	if indexed {
+		b = p.db.NewIndexedBatch()
+	} else {
+		b = p.db.NewBatch()
+	}
+	defer b.Close()
+	err := fill(b)
+	if err == nil {
+		err = b.Commit(pebble.NoSync)
+	}
+	if err == nil {
+		p.commits.wrote(b.Len())
+	}
+	p.mu.RUnlock()
+	return err
+}
+
+// Applied returns the index and term last recorded by Apply, or zeros
+func (p *PebbleKV) Applied() (index, term uint64, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	v, closer, err := p.db.Get(appliedKey)
 	if err == pebble.ErrNotFound {
-		return nil, false, nil
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closer.Close()
+
+	if len(v) != 16 {
+		return 0, 0, fmt.Errorf("storage: bad applied index record of %d bytes", len(v))
+	}
+	return binary.BigEndian.Uint64(v[:8]), binary.BigEndian.Uint64(v[8:]), nil
+}
+
+// Snapshot writes a consistent pebble checkpoint of the whole db as a tar
+// stream and returns the applied index/term the checkpoint contains
+func (p *PebbleKV) Snapshot(w io.Writer) (index, term uint64, err error) {
+	tmp, err := os.MkdirTemp(filepath.Dir(p.path), ".checkpoint-")
+	if err != nil {
+		return 0, 0, err
 	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "db")
 
+	// no Apply may land between reading the applied index and the checkpoint
+	p.applyMu.Lock()
+	index, term, err = p.Applied()
+	if err == nil {
+		p.mu.RLock()
+		err = p.db.Checkpoint(dir, pebble.WithFlushedWAL())
+		p.mu.RUnlock()
+	}
+	p.applyMu.Unlock()
 	if err != nil {
-		return nil, false, err
+		return 0, 0, err
 	}
 
-	defer closer.Close()
+	return index, term, writeTar(w, dir)
+}
+
+// Restore replaces the db with a checkpoint written by Snapshot. The new db
+// is unpacked next to the current one and swapped in with renames, so a
+// crash leaves either the old or the new db in place, never a mix.
+func (p *PebbleKV) Restore(r io.Reader) error {
+	p.applyMu.Lock()
+	defer p.applyMu.Unlock()
+
+	incoming := p.path + ".restore"
+	old := p.path + ".old"
+	if err := os.RemoveAll(incoming); err != nil {
+		return err
+	}
+	if err := readTar(r, incoming); err != nil {
+		os.RemoveAll(incoming)
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	cp := append([]byte(nil), v...)
-	return cp, true, nil
+	if err := p.db.Close(); err != nil {
+		return err
+	}
+	swapErr := swapDirs(p.path, incoming, old)
+
+	// whichever db ended up at path, keep serving from it
+	db, err := pebble.Open(p.path, &pebble.Options{})
+	if err != nil {
+		return err
+	}
+	p.db = db
+	if swapErr != nil {
+		return swapErr
+	}
+	if err := p.load(); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
 }
 
-// delete the kv pair from disk, pebble.Sync to persist the deletion
-func (p *PebbleKV) Delete(key []byte) error {
-	return p.db.Delete(key, pebble.Sync)
+// swapDirs moves path out of the way to old and incoming into its place,
+// putting path back if the second rename fails
+func swapDirs(path, incoming, old string) error {
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(path, old); err != nil {
+		return err
+	}
+	if err := os.Rename(incoming, path); err != nil {
+		_ = os.Rename(old, path)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
 }
 
-// gracefully shutdown the db
-func (p *PebbleKV) Close() error {
-	return p.db.Close()
+// writeTar writes the regular files in dir to w
+func writeTar(w io.Writer, dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		if !f.Type().IsRegular() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: f.Name(), Mode: 0o644, Size: info.Size(), ModTime: info.ModTime()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		src, err := os.Open(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// readTar unpacks a stream written by writeTar into a new dir, syncing
+// every file so the swap in Restore only ever sees complete data
+func readTar(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// checkpoints are flat, anything else is not ours
+		if hdr.Typeflag != tar.TypeReg || hdr.Name != filepath.Base(hdr.Name) {
+			return fmt.Errorf("storage: unexpected snapshot entry %q", hdr.Name)
+		}
+
+		f, err := os.OpenFile(filepath.Join(dir, hdr.Name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
 }
 
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
 
+// gracefully shutdown the db
+func (p *PebbleKV) Close() error {
+	// no write is halfway through while mu is held, those already in the
+	// db are synced before it closes and later ones get ErrClosed
+	p.mu.Lock()
+	p.commits.close()
+	p.mu.Unlock()
+	p.commits.wait()
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.db.Close()
+}
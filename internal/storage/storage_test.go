@@ -1,8 +1,17 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
 )
 
 func TestPebbleKV(t *testing.T) {
@@ -39,3 +48,671 @@ func TestPebbleKV(t *testing.T) {
 	_ = os.RemoveAll(dir)
 }
 
+
+func TestWriteBatch(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("old"), []byte("x")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	// later mutations win over earlier ones on the same key
+	err = db.WriteBatch([]Mutation{
+		{Key: []byte("user:1"), Value: []byte("ann")},
+		{Key: []byte("email:ann"), Value: []byte("user:1")},
+		{Delete: true, Key: []byte("old")},
+		{Key: []byte("tmp"), Value: []byte("1")},
+		{Delete: true, Key: []byte("tmp")},
+	})
+	if err != nil {
+		t.Fatalf("write batch failed: %v", err)
+	}
+
+	for key, want := range map[string]string{"user:1": "ann", "email:ann": "user:1", "old": "", "tmp": ""} {
+		got, ok, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		if ok != (want != "") || string(got) != want {
+			t.Fatalf("expected %q for %s, got %q (found %v)", want, key, got, ok)
+		}
+	}
+}
+
+func TestApplyRecordsIndex(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	muts := []Mutation{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Delete: true, Key: []byte("a")},
+	}
+	if _, err := db.Apply(muts, 7, 2); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	index, term, err := db.Applied()
+	if err != nil || index != 7 || term != 2 {
+		t.Fatalf("expected applied 7/2, got %d/%d (%v)", index, term, err)
+	}
+	if _, ok, _ := db.Get([]byte("a")); ok {
+		t.Fatalf("expected a to be deleted")
+	}
+	if v, ok, _ := db.Get([]byte("b")); !ok || string(v) != "2" {
+		t.Fatalf("expected b=2, got %q", v)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	absent := &Condition{Absent: true}
+	holds := func(v string) *Condition { return &Condition{Value: []byte(v)} }
+	for i, tc := range []struct {
+		muts    []Mutation
+		failed  bool
+		current string // what the failed condition found, "" if nothing
+	}{
+		{[]Mutation{{Key: []byte("lock"), Value: []byte("a"), If: absent}}, false, ""},
+		{[]Mutation{{Key: []byte("lock"), Value: []byte("b"), If: absent}}, true, "a"},
+		{[]Mutation{{Key: []byte("lock"), Value: []byte("b"), If: holds("x")}}, true, "a"},
+		{[]Mutation{{Key: []byte("lock"), Value: []byte("b"), If: holds("a")}}, false, ""},
+		// conditions see the mutations ahead of them in the batch, and a
+		// failed one drops the whole batch
+		{[]Mutation{
+			{Key: []byte("other"), Value: []byte("1")},
+			{Key: []byte("other"), Value: []byte("2"), If: holds("1")},
+			{Delete: true, Key: []byte("lock"), If: holds("a")},
+		}, true, "b"},
+		{[]Mutation{{Delete: true, Key: []byte("missing"), If: holds("")}}, true, ""},
+		{[]Mutation{{Delete: true, Key: []byte("lock"), If: holds("b")}}, false, ""},
+	} {
+		_, err := db.Apply(tc.muts, uint64(i+1), 1)
+		var failed *ConditionFailedError
+		if errors.As(err, &failed) != tc.failed || (err != nil && failed == nil) {
+			t.Fatalf("case %d: expected failed=%v, got %v", i, tc.failed, err)
+		}
+		if failed != nil && (string(failed.Value) != tc.current || failed.Found != (tc.current != "")) {
+			t.Fatalf("case %d: expected current value %q, got %q", i, tc.current, failed.Value)
+		}
+		// the entry counts as applied either way
+		if index, _, _ := db.Applied(); index != uint64(i+1) {
+			t.Fatalf("case %d: expected applied index %d, got %d", i, i+1, index)
+		}
+	}
+
+	if _, ok, _ := db.Get([]byte("lock")); ok {
+		t.Fatalf("expected lock to be deleted")
+	}
+	if _, ok, _ := db.Get([]byte("other")); ok {
+		t.Fatalf("expected the failed batch to leave nothing behind")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	src, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer src.Close()
+	// Restore swaps directories next to the db, give it a parent of its own
+	dst, err := Open(filepath.Join(t.TempDir(), "kv"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer dst.Close()
+
+	if _, err := src.Apply([]Mutation{{Key: []byte("k"), Value: []byte("v")}}, 3, 1); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	// stale data in dst must not survive the restore
+	if err := dst.Put([]byte("old"), []byte("x")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	index, term, err := src.Snapshot(&buf)
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if index != 3 || term != 1 {
+		t.Fatalf("expected snapshot at 3/1, got %d/%d", index, term)
+	}
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	if v, ok, _ := dst.Get([]byte("k")); !ok || string(v) != "v" {
+		t.Fatalf("expected k=v after restore, got %q", v)
+	}
+	if _, ok, _ := dst.Get([]byte("old")); ok {
+		t.Fatalf("expected old key to be gone after restore")
+	}
+	if index, term, _ := dst.Applied(); index != 3 || term != 1 {
+		t.Fatalf("expected applied 3/1 after restore, got %d/%d", index, term)
+	}
+}
+
+func TestAppliedEntriesShareSync(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	// entries are visible as soon as they are applied, one Sync makes them
+	// all durable
+	before := db.commits.groups.Load()
+	for i := uint64(1); i <= 10; i++ {
+		key := []byte(fmt.Sprintf("k%d", i))
+		if _, err := db.Apply([]Mutation{{Key: key, Value: key}}, i, 1); err != nil {
+			t.Fatalf("apply failed: %v", err)
+		}
+		if _, ok, _ := db.Get(key); !ok {
+			t.Fatalf("expected %s to be readable once applied", key)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if n := db.commits.groups.Load() - before; n != 1 {
+		t.Fatalf("expected one fsync for 10 applied entries, got %d", n)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	if index, _, _ := db.Applied(); index != 10 {
+		t.Fatalf("expected applied 10 after reopen, got %d", index)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	// writers racing each other end up sharing commits, every one of
+	// them must still be durable once its call returns
+	var wg sync.WaitGroup
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				key := []byte(fmt.Sprintf("w%d-%d", w, i))
+				if err := db.Put(key, key); err != nil {
+					t.Errorf("put failed: %v", err)
+					return
+				}
+			}
+			if err := db.Delete([]byte(fmt.Sprintf("w%d-0", w))); err != nil {
+				t.Errorf("delete failed: %v", err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if n := db.commits.groups.Load(); n >= 32*21 {
+		t.Fatalf("expected %d writes to share fsyncs, got %d", 32*21, n)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if err := db.Put([]byte("late"), nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed writing after close, got %v", err)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	for w := 0; w < 32; w++ {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("w%d-%d", w, i)
+			v, ok, err := db.Get([]byte(key))
+			if err != nil || ok != (i != 0) || (ok && string(v) != key) {
+				t.Fatalf("after reopen %s = %q, %v (%v)", key, v, ok, err)
+			}
+		}
+	}
+}
+
+func TestWritesRacingClose(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	// a write either makes it in and is durable, or gets ErrClosed and
+	// leaves nothing behind
+	written := make([]int, 8)
+	var wg sync.WaitGroup
+	for w := range written {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				err := db.Put([]byte(fmt.Sprintf("w%d-%d", w, i)), nil)
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("put failed: %v", err)
+					return
+				}
+				written[w]++
+			}
+		}(w)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	wg.Wait()
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	for w := range written {
+		n := written[w]
+		for i := 0; i <= n; i++ {
+			key := fmt.Sprintf("w%d-%d", w, i)
+			if _, ok, err := db.Get([]byte(key)); err != nil || ok != (i < n) {
+				t.Fatalf("after reopen %s found %v (%v), %d writes made it", key, ok, err, n)
+			}
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"event:1", "event:2", "event:3", "user:1", "user:2", "user:\xff", "zz"} {
+		if err := db.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	// internal state stays out of scans
+	if _, err := db.Apply(nil, 7, 1); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		opts ScanOptions
+		want []string
+	}{
+		{ScanOptions{}, []string{"event:1", "event:2", "event:3", "user:1", "user:2", "user:\xff", "zz"}},
+		{ScanOptions{Prefix: []byte("user:")}, []string{"user:1", "user:2", "user:\xff"}},
+		{ScanOptions{Prefix: []byte("event:"), Reverse: true, Limit: 2}, []string{"event:3", "event:2"}},
+		{ScanOptions{Start: []byte("event:2"), End: []byte("user:2")}, []string{"event:2", "event:3", "user:1"}},
+		{ScanOptions{Start: []byte("event:2"), Prefix: []byte("event:"), Limit: 1}, []string{"event:2"}},
+		{ScanOptions{Start: []byte("user"), End: []byte("event")}, nil},
+		{ScanOptions{Prefix: []byte("nope")}, nil},
+	} {
+		it, err := db.Scan(tc.opts)
+		if err != nil {
+			t.Fatalf("scan %+v failed: %v", tc.opts, err)
+		}
+		var got []string
+		for it.Next() {
+			if string(it.Value()) != "v"+string(it.Key()) {
+				t.Fatalf("key %q has value %q", it.Key(), it.Value())
+			}
+			got = append(got, string(it.Key()))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("scan %+v failed: %v", tc.opts, err)
+		}
+		it.Close()
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("scan %+v: expected %q, got %q", tc.opts, tc.want, got)
+		}
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	meta := func(key string) KeyMeta {
+		t.Helper()
+		_, m, _, err := db.GetMeta([]byte(key))
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		return m
+	}
+	// revisions 1 to 4, the last one a batch
+	for _, muts := range [][]Mutation{
+		{{Key: []byte("a"), Value: []byte("1")}},
+		{{Key: []byte("b"), Value: []byte("1")}},
+		{{Key: []byte("a"), Value: []byte("2")}},
+		{{Key: []byte("a"), Value: []byte("3")}, {Key: []byte("c")}},
+	} {
+		if err := db.WriteBatch(muts); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if m := meta("a"); m != (KeyMeta{CreateRevision: 1, ModRevision: 4, Version: 3}) {
+		t.Fatalf("unexpected metadata for a: %+v", m)
+	}
+
+	// a deleted key starts over when written again
+	if err := db.Delete([]byte("b")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := db.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if m := meta("b"); m != (KeyMeta{CreateRevision: 6, ModRevision: 6, Version: 1}) {
+		t.Fatalf("unexpected metadata for b: %+v", m)
+	}
+
+	// a write conditional on a stale revision changes nothing
+	err = db.WriteBatch([]Mutation{{Key: []byte("a"), Value: []byte("x"), If: &Condition{ModRevision: 3}}})
+	var failed *ConditionFailedError
+	if !errors.As(err, &failed) || failed.Meta.ModRevision != 4 {
+		t.Fatalf("expected the condition to fail at revision 4, got %v", err)
+	}
+	metas, err := db.Apply([]Mutation{{Key: []byte("a"), Value: []byte("y"), If: &Condition{ModRevision: 4}}}, 1, 1)
+	if err != nil || metas[0] != (KeyMeta{CreateRevision: 1, ModRevision: 7, Version: 4}) {
+		t.Fatalf("expected a at revision 7, got %+v (%v)", metas, err)
+	}
+	// entries without mutations don't count
+	if _, err := db.Apply(nil, 2, 1); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	db.Close()
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	if rev := db.Revision(); rev != 7 {
+		t.Fatalf("expected revision 7 after reopening, got %d", rev)
+	}
+}
+
+func TestUpgradeBareValues(t *testing.T) {
+	dir := t.TempDir()
+	// how values were stored before revisions were kept
+	old, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		t.Fatalf("failed to open pebble: %v", err)
+	}
+	old.Set([]byte("dk"), []byte("v"), pebble.Sync)
+	old.Set(appliedKey, make([]byte, 16), pebble.Sync)
+	old.Close()
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	v, m, ok, err := db.GetMeta([]byte("k"))
+	if err != nil || !ok || string(v) != "v" || m != (KeyMeta{Version: 1}) {
+		t.Fatalf("expected k=v at version 1, got %q %+v (%v)", v, m, err)
+	}
+	if err := db.Put([]byte("k"), []byte("w")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	// the upgrade took revision 1, for the keys kept at 0
+	if _, m, _, _ := db.GetMeta([]byte("k")); m != (KeyMeta{ModRevision: 2, Version: 2}) {
+		t.Fatalf("unexpected metadata after writing again: %+v", m)
+	}
+	if v, _, _, _ := db.GetAt([]byte("k"), 1); string(v) != "v" {
+		t.Fatalf("expected k=v at revision 1, got %q", v)
+	}
+}
+
+func TestUpgradeRevisionedValues(t *testing.T) {
+	dir := t.TempDir()
+	// how values were stored before versions were kept, written at 5
+	old, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		t.Fatalf("failed to open pebble: %v", err)
+	}
+	header := make([]byte, metaSize)
+	header[7], header[15], header[23] = 3, 5, 2
+	old.Set([]byte("dk"), append(header, 'v'), pebble.Sync)
+	old.Set(formatKey, []byte{0, 0, 0, 0, 0, 0, 0, 1}, pebble.Sync)
+	old.Set(revisionKey, []byte{0, 0, 0, 0, 0, 0, 0, 5}, pebble.Sync)
+	old.Close()
+
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	v, m, ok, err := db.GetMeta([]byte("k"))
+	if err != nil || !ok || string(v) != "v" || m != (KeyMeta{CreateRevision: 3, ModRevision: 5, Version: 2}) {
+		t.Fatalf("expected k=v at revision 5, got %q %+v (%v)", v, m, err)
+	}
+	// there is no history from before the upgrade
+	if _, _, _, err := db.GetAt([]byte("k"), 4); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected revision 4 to be compacted, got %v", err)
+	}
+	if _, _, err := db.RevisionAt(time.Now().Add(-time.Hour)); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected an hour ago to be compacted, got %v", err)
+	}
+	if rev, ok, err := db.RevisionAt(time.Now()); err != nil || !ok || rev != 5 {
+		t.Fatalf("expected revision 5 now, got %d %v (%v)", rev, ok, err)
+	}
+}
+
+func TestReadAsOf(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	// revisions 1 to 5 written a second apart, 0x00 in keys must not mix
+	// up their versions
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, muts := range [][]Mutation{
+		{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("a\x00"), Value: []byte("x")}},
+		{{Key: []byte("b"), Value: []byte("1")}},
+		{{Key: []byte("a"), Value: []byte("2")}},
+		{{Delete: true, Key: []byte("b")}},
+		{{Key: []byte("c"), Value: []byte("1")}},
+	} {
+		if _, err := db.ApplyAt(muts, uint64(i+1), 1, base.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("apply failed: %v", err)
+		}
+	}
+
+	get := func(key string, rev uint64) string {
+		t.Helper()
+		v, m, ok, err := db.GetAt([]byte(key), rev)
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		if !ok {
+			return "-"
+		}
+		return fmt.Sprintf("%s@%d", v, m.ModRevision)
+	}
+	scan := func(rev uint64, reverse bool) string {
+		t.Helper()
+		it, err := db.Scan(ScanOptions{Revision: rev, Reverse: reverse})
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		defer it.Close()
+		var got []string
+		for it.Next() {
+			got = append(got, fmt.Sprintf("%q=%s", it.Key(), it.Value()))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		return strings.Join(got, " ")
+	}
+
+	for _, c := range []struct {
+		key  string
+		rev  uint64
+		want string
+	}{
+		{"a", 0, "2@3"}, {"a", 1, "1@1"}, {"a", 2, "1@1"}, {"a", 9, "2@3"},
+		{"b", 1, "-"}, {"b", 3, "1@2"}, {"b", 4, "-"},
+		{"a\x00", 1, "x@1"}, {"c", 4, "-"},
+	} {
+		if got := get(c.key, c.rev); got != c.want {
+			t.Errorf("%q as of %d: expected %s, got %s", c.key, c.rev, c.want, got)
+		}
+	}
+	if got := scan(2, false); got != `"a"=1 "a\x00"=x "b"=1` {
+		t.Errorf("unexpected scan as of 2: %s", got)
+	}
+	if got := scan(4, true); got != `"a\x00"=x "a"=2` {
+		t.Errorf("unexpected reverse scan as of 4: %s", got)
+	}
+	if got := scan(0, false); got != `"a"=2 "a\x00"=x "c"=1` {
+		t.Errorf("unexpected scan: %s", got)
+	}
+
+	for _, c := range []struct {
+		at   time.Duration
+		want uint64
+		ok   bool
+	}{
+		{-time.Second, 0, false}, {0, 1, true}, {2500 * time.Millisecond, 3, true}, {time.Hour, 5, true},
+	} {
+		if rev, ok, err := db.RevisionAt(base.Add(c.at)); err != nil || rev != c.want || ok != c.ok {
+			t.Errorf("revision at %v: expected %d %v, got %d %v (%v)", c.at, c.want, c.ok, rev, ok, err)
+		}
+	}
+
+	// a write without a time could have happened any time after the last
+	// one with a time
+	if _, err := db.Apply([]Mutation{{Key: []byte("d"), Value: []byte("1")}}, 6, 1); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if _, _, err := db.RevisionAt(base.Add(time.Hour)); !errors.Is(err, ErrCompacted) {
+		t.Errorf("expected no revision for a time before revision 6, got %v", err)
+	}
+	if _, err := db.ApplyAt([]Mutation{{Key: []byte("d"), Value: []byte("2")}}, 7, 1, base.Add(time.Hour)); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if rev, _, err := db.RevisionAt(base.Add(time.Hour)); err != nil || rev != 7 {
+		t.Errorf("expected revision 7, got %d (%v)", rev, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	// revisions 1 to 4
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, muts := range [][]Mutation{
+		{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("1")}},
+		{{Key: []byte("a"), Value: []byte("2")}},
+		{{Delete: true, Key: []byte("b")}},
+		{{Key: []byte("a"), Value: []byte("3")}},
+	} {
+		if _, err := db.ApplyAt(muts, uint64(i+1), 1, base.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("apply failed: %v", err)
+		}
+	}
+	if err := db.Compact(3, 5, 1); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	// compacting no further only records the entry
+	if err := db.Compact(2, 6, 1); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	db.Close()
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen db: %v", err)
+	}
+	defer db.Close()
+	if c := db.Compacted(); c != 3 {
+		t.Fatalf("expected compacted revision 3, got %d", c)
+	}
+	if index, _, _ := db.Applied(); index != 6 {
+		t.Fatalf("expected applied index 6, got %d", index)
+	}
+	if _, _, _, err := db.GetAt([]byte("a"), 2); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected revision 2 to be compacted, got %v", err)
+	}
+	if v, _, _, err := db.GetAt([]byte("a"), 3); err != nil || string(v) != "2" {
+		t.Fatalf("expected a=2 as of 3, got %q (%v)", v, err)
+	}
+	if _, _, err := db.RevisionAt(base.Add(time.Second)); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("expected the time of revision 2 to be compacted, got %v", err)
+	}
+
+	// all that's left are a's versions at 2 and 4
+	var versions int
+	it, _ := db.db.NewIter(&pebble.IterOptions{LowerBound: versionPrefix, UpperBound: PrefixEnd(versionPrefix)})
+	for it.First(); it.Valid(); it.Next() {
+		versions++
+	}
+	it.Close()
+	if versions != 2 {
+		t.Fatalf("expected 2 versions left, got %d", versions)
+	}
+}
+
+func TestCompactFailureKeepsMark(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := db.Apply([]Mutation{{Key: []byte("a"), Value: []byte{byte('0' + i)}}}, uint64(i), 1); err != nil {
+			t.Fatalf("apply failed: %v", err)
+		}
+	}
+	if err := db.Compact(2, 4, 1); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	db.Close()
+
+	// nothing was deleted, so reads from 2 on must still be allowed
+	if err := db.Compact(3, 5, 1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if c := db.Compacted(); c != 2 {
+		t.Fatalf("expected the compacted revision to stay at 2, got %d", c)
+	}
+}